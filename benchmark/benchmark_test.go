@@ -1,16 +1,36 @@
 package benchmark
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"btree"
+	"lsm/compaction"
 	"lsm/lsmtree"
 )
 
+// strategyName selects the LSM compaction strategy, e.g.
+// go test -bench LSM -args -lsm.strategy=fifo
+var strategyName = flag.String("lsm.strategy", "", "LSM compaction strategy: "+strings.Join(compaction.Names(), ", "))
+
+// newLSM opens a tree in dir with the strategy chosen by -lsm.strategy, or
+// without one.
+func newLSM(dir string, threshold int) (*lsmtree.LSMTree, error) {
+	if *strategyName == "" {
+		return lsmtree.New(dir, threshold)
+	}
+	strategy, err := compaction.ByName(*strategyName)
+	if err != nil {
+		return nil, err
+	}
+	return lsmtree.NewWithStrategy(dir, threshold, strategy)
+}
+
 type kv struct {
 	k string
 	v string
@@ -37,7 +57,7 @@ func BenchmarkWriteLSM(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		os.RemoveAll("bench_lsm")
-		tree, err := lsmtree.New("bench_lsm", 1000)
+		tree, err := newLSM("bench_lsm", 1000)
 		if err != nil {
 			b.Fatalf("new lsm: %v", err)
 		}
@@ -46,6 +66,9 @@ func BenchmarkWriteLSM(b *testing.B) {
 				b.Fatalf("put: %v", err)
 			}
 		}
+		if err := tree.Close(); err != nil {
+			b.Fatalf("close: %v", err)
+		}
 	}
 }
 
@@ -68,12 +91,13 @@ func BenchmarkWriteBTree(b *testing.B) {
 
 func prepLSM(data []kv) (*lsmtree.LSMTree, error) {
 	os.RemoveAll("bench_lsm")
-	t, err := lsmtree.New("bench_lsm", 1000)
+	t, err := newLSM("bench_lsm", 1000)
 	if err != nil {
 		return nil, err
 	}
 	for _, kv := range data {
 		if err := t.Put(kv.k, kv.v); err != nil {
+			t.Close()
 			return nil, err
 		}
 	}
@@ -100,6 +124,7 @@ func BenchmarkReadLSM(b *testing.B) {
 	if err != nil {
 		b.Fatalf("prep lsm: %v", err)
 	}
+	defer tree.Close()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		for _, kv := range data {
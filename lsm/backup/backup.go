@@ -0,0 +1,270 @@
+// Package backup keeps incremental backups of an LSM tree in a directory.
+//
+// A backup directory is laid out as:
+//
+//	shared/         table and blob files, each stored once and shared by every backup that includes it
+//	private/<id>/   the manifest and write-ahead log of one backup
+//	meta/<id>.json  the description of one backup
+//
+// Tables are immutable, so a new backup only uploads the tables created
+// since the previous one; blob files are only appended to, and uploaded
+// again once they grew. Shared files are named by file name, checksum and
+// size, so files from diverging histories never collide.
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"lsm/lsmtree"
+)
+
+// File is a table or blob file included in a backup.
+type File struct {
+	Name   string // file name inside the tree directory
+	Shared string // file name inside shared/
+	Size   int64
+}
+
+// Info describes a single backup.
+type Info struct {
+	ID        int
+	CreatedAt time.Time
+	Tables    []File
+	Private   []string // files in private/<id>/
+	Size      int64    // total bytes of the backup
+	NewTables int      // tables uploaded by this backup
+}
+
+// Engine manages the backups stored in Dir.
+type Engine struct {
+	Dir string
+}
+
+// Open opens or creates a backup directory.
+func Open(dir string) (*Engine, error) {
+	for _, sub := range []string{"shared", "private", "meta"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{Dir: dir}, nil
+}
+
+// CreateBackup takes a checkpoint of tree and stores it as a new backup,
+// uploading only tables not already present in the backup directory.
+func (e *Engine) CreateBackup(tree *lsmtree.LSMTree) (*Info, error) {
+	infos, err := e.List()
+	if err != nil {
+		return nil, err
+	}
+	info := &Info{ID: 1, CreatedAt: time.Now()}
+	if len(infos) > 0 {
+		info.ID = infos[len(infos)-1].ID + 1
+	}
+
+	tmp := filepath.Join(e.Dir, fmt.Sprintf("tmp-%d", info.ID))
+	os.RemoveAll(tmp)
+	if err := tree.Checkpoint(tmp); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return nil, err
+	}
+	private := filepath.Join(e.Dir, "private", fmt.Sprint(info.ID))
+	if err := os.MkdirAll(private, 0o755); err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		src := filepath.Join(tmp, entry.Name())
+		stat, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		info.Size += stat.Size()
+
+		ext := filepath.Ext(entry.Name())
+		if ext != ".sst" && ext != ".blob" {
+			if err := copyFile(src, filepath.Join(private, entry.Name())); err != nil {
+				return nil, err
+			}
+			info.Private = append(info.Private, entry.Name())
+			continue
+		}
+
+		sum, err := checksum(src)
+		if err != nil {
+			return nil, err
+		}
+		shared := fmt.Sprintf("%s_%08x_%d%s", strings.TrimSuffix(entry.Name(), ext), sum, stat.Size(), ext)
+		dst := filepath.Join(e.Dir, "shared", shared)
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			if err := copyFile(src, dst); err != nil {
+				return nil, err
+			}
+			info.NewTables++
+		} else if err != nil {
+			return nil, err
+		}
+		info.Tables = append(info.Tables, File{Name: entry.Name(), Shared: shared, Size: stat.Size()})
+	}
+
+	// The backup only exists once its metadata is written
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(e.metaPath(info.ID), data, 0o644); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// List returns all backups, oldest first.
+func (e *Engine) List() ([]Info, error) {
+	paths, err := filepath.Glob(filepath.Join(e.Dir, "meta", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var infos []Info
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var info Info
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("backup: bad metadata %s: %w", path, err)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos, nil
+}
+
+// Restore recreates backup id in destDir, which must not exist. The result
+// can be opened with lsmtree.New.
+func (e *Engine) Restore(id int, destDir string) error {
+	info, err := e.info(id)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(destDir); err == nil {
+		return fmt.Errorf("backup: restore directory %s already exists", destDir)
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range info.Tables {
+		if err := copyFile(filepath.Join(e.Dir, "shared", f.Shared), filepath.Join(destDir, f.Name)); err != nil {
+			os.RemoveAll(destDir)
+			return err
+		}
+	}
+	for _, name := range info.Private {
+		src := filepath.Join(e.Dir, "private", fmt.Sprint(id), name)
+		if err := copyFile(src, filepath.Join(destDir, name)); err != nil {
+			os.RemoveAll(destDir)
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes backup id and any shared tables no other backup uses.
+func (e *Engine) Delete(id int) error {
+	if _, err := e.info(id); err != nil {
+		return err
+	}
+	if err := os.Remove(e.metaPath(id)); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(e.Dir, "private", fmt.Sprint(id))); err != nil {
+		return err
+	}
+
+	infos, err := e.List()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, info := range infos {
+		for _, f := range info.Tables {
+			used[f.Shared] = true
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(e.Dir, "shared"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !used[entry.Name()] {
+			os.Remove(filepath.Join(e.Dir, "shared", entry.Name()))
+		}
+	}
+	return nil
+}
+
+func (e *Engine) info(id int) (*Info, error) {
+	data, err := os.ReadFile(e.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("backup: no backup with id %d", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var info Info
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (e *Engine) metaPath(id int) string {
+	return filepath.Join(e.Dir, "meta", fmt.Sprintf("%d.json", id))
+}
+
+func checksum(path string) (uint32, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, f); err != nil {
+		return 0, err
+	}
+	return h.Sum32(), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"lsm/lsmtree"
+)
+
+func TestIncrementalBackupAndRestore(t *testing.T) {
+	dbDir, backupDir := "test_backup_db", "test_backup_dir"
+	restoreDir := "test_backup_restore"
+	for _, dir := range []string{dbDir, backupDir, restoreDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	tree, err := lsmtree.New(dbDir, 2)
+	if err != nil {
+		t.Fatalf("new tree: %v", err)
+	}
+	defer tree.Close()
+	engine, err := Open(backupDir)
+	if err != nil {
+		t.Fatalf("open backup engine: %v", err)
+	}
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := tree.Put(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i)); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+	}
+
+	put(0, 4)
+	first, err := engine.CreateBackup(tree)
+	if err != nil {
+		t.Fatalf("first backup: %v", err)
+	}
+	put(4, 9)
+	second, err := engine.CreateBackup(tree)
+	if err != nil {
+		t.Fatalf("second backup: %v", err)
+	}
+	if first.NewTables != 2 || second.NewTables != 2 || len(second.Tables) != 4 {
+		t.Fatalf("expected incremental uploads, got first=%+v second=%+v", first, second)
+	}
+
+	// Restoring the first backup must not see later writes
+	if err := engine.Restore(first.ID, restoreDir); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	restored, err := lsmtree.New(restoreDir, 2)
+	if err != nil {
+		t.Fatalf("open restored tree: %v", err)
+	}
+	if v, ok, _ := restored.Get("k03"); !ok || v != "v3" {
+		t.Fatalf("restored k03 = %q, %v", v, ok)
+	}
+	if _, ok, _ := restored.Get("k05"); ok {
+		t.Fatalf("restored backup should not contain k05")
+	}
+	restored.Close()
+
+	if err := engine.Delete(first.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	os.RemoveAll(restoreDir)
+	if err := engine.Restore(second.ID, restoreDir); err != nil {
+		t.Fatalf("restore second after deleting first: %v", err)
+	}
+	restored, err = lsmtree.New(restoreDir, 2)
+	if err != nil {
+		t.Fatalf("open restored tree: %v", err)
+	}
+	defer restored.Close()
+	for i := 0; i < 9; i++ {
+		if v, ok, _ := restored.Get(fmt.Sprintf("k%02d", i)); !ok || v != fmt.Sprintf("v%d", i) {
+			t.Fatalf("restored k%02d = %q, %v", i, v, ok)
+		}
+	}
+}
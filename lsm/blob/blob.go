@@ -0,0 +1,119 @@
+// Package blob implements append-only blob files that hold large values
+// outside SSTables, so compaction moves small references instead of the
+// values themselves (key-value separation as in WiscKey).
+package blob
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ref locates a value in a blob file.
+type Ref struct {
+	File   uint64 // blob file number
+	Offset int64  // position of the value in the file
+	Size   int    // length of the value in bytes
+}
+
+// String encodes the reference as stored in tables: file:offset:size.
+func (r Ref) String() string {
+	return fmt.Sprintf("%d:%d:%d", r.File, r.Offset, r.Size)
+}
+
+// ParseRef decodes a reference written by Ref.String.
+func ParseRef(s string) (Ref, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Ref{}, fmt.Errorf("blob: bad reference %q", s)
+	}
+	file, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Ref{}, fmt.Errorf("blob: bad reference %q: %w", s, err)
+	}
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Ref{}, fmt.Errorf("blob: bad reference %q: %w", s, err)
+	}
+	size, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return Ref{}, fmt.Errorf("blob: bad reference %q: %w", s, err)
+	}
+	return Ref{File: file, Offset: offset, Size: size}, nil
+}
+
+// Writer appends values to a blob file. It is safe for concurrent use.
+type Writer struct {
+	Path   string
+	Number uint64
+
+	mu   sync.Mutex
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+// Create creates blob file number at path, replacing any file there.
+func Create(path string, number uint64) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{Path: path, Number: number, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Add appends value and returns its reference. The value is only durable
+// after Sync.
+func (w *Writer) Add(value string) (Ref, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.w.WriteString(value); err != nil {
+		return Ref{}, err
+	}
+	ref := Ref{File: w.Number, Offset: w.size, Size: len(value)}
+	w.size += int64(len(value))
+	return ref, nil
+}
+
+// Size returns the number of bytes written.
+func (w *Writer) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Sync flushes the file to stable storage.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	return w.f.Sync()
+}
+
+// Close syncs and closes the file.
+func (w *Writer) Close() error {
+	if err := w.Sync(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// Read returns the value ref points to in the blob file at path.
+func Read(path string, ref Ref) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, ref.Size)
+	if _, err := f.ReadAt(buf, ref.Offset); err != nil {
+		return "", fmt.Errorf("blob: read %s at %d: %w", path, ref.Offset, err)
+	}
+	return string(buf), nil
+}
@@ -1,6 +1,7 @@
 package bloom
 
 import (
+	"fmt"
 	"hash/fnv"
 )
 
@@ -34,6 +35,19 @@ func (b *Bloom) Contains(s string) bool {
 	return true
 }
 
+// Union adds every element of other to b. Both filters must have the same
+// size and number of hash functions.
+func (b *Bloom) Union(other *Bloom) error {
+	if len(b.bits) != len(other.bits) || b.k != other.k {
+		return fmt.Errorf("bloom: cannot union filters of %d bits, %d hashes and %d bits, %d hashes",
+			len(b.bits), b.k, len(other.bits), other.k)
+	}
+	for i, bit := range other.bits {
+		b.bits[i] |= bit
+	}
+	return nil
+}
+
 func (b *Bloom) hashes(s string) []uint {
 	hashes := make([]uint, b.k)
 	h := fnv.New64a()
@@ -0,0 +1,228 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// CountingBloom implements a counting Bloom filter that supports deletions.
+//
+// Counters saturate: once a counter reaches its maximum it is sticky and is
+// never decremented again, since the true count behind it is unknown.
+// Decrementing it could reach zero while elements remain and produce false
+// negatives; a stuck counter only costs some false positives.
+type CountingBloom struct {
+	counters    []uint8 // one counter per byte, or two per byte when packed
+	m           uint    // number of counters
+	k           uint
+	counterBits uint // 8, or 4 when packed
+	elements    uint // adds minus removes
+}
+
+// NewCounting creates a counting Bloom filter with m 8-bit counters
+func NewCounting(m uint, k uint) *CountingBloom {
+	return &CountingBloom{
+		counters:    make([]uint8, m),
+		m:           m,
+		k:           k,
+		counterBits: 8,
+	}
+}
+
+// NewCounting4 creates a counting Bloom filter with m 4-bit counters packed
+// two per byte. Counters saturate at 15, which is rarely reached with a
+// sensibly sized filter, for half the memory of NewCounting.
+func NewCounting4(m uint, k uint) *CountingBloom {
+	return &CountingBloom{
+		counters:    make([]uint8, (m+1)/2),
+		m:           m,
+		k:           k,
+		counterBits: 4,
+	}
+}
+
+// Add increments counters for the element
+func (cb *CountingBloom) Add(s string) {
+	limit := cb.limit()
+	for _, idx := range cb.hashes(s) {
+		pos := idx % cb.m
+		if c := cb.get(pos); c < limit {
+			cb.set(pos, c+1)
+		}
+	}
+	cb.elements++
+}
+
+// Remove decrements counters for the element. Removing an element that was
+// never added can cause false negatives for others, so elements the filter
+// rules out are ignored; saturated counters are left as they are.
+func (cb *CountingBloom) Remove(s string) {
+	if !cb.Contains(s) {
+		return
+	}
+	limit := cb.limit()
+	for _, idx := range cb.hashes(s) {
+		pos := idx % cb.m
+		if c := cb.get(pos); c > 0 && c < limit {
+			cb.set(pos, c-1)
+		}
+	}
+	if cb.elements > 0 {
+		cb.elements--
+	}
+}
+
+// Contains checks if element might be in the set
+func (cb *CountingBloom) Contains(s string) bool {
+	for _, idx := range cb.hashes(s) {
+		if cb.get(idx%cb.m) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SizeInBits implements Filter.
+func (cb *CountingBloom) SizeInBits() uint { return cb.m * cb.counterBits }
+
+// Stats returns statistics about the filter
+func (cb *CountingBloom) Stats() CountingStats {
+	var nonZero, saturated uint
+	limit := cb.limit()
+	for pos := uint(0); pos < cb.m; pos++ {
+		switch c := cb.get(pos); {
+		case c == limit:
+			saturated++
+			nonZero++
+		case c > 0:
+			nonZero++
+		}
+	}
+	fillRatio := float64(nonZero) / float64(cb.m)
+	return CountingStats{
+		Size:              cb.m,
+		CounterBits:       cb.counterBits,
+		HashFunctions:     cb.k,
+		ActualElements:    cb.elements,
+		FalsePositiveRate: math.Pow(fillRatio, float64(cb.k)),
+		FillRatio:         fillRatio,
+		NonZeroCounters:   nonZero,
+		SaturatedCounters: saturated,
+	}
+}
+
+// CountingStats contains statistics about a counting Bloom filter
+type CountingStats struct {
+	Size              uint // number of counters
+	CounterBits       uint
+	HashFunctions     uint
+	ActualElements    uint    // adds minus removes
+	FalsePositiveRate float64 // estimated from the fill ratio, which accounts for removes
+	FillRatio         float64
+	NonZeroCounters   uint
+	SaturatedCounters uint // sticky counters that removes no longer decrement
+}
+
+// String returns a formatted string representation of the stats
+func (cs CountingStats) String() string {
+	return fmt.Sprintf(`Counting Bloom Filter Statistics:
+  Size: %d counters of %d bits
+  Hash Functions: %d
+  Actual Elements: %d
+  False Positive Rate: %.4f (%.2f%%)
+  Fill Ratio: %.4f (%.2f%%)
+  Saturated Counters: %d/%d`,
+		cs.Size, cs.CounterBits, cs.HashFunctions, cs.ActualElements,
+		cs.FalsePositiveRate, cs.FalsePositiveRate*100,
+		cs.FillRatio, cs.FillRatio*100,
+		cs.SaturatedCounters, cs.Size)
+}
+
+// countingVersion is the first byte of the MarshalBinary encoding.
+const countingVersion = 1
+
+// countingHeader is the size of the encoding before the counters: version,
+// counter bits, k, m and element count.
+const countingHeader = 1 + 1 + 4 + 8 + 8
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (cb *CountingBloom) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, countingHeader, countingHeader+len(cb.counters))
+	buf[0] = countingVersion
+	buf[1] = uint8(cb.counterBits)
+	binary.BigEndian.PutUint32(buf[2:], uint32(cb.k))
+	binary.BigEndian.PutUint64(buf[6:], uint64(cb.m))
+	binary.BigEndian.PutUint64(buf[14:], uint64(cb.elements))
+	return append(buf, cb.counters...), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (cb *CountingBloom) UnmarshalBinary(data []byte) error {
+	if len(data) < countingHeader {
+		return errors.New("bloom: counting filter encoding too short")
+	}
+	if data[0] != countingVersion {
+		return fmt.Errorf("bloom: unknown counting filter version %d", data[0])
+	}
+	counterBits := uint(data[1])
+	if counterBits != 4 && counterBits != 8 {
+		return fmt.Errorf("bloom: bad counter size %d", counterBits)
+	}
+	k := uint(binary.BigEndian.Uint32(data[2:]))
+	m := uint(binary.BigEndian.Uint64(data[6:]))
+	elements := uint(binary.BigEndian.Uint64(data[14:]))
+	size := m
+	if counterBits == 4 {
+		size = (m + 1) / 2
+	}
+	if m == 0 || uint(len(data)-countingHeader) != size {
+		return fmt.Errorf("bloom: counting filter of %d counters has %d bytes of data", m, len(data)-countingHeader)
+	}
+
+	*cb = CountingBloom{
+		counters:    append([]uint8(nil), data[countingHeader:]...),
+		m:           m,
+		k:           k,
+		counterBits: counterBits,
+		elements:    elements,
+	}
+	return nil
+}
+
+// limit returns the saturated counter value.
+func (cb *CountingBloom) limit() uint8 {
+	return uint8(1<<cb.counterBits - 1)
+}
+
+// get returns counter pos.
+func (cb *CountingBloom) get(pos uint) uint8 {
+	if cb.counterBits == 8 {
+		return cb.counters[pos]
+	}
+	return cb.counters[pos/2] >> (4 * (pos % 2)) & 0x0f
+}
+
+// set stores c in counter pos.
+func (cb *CountingBloom) set(pos uint, c uint8) {
+	if cb.counterBits == 8 {
+		cb.counters[pos] = c
+		return
+	}
+	shift := 4 * (pos % 2)
+	cb.counters[pos/2] = cb.counters[pos/2]&^(0x0f<<shift) | c<<shift
+}
+
+func (cb *CountingBloom) hashes(s string) []uint {
+	hashes := make([]uint, cb.k)
+	h := fnv.New64a()
+	for i := uint(0); i < cb.k; i++ {
+		h.Reset()
+		h.Write([]byte{byte(i)})
+		h.Write([]byte(s))
+		hashes[i] = uint(h.Sum64())
+	}
+	return hashes
+}
@@ -0,0 +1,139 @@
+package bloom
+
+// cuckooBucketSize is the number of fingerprints per bucket.
+const cuckooBucketSize = 4
+
+// cuckooMaxKicks bounds the evictions tried before an insert gives up.
+const cuckooMaxKicks = 500
+
+// Cuckoo is a cuckoo filter (Fan et al., 2014) with 16-bit fingerprints.
+// Unlike a Bloom filter it supports deleting keys, and unlike a counting
+// Bloom filter it stays compact while doing so: about 17 bits per key at a
+// 95% load for a false positive rate near 0.01%.
+type Cuckoo struct {
+	buckets [][cuckooBucketSize]uint16
+	count   uint
+	rng     uint64
+}
+
+// NewCuckoo creates a cuckoo filter with room for at least capacity keys.
+func NewCuckoo(capacity uint) *Cuckoo {
+	// Tables fill to about 95% before inserts start failing
+	want := uint(float64(capacity)/cuckooBucketSize/0.95) + 1
+	n := uint(1)
+	for n < want {
+		n <<= 1
+	}
+	return &Cuckoo{buckets: make([][cuckooBucketSize]uint16, n), rng: 0x9e3779b97f4a7c15}
+}
+
+// Insert adds a string to the filter, reporting false if the filter is too
+// full to take it. The filter is unchanged on failure.
+func (c *Cuckoo) Insert(s string) bool {
+	fp, i1, i2 := c.locate(s)
+	if c.put(i1, fp) || c.put(i2, fp) {
+		c.count++
+		return true
+	}
+
+	// Evict random fingerprints to their alternate bucket, remembering
+	// the moves so they can be undone if no free slot turns up
+	type move struct {
+		bucket uint
+		slot   int
+		fp     uint16
+	}
+	var moves []move
+	i := i1
+	if c.next()&1 == 1 {
+		i = i2
+	}
+	for n := 0; n < cuckooMaxKicks; n++ {
+		slot := int(c.next() % cuckooBucketSize)
+		moves = append(moves, move{bucket: i, slot: slot, fp: c.buckets[i][slot]})
+		fp, c.buckets[i][slot] = c.buckets[i][slot], fp
+		i = c.alt(i, fp)
+		if c.put(i, fp) {
+			c.count++
+			return true
+		}
+	}
+	for n := len(moves) - 1; n >= 0; n-- {
+		m := moves[n]
+		c.buckets[m.bucket][m.slot] = m.fp
+	}
+	return false
+}
+
+// Delete removes one copy of a string previously inserted, reporting
+// whether it was found. Deleting a key that was never inserted may remove
+// another key sharing its fingerprint.
+func (c *Cuckoo) Delete(s string) bool {
+	fp, i1, i2 := c.locate(s)
+	for _, i := range [2]uint{i1, i2} {
+		for j, f := range c.buckets[i] {
+			if f == fp {
+				c.buckets[i][j] = 0
+				c.count--
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Contains checks if a string is possibly in the set.
+func (c *Cuckoo) Contains(s string) bool {
+	fp, i1, i2 := c.locate(s)
+	for _, i := range [2]uint{i1, i2} {
+		for _, f := range c.buckets[i] {
+			if f == fp {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Count returns the number of keys held.
+func (c *Cuckoo) Count() uint { return c.count }
+
+// SizeInBits implements Filter.
+func (c *Cuckoo) SizeInBits() uint { return uint(len(c.buckets)) * cuckooBucketSize * 16 }
+
+// locate returns the fingerprint of s and its two candidate buckets. Zero
+// marks an empty slot, so fingerprints are never zero.
+func (c *Cuckoo) locate(s string) (uint16, uint, uint) {
+	h := hash64(s)
+	fp := uint16(h >> 48)
+	if fp == 0 {
+		fp = 1
+	}
+	i1 := uint(h) & uint(len(c.buckets)-1)
+	return fp, i1, c.alt(i1, fp)
+}
+
+// alt returns the other bucket of a fingerprint stored in bucket i. It is
+// its own inverse, so a fingerprint can move without its key.
+func (c *Cuckoo) alt(i uint, fp uint16) uint {
+	return (i ^ uint(mix64(uint64(fp)))) & uint(len(c.buckets)-1)
+}
+
+// put stores fp in a free slot of bucket i.
+func (c *Cuckoo) put(i uint, fp uint16) bool {
+	for j, f := range c.buckets[i] {
+		if f == 0 {
+			c.buckets[i][j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// next is a xorshift generator choosing eviction victims deterministically.
+func (c *Cuckoo) next() uint64 {
+	c.rng ^= c.rng << 13
+	c.rng ^= c.rng >> 7
+	c.rng ^= c.rng << 17
+	return c.rng
+}
@@ -2,7 +2,6 @@ package bloom
 
 import (
 	"fmt"
-	"hash/fnv"
 	"math"
 )
 
@@ -45,6 +44,23 @@ func (eb *EnhancedBloom) Add(s string) {
 	eb.actualElements++
 }
 
+// Union adds every element of other to eb. Both filters must have the same
+// size and number of hash functions; their element counts are summed.
+func (eb *EnhancedBloom) Union(other *EnhancedBloom) error {
+	if err := eb.Bloom.Union(other.Bloom); err != nil {
+		return err
+	}
+	eb.actualElements += other.actualElements
+	return nil
+}
+
+// clone returns a deep copy of the filter.
+func (eb *EnhancedBloom) clone() *EnhancedBloom {
+	c := *eb
+	c.Bloom = &Bloom{bits: append([]byte(nil), eb.bits...), k: eb.k}
+	return &c
+}
+
 // Stats returns statistics about the filter
 func (eb *EnhancedBloom) Stats() BloomStats {
 	// Calculate current false positive probability
@@ -101,62 +117,3 @@ func (bs BloomStats) String() string {
 		bs.FillRatio, bs.FillRatio*100,
 		bs.SetBits, bs.Size)
 }
-
-// CountingBloom implements a counting Bloom filter that supports deletions
-type CountingBloom struct {
-	counters []uint8
-	k        uint
-}
-
-// NewCounting creates a counting Bloom filter
-func NewCounting(m uint, k uint) *CountingBloom {
-	return &CountingBloom{
-		counters: make([]uint8, m),
-		k:        k,
-	}
-}
-
-// Add increments counters for the element
-func (cb *CountingBloom) Add(s string) {
-	indexes := cb.hashes(s)
-	for _, idx := range indexes {
-		pos := idx % uint(len(cb.counters))
-		if cb.counters[pos] < 255 { // Prevent overflow
-			cb.counters[pos]++
-		}
-	}
-}
-
-// Remove decrements counters for the element
-func (cb *CountingBloom) Remove(s string) {
-	indexes := cb.hashes(s)
-	for _, idx := range indexes {
-		pos := idx % uint(len(cb.counters))
-		if cb.counters[pos] > 0 {
-			cb.counters[pos]--
-		}
-	}
-}
-
-// Contains checks if element might be in the set
-func (cb *CountingBloom) Contains(s string) bool {
-	indexes := cb.hashes(s)
-	for _, idx := range indexes {
-		if cb.counters[idx%uint(len(cb.counters))] == 0 {
-			return false
-		}
-	}
-	return true
-}
-
-func (cb *CountingBloom) hashes(s string) []uint {
-	hashes := make([]uint, cb.k)
-	h := fnv.New64a()
-	for i := uint(0); i < cb.k; i++ {
-		h.Reset()
-		h.Write([]byte{byte(i)})
-		h.Write([]byte(s))
-		hashes[i] = uint(h.Sum64())
-	}
-	return hashes
-}
@@ -0,0 +1,158 @@
+package bloom
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Filter is an approximate-membership filter: Contains never reports false
+// for a key in the set, but may report true for keys that are not.
+type Filter interface {
+	Contains(s string) bool
+	// SizeInBits is the size of the filter's table, the figure behind its
+	// bits per key.
+	SizeInBits() uint
+}
+
+// Policy builds filters over a known set of keys, as for an immutable table.
+type Policy interface {
+	// Name identifies the policy and its parameters; ParsePolicy(Name())
+	// returns an equivalent policy.
+	Name() string
+	Build(keys []string) Filter
+}
+
+// BloomPolicy builds classic Bloom filters with BitsPerKey bits per key.
+type BloomPolicy struct {
+	BitsPerKey int
+}
+
+// Name implements Policy.
+func (p BloomPolicy) Name() string { return fmt.Sprintf("bloom:%d", p.BitsPerKey) }
+
+// Build implements Policy.
+func (p BloomPolicy) Build(keys []string) Filter {
+	b := New(uint(len(keys)*p.BitsPerKey+1), optimalK(float64(p.BitsPerKey)))
+	for _, k := range keys {
+		b.Add(k)
+	}
+	return b
+}
+
+// BlockedPolicy builds cache-line-blocked Bloom filters with BitsPerKey bits
+// per key.
+type BlockedPolicy struct {
+	BitsPerKey int
+}
+
+// Name implements Policy.
+func (p BlockedPolicy) Name() string { return fmt.Sprintf("blocked:%d", p.BitsPerKey) }
+
+// Build implements Policy.
+func (p BlockedPolicy) Build(keys []string) Filter {
+	b := NewBlocked(uint(len(keys)), p.BitsPerKey)
+	for _, k := range keys {
+		b.Add(k)
+	}
+	return b
+}
+
+// XorPolicy builds xor filters with 8-bit fingerprints.
+type XorPolicy struct{}
+
+// Name implements Policy.
+func (XorPolicy) Name() string { return "xor8" }
+
+// Build implements Policy.
+func (XorPolicy) Build(keys []string) Filter { return NewXor8(keys) }
+
+// CuckooPolicy builds cuckoo filters with 16-bit fingerprints, growing the
+// table until every key fits.
+type CuckooPolicy struct{}
+
+// Name implements Policy.
+func (CuckooPolicy) Name() string { return "cuckoo" }
+
+// Build implements Policy.
+func (CuckooPolicy) Build(keys []string) Filter {
+	for capacity := uint(len(keys)) + 1; ; capacity *= 2 {
+		c := NewCuckoo(capacity)
+		ok := true
+		for _, k := range keys {
+			// Skipping keys already reported keeps duplicates from
+			// overflowing their two buckets
+			if !c.Contains(k) && !c.Insert(k) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return c
+		}
+	}
+}
+
+// ParsePolicy returns the policy with the given name. The empty name means
+// no policy and returns nil.
+func ParsePolicy(name string) (Policy, error) {
+	kind, arg, _ := strings.Cut(name, ":")
+	bitsPerKey := func() (int, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("bloom: bad bits per key in policy %q", name)
+		}
+		return n, nil
+	}
+	switch kind {
+	case "":
+		return nil, nil
+	case "bloom":
+		n, err := bitsPerKey()
+		return BloomPolicy{BitsPerKey: n}, err
+	case "blocked":
+		n, err := bitsPerKey()
+		return BlockedPolicy{BitsPerKey: n}, err
+	case "xor8":
+		return XorPolicy{}, nil
+	case "cuckoo":
+		return CuckooPolicy{}, nil
+	}
+	return nil, fmt.Errorf("bloom: unknown filter policy %q", name)
+}
+
+// optimalK returns the number of hash functions minimizing the false
+// positive rate at bitsPerKey bits per key.
+func optimalK(bitsPerKey float64) uint {
+	k := uint(math.Round(bitsPerKey * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return k
+}
+
+// hash64 is the base hash the newer filters derive their probes from.
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix64(h.Sum64())
+}
+
+// mix64 is the MurmurHash3 finalizer; it spreads FNV's weak low bits.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// SizeInBits implements Filter. Each bit is stored in a byte, so the table
+// actually takes 8 times as much memory as a packed one would.
+func (b *Bloom) SizeInBits() uint { return uint(len(b.bits)) }
@@ -0,0 +1,259 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+)
+
+// falsePositiveRate builds a filter over n keys with policy, checks that
+// every key is reported and measures the rate on keys never added.
+func falsePositiveRate(t *testing.T, policy Policy, n, probes int) (float64, float64) {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	f := policy.Build(keys)
+	for _, k := range keys {
+		if !f.Contains(k) {
+			t.Fatalf("%s: false negative for %s", policy.Name(), k)
+		}
+	}
+	hits := 0
+	for i := 0; i < probes; i++ {
+		if f.Contains(fmt.Sprintf("absent-%d", i)) {
+			hits++
+		}
+	}
+	return float64(f.SizeInBits()) / float64(n), float64(hits) / float64(probes)
+}
+
+func TestFilterComparison(t *testing.T) {
+	const n, probes = 20000, 200000
+
+	cases := []struct {
+		policy Policy
+		maxFPR float64 // expected rate with some slack
+	}{
+		{BloomPolicy{BitsPerKey: 6}, 0.07},
+		{BloomPolicy{BitsPerKey: 10}, 0.013},
+		{BloomPolicy{BitsPerKey: 16}, 0.001},
+		{BlockedPolicy{BitsPerKey: 6}, 0.08},
+		{BlockedPolicy{BitsPerKey: 10}, 0.016},
+		{BlockedPolicy{BitsPerKey: 16}, 0.003}, // uneven block loads cost more as bits/key grow
+		{XorPolicy{}, 0.006},
+		{CuckooPolicy{}, 0.0005},
+	}
+
+	t.Logf("%-12s %10s %10s", "policy", "bits/key", "FPR")
+	for _, c := range cases {
+		bitsPerKey, fpr := falsePositiveRate(t, c.policy, n, probes)
+		t.Logf("%-12s %10.2f %9.4f%%", c.policy.Name(), bitsPerKey, fpr*100)
+		if fpr > c.maxFPR {
+			t.Fatalf("%s: false positive rate %.4f above %.4f", c.policy.Name(), fpr, c.maxFPR)
+		}
+	}
+
+	// At the same memory, the xor filter beats a classic Bloom filter
+	xorBits, xorFPR := falsePositiveRate(t, XorPolicy{}, n, probes)
+	_, bloomFPR := falsePositiveRate(t, BloomPolicy{BitsPerKey: int(xorBits + 0.5)}, n, probes)
+	if xorFPR >= bloomFPR {
+		t.Fatalf("Expected xor8 FPR %.4f below Bloom FPR %.4f at %.1f bits/key", xorFPR, bloomFPR, xorBits)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, policy := range []Policy{BloomPolicy{BitsPerKey: 10}, BlockedPolicy{BitsPerKey: 12}, XorPolicy{}, CuckooPolicy{}} {
+		parsed, err := ParsePolicy(policy.Name())
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", policy.Name(), err)
+		}
+		if parsed != policy {
+			t.Fatalf("Expected %v, got %v", policy, parsed)
+		}
+	}
+	if policy, err := ParsePolicy(""); policy != nil || err != nil {
+		t.Fatalf("Empty name should mean no policy, got %v, %v", policy, err)
+	}
+	for _, name := range []string{"bloom", "blocked:x", "ribbon"} {
+		if _, err := ParsePolicy(name); err == nil {
+			t.Fatalf("Expected an error for %q", name)
+		}
+	}
+}
+
+func TestCuckooDelete(t *testing.T) {
+	c := NewCuckoo(1000)
+	for i := 0; i < 1000; i++ {
+		if !c.Insert(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("Insert %d failed below capacity", i)
+		}
+	}
+	for i := 0; i < 1000; i += 2 {
+		if !c.Delete(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("Failed to delete key-%d", i)
+		}
+	}
+	if c.Count() != 500 {
+		t.Fatalf("Expected 500 keys after deletes, got %d", c.Count())
+	}
+	stillPresent := 0
+	for i := 0; i < 1000; i++ {
+		found := c.Contains(fmt.Sprintf("key-%d", i))
+		if i%2 == 1 && !found {
+			t.Fatalf("key-%d lost after deleting others", i)
+		}
+		if i%2 == 0 && found {
+			stillPresent++
+		}
+	}
+	if stillPresent > 5 {
+		t.Fatalf("Expected deleted keys to be gone, %d still reported", stillPresent)
+	}
+
+	// A full filter rejects inserts without losing keys
+	small := NewCuckoo(8)
+	var inserted []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if small.Insert(key) {
+			inserted = append(inserted, key)
+		}
+	}
+	if len(inserted) == 100 {
+		t.Fatalf("Expected a small filter to fill up")
+	}
+	for _, key := range inserted {
+		if !small.Contains(key) {
+			t.Fatalf("%s lost when the filter filled up", key)
+		}
+	}
+}
+
+func TestScalableBloom(t *testing.T) {
+	const target = 0.01
+	measure := func(f Filter, probes int) float64 {
+		hits := 0
+		for i := 0; i < probes; i++ {
+			if f.Contains(fmt.Sprintf("absent-%d", i)) {
+				hits++
+			}
+		}
+		return float64(hits) / float64(probes)
+	}
+
+	// 100 times more elements than the first stage was sized for
+	scalable := NewScalable(100, target)
+	fixed := NewEnhanced(100, target)
+	for i := 0; i < 10000; i++ {
+		scalable.Add(fmt.Sprintf("key-%d", i))
+		fixed.Add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < 10000; i++ {
+		if !scalable.Contains(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("False negative for key-%d", i)
+		}
+	}
+	stats := scalable.Stats()
+	if stats.Stages < 2 || stats.ActualElements != 10000 {
+		t.Fatalf("Expected several stages holding 10000 elements, got %d stages with %d", stats.Stages, stats.ActualElements)
+	}
+	if stats.FalsePositiveRate > target {
+		t.Fatalf("Estimated FPR %.4f above target %.4f", stats.FalsePositiveRate, target)
+	}
+	if fpr := measure(scalable, 100000); fpr > target {
+		t.Fatalf("Measured FPR %.4f above target %.4f", fpr, target)
+	}
+	if fpr := measure(fixed, 100000); fpr < 0.5 {
+		t.Fatalf("Expected an overfilled fixed-size filter to degrade, measured FPR %.4f", fpr)
+	}
+
+	// Union without rehashing keys
+	a, b := NewScalable(100, target), NewScalable(100, target)
+	for i := 0; i < 3000; i++ {
+		a.Add(fmt.Sprintf("key-%d", i))
+		b.Add(fmt.Sprintf("key-%d", i+3000))
+	}
+	if err := a.Union(b); err != nil {
+		t.Fatalf("Failed to union: %v", err)
+	}
+	for i := 0; i < 6000; i++ {
+		if !a.Contains(fmt.Sprintf("key-%d", i)) {
+			t.Fatalf("False negative for key-%d after union", i)
+		}
+	}
+	if fpr := measure(a, 100000); fpr > 2*target {
+		t.Fatalf("Measured FPR %.4f after union above %.4f", fpr, 2*target)
+	}
+	if err := a.Union(NewScalable(200, target)); err == nil {
+		t.Fatalf("Union of filters with different parameters should fail")
+	}
+}
+
+func TestCountingBloomSaturation(t *testing.T) {
+	for _, cb := range []*CountingBloom{NewCounting(64, 3), NewCounting4(64, 3)} {
+		limit := 1<<cb.counterBits - 1
+		// Drive the counters of hot past saturation
+		for i := 0; i < limit+10; i++ {
+			cb.Add("hot")
+		}
+		cb.Add("other")
+		for i := 0; i < limit+10; i++ {
+			cb.Remove("hot")
+		}
+		// The sticky counters must still cover other
+		if !cb.Contains("other") {
+			t.Fatalf("%d-bit counters: false negative after removing a saturated element", cb.counterBits)
+		}
+		stats := cb.Stats()
+		if stats.SaturatedCounters == 0 {
+			t.Fatalf("%d-bit counters: expected saturated counters in stats", cb.counterBits)
+		}
+		if stats.ActualElements != 1 {
+			t.Fatalf("%d-bit counters: expected 1 element left, got %d", cb.counterBits, stats.ActualElements)
+		}
+	}
+
+	// Unsaturated counters still support deletion
+	cb := NewCounting4(1000, 3)
+	cb.Add("a")
+	cb.Add("b")
+	cb.Remove("a")
+	cb.Remove("never-added")
+	if cb.Contains("a") || !cb.Contains("b") {
+		t.Fatalf("Expected only b after removing a")
+	}
+	if cb.SizeInBits() != 4000 {
+		t.Fatalf("Expected 4000 bits for 1000 packed counters, got %d", cb.SizeInBits())
+	}
+}
+
+func TestCountingBloomMarshal(t *testing.T) {
+	for _, cb := range []*CountingBloom{NewCounting(101, 4), NewCounting4(101, 4)} {
+		for i := 0; i < 50; i++ {
+			cb.Add(fmt.Sprintf("key-%d", i))
+		}
+		data, err := cb.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to marshal: %v", err)
+		}
+		var decoded CountingBloom
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("Failed to unmarshal: %v", err)
+		}
+		if decoded.Stats() != cb.Stats() {
+			t.Fatalf("Stats differ after round trip: %v vs %v", decoded.Stats(), cb.Stats())
+		}
+		for i := 0; i < 50; i++ {
+			if !decoded.Contains(fmt.Sprintf("key-%d", i)) {
+				t.Fatalf("key-%d lost in round trip", i)
+			}
+		}
+		decoded.Remove("key-0")
+		if !cb.Contains("key-0") {
+			t.Fatalf("Decoded filter should not share counters with the original")
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); err == nil {
+			t.Fatalf("Expected an error for truncated data")
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package bloom
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// scalableGrowth is how much larger each new stage is than the last.
+	scalableGrowth = 2
+	// scalableTightening scales the error rate of each new stage, so the
+	// rates form a geometric series whose sum stays below the target.
+	scalableTightening = 0.8
+)
+
+// ScalableBloom is a Bloom filter that grows as elements are added
+// (Almeida et al., 2007). It chains EnhancedBloom stages, each larger than
+// the last and with a tighter error rate, so the overall false positive
+// rate stays below the target however many elements are added.
+type ScalableBloom struct {
+	stages          []*EnhancedBloom
+	initialCapacity uint
+	falsePositive   float64
+}
+
+// NewScalable creates a scalable Bloom filter whose first stage holds
+// initialCapacity elements, keeping the false positive rate below fpr.
+func NewScalable(initialCapacity uint, fpr float64) *ScalableBloom {
+	if initialCapacity < 1 {
+		initialCapacity = 1
+	}
+	s := &ScalableBloom{initialCapacity: initialCapacity, falsePositive: fpr}
+	s.grow()
+	return s
+}
+
+// grow appends the next stage.
+func (s *ScalableBloom) grow() {
+	i := len(s.stages)
+	capacity := s.initialCapacity * uint(math.Pow(scalableGrowth, float64(i)))
+	fpr := s.falsePositive * (1 - scalableTightening) * math.Pow(scalableTightening, float64(i))
+	s.stages = append(s.stages, NewEnhanced(capacity, fpr))
+}
+
+// Add inserts an element, starting a new stage once the current one is full.
+func (s *ScalableBloom) Add(str string) {
+	last := s.stages[len(s.stages)-1]
+	if last.actualElements >= last.expectedElements {
+		s.grow()
+		last = s.stages[len(s.stages)-1]
+	}
+	last.Add(str)
+}
+
+// Contains checks if an element is possibly in the set.
+func (s *ScalableBloom) Contains(str string) bool {
+	for _, stage := range s.stages {
+		if stage.Contains(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// SizeInBits implements Filter.
+func (s *ScalableBloom) SizeInBits() uint {
+	var size uint
+	for _, stage := range s.stages {
+		size += stage.SizeInBits()
+	}
+	return size
+}
+
+// Union adds every element of other to s without rehashing. Matching
+// stages are combined bit by bit when their elements fit in one stage;
+// other stages are appended whole, so the union's false positive rate is
+// at most the sum of the two filters' rates. The filters must have been
+// created with the same parameters.
+func (s *ScalableBloom) Union(other *ScalableBloom) error {
+	if s.initialCapacity != other.initialCapacity || s.falsePositive != other.falsePositive {
+		return fmt.Errorf("bloom: cannot union scalable filters with capacity %d, FPR %g and capacity %d, FPR %g",
+			s.initialCapacity, s.falsePositive, other.initialCapacity, other.falsePositive)
+	}
+	n := len(s.stages)
+	for i, stage := range other.stages {
+		if i < n && s.stages[i].actualElements+stage.actualElements <= s.stages[i].expectedElements {
+			if err := s.stages[i].Union(stage); err != nil {
+				return err
+			}
+			continue
+		}
+		s.stages = append(s.stages, stage.clone())
+	}
+	return nil
+}
+
+// Stats returns statistics about the filter.
+func (s *ScalableBloom) Stats() ScalableStats {
+	stats := ScalableStats{
+		Stages:                  len(s.stages),
+		TargetFalsePositiveRate: s.falsePositive,
+	}
+	// An element is a false positive unless every stage rejects it
+	pass := 1.0
+	for _, stage := range s.stages {
+		st := stage.Stats()
+		stats.Size += st.Size
+		stats.ActualElements += st.ActualElements
+		pass *= 1 - st.FalsePositiveRate
+	}
+	stats.FalsePositiveRate = 1 - pass
+	return stats
+}
+
+// ScalableStats contains statistics about a scalable Bloom filter.
+type ScalableStats struct {
+	Stages                  int
+	Size                    uint
+	ActualElements          uint
+	FalsePositiveRate       float64 // estimated from the stages' fill
+	TargetFalsePositiveRate float64
+}
+
+// String returns a formatted string representation of the stats
+func (ss ScalableStats) String() string {
+	return fmt.Sprintf(`Scalable Bloom Filter Statistics:
+  Stages: %d
+  Size: %d bits
+  Actual Elements: %d
+  False Positive Rate: %.4f (%.2f%%)
+  Target False Positive Rate: %.4f (%.2f%%)`,
+		ss.Stages, ss.Size, ss.ActualElements,
+		ss.FalsePositiveRate, ss.FalsePositiveRate*100,
+		ss.TargetFalsePositiveRate, ss.TargetFalsePositiveRate*100)
+}
@@ -1,14 +1,28 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"lsm/compaction"
 	"lsm/lsmtree"
 )
 
 func main() {
+	strategyName := flag.String("strategy", "", "compaction strategy run after flushes: "+strings.Join(compaction.Names(), ", "))
+	flag.Parse()
+	var strategy compaction.Strategy
+	if *strategyName != "" {
+		var err error
+		if strategy, err = compaction.ByName(*strategyName); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
 	// Clean up any existing data
 	dataDir := "demo_data"
 	os.RemoveAll(dataDir)
@@ -19,11 +33,21 @@ func main() {
 	fmt.Println()
 
 	// Create basic LSM tree with small threshold for demonstration
-	tree, err := lsmtree.New(dataDir, 3) // Small threshold to trigger flushes
+	var tree *lsmtree.LSMTree
+	var err error
+	if strategy == nil {
+		tree, err = lsmtree.New(dataDir, 3) // Small threshold to trigger flushes
+	} else {
+		tree, err = lsmtree.NewWithStrategy(dataDir, 3, strategy)
+	}
 	if err != nil {
 		panic(err)
 	}
+	defer tree.Close()
 	fmt.Printf("✓ Created LSM tree with memtable threshold: 3\n")
+	if strategy != nil {
+		fmt.Printf("✓ Compaction strategy: %s\n", strategy.Name())
+	}
 	fmt.Printf("✓ Data directory: %s\n", dataDir)
 
 	fmt.Println("\n1. Inserting data (will trigger memtable flushes)...")
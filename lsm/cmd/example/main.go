@@ -56,6 +56,7 @@ func basicLSMDemo(dataDir string) {
 	if err != nil {
 		panic(err)
 	}
+	defer tree.Close()
 	fmt.Printf("   ✓ Created LSM tree with memtable threshold: 3\n")
 	fmt.Printf("   ✓ Data directory: %s\n", dataDir)
 
@@ -156,7 +157,7 @@ func bloomFilterDemo() {
 	fmt.Printf("   Expected FP rate: %.3f%%\n", stats.FalsePositiveRate*100)
 
 	fmt.Println("\n4. Counting Bloom Filter (supports deletion)...")
-	countingBloom := bloom.NewCounting(1000, 3)
+	countingBloom := bloom.NewCounting4(1000, 3) // 4-bit counters, two per byte
 
 	// Add elements
 	for _, elem := range elements {
@@ -168,6 +169,8 @@ func bloomFilterDemo() {
 	fmt.Printf("\n   Before deletion - contains 'banana': %t\n", countingBloom.Contains("banana"))
 	countingBloom.Remove("banana")
 	fmt.Printf("   After deletion - contains 'banana': %t\n", countingBloom.Contains("banana"))
+	countingStats := countingBloom.Stats()
+	fmt.Printf("   Elements: %d, saturated counters: %d\n", countingStats.ActualElements, countingStats.SaturatedCounters)
 }
 
 func enhancedLSMDemo(dataDir string) {
@@ -177,6 +180,8 @@ func enhancedLSMDemo(dataDir string) {
 		compaction.NewSizeTieredStrategy(),
 		compaction.NewLeveledStrategy(),
 		compaction.NewTimeBasedStrategy(),
+		compaction.NewUniversalStrategy(),
+		&compaction.FIFOStrategy{MaxTotalSize: 512}, // tiny cap so the demo drops tables
 	}
 
 	for i, strategy := range strategies {
@@ -189,6 +194,7 @@ func enhancedLSMDemo(dataDir string) {
 		if err != nil {
 			panic(err)
 		}
+		defer tree.Close()
 
 		// Insert data in batches to trigger compaction
 		batches := []map[string]string{
@@ -214,7 +220,7 @@ func enhancedLSMDemo(dataDir string) {
 		// Show statistics
 		if stats := tree.Stats(); stats != nil {
 			fmt.Printf("     Writes: %d, Reads: %d\n", stats.TotalWrites, stats.TotalReads)
-			fmt.Printf("     Compactions: %d, Flushes: %d\n", stats.CompactionCount, stats.TotalFlushes)
+			fmt.Printf("     Compactions: %d, Flushes: %d, Tables dropped: %d\n", stats.CompactionCount, stats.TotalFlushes, stats.TablesDropped)
 		} else {
 			fmt.Printf("     Statistics not enabled for this tree\n")
 		}
@@ -236,6 +242,7 @@ func performanceDemo(dataDir string) {
 		if err != nil {
 			panic(err)
 		}
+		defer tree.Close()
 
 		// Measure write performance
 		start := time.Now()
@@ -0,0 +1,335 @@
+package compaction
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"lsm/sstable"
+	"lsm/wal"
+)
+
+// entryOverhead approximates the bytes a table spends on an entry besides
+// its key and value: timestamp, kind and separators.
+const entryOverhead = 24
+
+// Write is one put in a workload.
+type Write struct {
+	Key       string
+	ValueSize int
+	Time      time.Time
+}
+
+// Workload is a sequence of writes replayed by a Simulator.
+type Workload []Write
+
+// SyntheticWorkload returns n writes of valueSize-byte values to keys drawn
+// uniformly from keySpace keys, one every interval starting at start. The
+// same seed gives the same workload. keySpace must be positive and n must
+// not be negative.
+func SyntheticWorkload(n, keySpace, valueSize int, start time.Time, interval time.Duration, seed int64) Workload {
+	rng := rand.New(rand.NewSource(seed))
+	w := make(Workload, n)
+	for i := range w {
+		w[i] = Write{
+			Key:       fmt.Sprintf("key-%08d", rng.Intn(keySpace)),
+			ValueSize: valueSize,
+			Time:      start.Add(time.Duration(i) * interval),
+		}
+	}
+	return w
+}
+
+// WorkloadFromWAL records the puts and merges of a tree's write-ahead log
+// as a workload.
+func WorkloadFromWAL(path string) (Workload, error) {
+	var w Workload
+	err := wal.Replay(path, func(r wal.Record) error {
+		if r.Op == wal.OpPut || r.Op == wal.OpMerge {
+			w = append(w, Write{Key: r.Key, ValueSize: len(r.Value), Time: time.Unix(0, r.Timestamp)})
+		}
+		return nil
+	})
+	return w, err
+}
+
+// Simulator replays a workload against a Strategy without any I/O. Tables
+// are modelled by their keys and sizes, and compaction runs as in
+// LSMTree: after each memtable flush, tables a Dropper strategy gives up
+// are deleted and at most one compaction runs.
+//
+// Strategies that read the clock, such as TimeBasedStrategy, should be
+// given the simulator's Now so windows follow the workload's timestamps.
+type Simulator struct {
+	Strategy     Strategy
+	MemtableSize int // distinct keys buffered before a flush
+	SampleEvery  int // writes between samples; 0 samples only at the end
+	LookupSample int // keys probed to measure read amplification (default 200)
+
+	now     time.Time
+	tables  []*sstable.SSTable
+	content map[*sstable.SSTable]map[string]simEntry
+	nextID  int
+}
+
+// simEntry is the newest version of a key held by a simulated table.
+type simEntry struct {
+	size int64
+	seq  uint64
+}
+
+// SimResult summarizes a simulation.
+type SimResult struct {
+	Strategy       string
+	Writes         int
+	Flushes        int
+	Compactions    int
+	Dropped        int   // tables deleted by a Dropper strategy
+	UserBytes      int64 // key and value bytes written by the workload
+	FlushedBytes   int64 // bytes written by memtable flushes
+	CompactedBytes int64 // bytes written by compactions
+	Samples        []Sample
+}
+
+// Final returns the last sample, taken when the workload has been replayed.
+func (r SimResult) Final() Sample {
+	if len(r.Samples) == 0 {
+		return Sample{}
+	}
+	return r.Samples[len(r.Samples)-1]
+}
+
+// Sample is the state of a simulated tree after a number of writes.
+type Sample struct {
+	Writes      int
+	Tables      int
+	Compactions int
+	// WriteAmp is bytes written to tables per byte written by the user.
+	WriteAmp float64
+	// SpaceAmp is bytes held in tables per byte of live data in them.
+	SpaceAmp float64
+	// ReadAmp is the average number of tables a point lookup of a stored
+	// key consults, newest first, before finding it.
+	ReadAmp float64
+}
+
+// Now returns the simulated time: the timestamp of the write being replayed.
+func (s *Simulator) Now() time.Time {
+	return s.now
+}
+
+// Run replays w and returns the measurements.
+func (s *Simulator) Run(w Workload) SimResult {
+	s.tables = nil
+	s.content = make(map[*sstable.SSTable]map[string]simEntry)
+	s.nextID = 0
+	memtableSize := s.MemtableSize
+	if memtableSize < 1 {
+		memtableSize = 1
+	}
+
+	res := SimResult{Strategy: s.Strategy.Name()}
+	mem := make(map[string]simEntry)
+	var memStart time.Time
+	var seq uint64
+	var keys []string // distinct keys in order of first write
+	seen := make(map[string]bool)
+
+	for i, write := range w {
+		s.now = write.Time
+		seq++
+		if len(mem) == 0 {
+			memStart = write.Time
+		}
+		size := int64(len(write.Key) + write.ValueSize)
+		mem[write.Key] = simEntry{size: size + entryOverhead, seq: seq}
+		res.Writes++
+		res.UserBytes += size
+		if !seen[write.Key] {
+			seen[write.Key] = true
+			keys = append(keys, write.Key)
+		}
+
+		if len(mem) >= memtableSize {
+			res.FlushedBytes += s.flush(mem, memStart, write.Time)
+			res.Flushes++
+			mem = make(map[string]simEntry)
+			if s.Strategy.ShouldCompact(s.tables) {
+				if dropper, ok := s.Strategy.(Dropper); ok {
+					drop := dropper.DropTables(s.tables)
+					s.removeTables(drop)
+					res.Dropped += len(drop)
+				}
+				if s.Strategy.ShouldCompact(s.tables) {
+					if written, ok := s.compact(); ok {
+						res.Compactions++
+						res.CompactedBytes += written
+					}
+				}
+			}
+		}
+
+		if s.SampleEvery > 0 && (i+1)%s.SampleEvery == 0 && i+1 < len(w) {
+			res.Samples = append(res.Samples, s.sample(&res, keys))
+		}
+	}
+	res.Samples = append(res.Samples, s.sample(&res, keys))
+	return res
+}
+
+// flush turns the memtable into a level 0 table and returns its size.
+func (s *Simulator) flush(mem map[string]simEntry, start, end time.Time) int64 {
+	content := make(map[string]simEntry, len(mem))
+	var size int64
+	minSeq, maxSeq := ^uint64(0), uint64(0)
+	for k, e := range mem {
+		content[k] = e
+		size += e.size
+		if e.seq < minSeq {
+			minSeq = e.seq
+		}
+		if e.seq > maxSeq {
+			maxSeq = e.seq
+		}
+	}
+	s.addTable(content, size, sstable.Metadata{
+		CreatedAt:    end,
+		MinTimestamp: start,
+		MaxTimestamp: end,
+		Entries:      len(content),
+		MinSeq:       minSeq,
+		MaxSeq:       maxSeq,
+	})
+	return size
+}
+
+// compact merges the tables the strategy selects into one and returns the
+// bytes written, reporting false if the strategy selected too few tables.
+func (s *Simulator) compact() (int64, bool) {
+	selected := s.Strategy.SelectTables(s.tables)
+	if len(selected) < 2 {
+		return 0, false
+	}
+
+	content := make(map[string]simEntry)
+	meta := sstable.Metadata{Level: OutputLevel(s.Strategy, selected), CreatedAt: s.now, MinSeq: ^uint64(0)}
+	for i, table := range selected {
+		for k, e := range s.content[table] {
+			if old, ok := content[k]; !ok || e.seq > old.seq {
+				content[k] = e
+			}
+		}
+		if i == 0 || table.Meta.MinTimestamp.Before(meta.MinTimestamp) {
+			meta.MinTimestamp = table.Meta.MinTimestamp
+		}
+		if table.Meta.MaxTimestamp.After(meta.MaxTimestamp) {
+			meta.MaxTimestamp = table.Meta.MaxTimestamp
+		}
+		if table.Meta.MinSeq < meta.MinSeq {
+			meta.MinSeq = table.Meta.MinSeq
+		}
+		if table.Meta.MaxSeq > meta.MaxSeq {
+			meta.MaxSeq = table.Meta.MaxSeq
+		}
+	}
+	var size int64
+	for _, e := range content {
+		size += e.size
+	}
+	meta.Entries = len(content)
+
+	s.removeTables(selected)
+	s.addTable(content, size, meta)
+	return size, true
+}
+
+// removeTables deletes tables from the simulated tree.
+func (s *Simulator) removeTables(tables []*sstable.SSTable) {
+	remove := make(map[*sstable.SSTable]bool, len(tables))
+	for _, table := range tables {
+		remove[table] = true
+		delete(s.content, table)
+	}
+	kept := s.tables[:0]
+	for _, table := range s.tables {
+		if !remove[table] {
+			kept = append(kept, table)
+		}
+	}
+	s.tables = kept
+}
+
+// addTable adds a simulated table, keeping tables ordered oldest first.
+func (s *Simulator) addTable(content map[string]simEntry, size int64, meta sstable.Metadata) {
+	meta.Version = 1
+	first := true
+	for k := range content {
+		if first || k < meta.SmallestKey {
+			meta.SmallestKey = k
+		}
+		if first || k > meta.LargestKey {
+			meta.LargestKey = k
+		}
+		first = false
+	}
+	table := &sstable.SSTable{
+		Path: fmt.Sprintf("sim-%d.sst", s.nextID),
+		Size: size,
+		Meta: meta,
+	}
+	s.nextID++
+	s.content[table] = content
+	s.tables = append(s.tables, table)
+	sort.SliceStable(s.tables, func(i, j int) bool { return s.tables[i].Meta.MaxSeq < s.tables[j].Meta.MaxSeq })
+}
+
+// sample measures the current state.
+func (s *Simulator) sample(res *SimResult, keys []string) Sample {
+	smp := Sample{Writes: res.Writes, Tables: len(s.tables), Compactions: res.Compactions}
+	if res.UserBytes > 0 {
+		smp.WriteAmp = float64(res.FlushedBytes+res.CompactedBytes) / float64(res.UserBytes)
+	}
+
+	// Live data is the newest version of every key in the tables
+	live := make(map[string]simEntry)
+	var total int64
+	for _, table := range s.tables {
+		total += table.Size
+		for k, e := range s.content[table] {
+			if old, ok := live[k]; !ok || e.seq > old.seq {
+				live[k] = e
+			}
+		}
+	}
+	var liveBytes int64
+	for _, e := range live {
+		liveBytes += e.size
+	}
+	if liveBytes > 0 {
+		smp.SpaceAmp = float64(total) / float64(liveBytes)
+	}
+
+	n := s.LookupSample
+	if n <= 0 {
+		n = 200
+	}
+	var probes, lookups int
+	for i := 0; i < n && len(keys) > 0; i++ {
+		key := keys[i*len(keys)/n]
+		if _, ok := live[key]; !ok {
+			continue // still in the memtable, or dropped
+		}
+		lookups++
+		for j := len(s.tables) - 1; j >= 0; j-- {
+			probes++
+			if _, ok := s.content[s.tables[j]][key]; ok {
+				break
+			}
+		}
+	}
+	if lookups > 0 {
+		smp.ReadAmp = float64(probes) / float64(lookups)
+	}
+	return smp
+}
@@ -0,0 +1,107 @@
+package compaction
+
+import (
+	"testing"
+	"time"
+
+	"lsm/sstable"
+)
+
+func TestSimulator(t *testing.T) {
+	workload := SyntheticWorkload(5000, 1000, 50, time.Unix(0, 0), time.Second, 1)
+
+	run := func(strategy Strategy) SimResult {
+		sim := &Simulator{Strategy: strategy, MemtableSize: 50, SampleEvery: 1000}
+		if tb, ok := strategy.(*TimeBasedStrategy); ok {
+			tb.Now = sim.Now
+		}
+		return sim.Run(workload)
+	}
+
+	for _, strategy := range []Strategy{NewSizeTieredStrategy(), NewLeveledStrategy(), NewTimeBasedStrategy(), NewUniversalStrategy()} {
+		res := run(strategy)
+		if res.Writes != 5000 || res.Flushes == 0 {
+			t.Fatalf("%s: expected 5000 writes and some flushes, got %d writes, %d flushes", res.Strategy, res.Writes, res.Flushes)
+		}
+		if len(res.Samples) != 5 {
+			t.Fatalf("%s: expected 5 samples, got %d", res.Strategy, len(res.Samples))
+		}
+		final := res.Final()
+		if res.Compactions == 0 || final.WriteAmp <= 1 {
+			t.Fatalf("%s: expected compactions to raise write amplification, got %d compactions, %.2f", res.Strategy, res.Compactions, final.WriteAmp)
+		}
+		if final.SpaceAmp < 1 || final.ReadAmp < 1 || final.ReadAmp > float64(final.Tables) {
+			t.Fatalf("%s: implausible amplification: space %.2f, read %.2f with %d tables", res.Strategy, final.SpaceAmp, final.ReadAmp, final.Tables)
+		}
+		for i := 1; i < len(res.Samples); i++ {
+			if res.Samples[i].Compactions < res.Samples[i-1].Compactions {
+				t.Fatalf("%s: compaction count decreased over time", res.Strategy)
+			}
+		}
+
+		// Replays are deterministic
+		if again := run(strategy); again.Final() != final {
+			t.Fatalf("%s: results differ between runs: %+v vs %+v", res.Strategy, again.Final(), final)
+		}
+	}
+
+	// Without compaction nothing is rewritten and every flush stays a table
+	never := &SizeTieredStrategy{MinTables: 1 << 30, SizeRatio: 2, MaxTableSize: 1 << 40}
+	res := run(never)
+	if res.Compactions != 0 || res.Final().Tables != res.Flushes {
+		t.Fatalf("Expected %d tables and no compactions, got %d tables, %d compactions", res.Flushes, res.Final().Tables, res.Compactions)
+	}
+
+	// FIFO rewrites nothing and keeps the tables under its cap
+	fifo := &FIFOStrategy{MaxTotalSize: 20000}
+	res = run(fifo)
+	if res.Compactions != 0 || res.CompactedBytes != 0 || res.Dropped == 0 {
+		t.Fatalf("Expected FIFO to only drop tables, got %d compactions, %d dropped", res.Compactions, res.Dropped)
+	}
+	if res.Final().Tables+res.Dropped != res.Flushes {
+		t.Fatalf("Expected every flushed table to be kept or dropped: %d + %d != %d", res.Final().Tables, res.Dropped, res.Flushes)
+	}
+}
+
+func TestUniversalSelection(t *testing.T) {
+	table := func(seq uint64, size int64) *sstable.SSTable {
+		return &sstable.SSTable{Path: "t", Size: size, Meta: sstable.Metadata{MinSeq: seq, MaxSeq: seq}}
+	}
+	u := NewUniversalStrategy()
+
+	// Similar-sized newest runs merge; the large oldest run is left alone
+	tables := []*sstable.SSTable{table(1, 10000), table(2, 100), table(3, 100), table(4, 100)}
+	if got := u.SelectTables(tables); len(got) != 3 || got[2].Meta.MaxSeq != 2 {
+		t.Fatalf("Expected the 3 newest runs, got %d", len(got))
+	}
+	// Newer runs outgrowing the oldest trigger a full merge
+	tables = []*sstable.SSTable{table(1, 100), table(2, 1000), table(3, 150), table(4, 10)}
+	if got := u.SelectTables(tables); len(got) != 4 {
+		t.Fatalf("Expected a full merge on size amplification, got %d runs", len(got))
+	}
+	// Too few runs
+	if u.ShouldCompact(tables[:3]) {
+		t.Fatalf("Expected no compaction below MinTables runs")
+	}
+}
+
+func TestTimeBasedCurrentWindowRuns(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	table := func(seq uint64, size int64) *sstable.SSTable {
+		return &sstable.SSTable{Path: "t", Size: size, Meta: sstable.Metadata{MinSeq: seq, MaxSeq: seq, MaxTimestamp: now}}
+	}
+	tb := &TimeBasedStrategy{WindowSize: time.Hour, MinTables: 3, SizeRatio: 2, Now: func() time.Time { return now }}
+
+	// Three small tables, but a large one sits between the oldest and the
+	// others
+	tables := []*sstable.SSTable{table(1, 100), table(2, 10000), table(3, 100), table(4, 100)}
+	if got := tb.SelectTables(tables); got != nil {
+		t.Fatalf("Expected no selection around the large table, got %d tables", len(got))
+	}
+	// Another small table completes a run of three adjacent tables
+	tables = append(tables, table(5, 100))
+	got := tb.SelectTables(tables)
+	if len(got) != 3 || got[0].Meta.MaxSeq != 3 || got[2].Meta.MaxSeq != 5 {
+		t.Fatalf("Expected the 3 newest tables, got %d", len(got))
+	}
+}
@@ -3,9 +3,9 @@ package compaction
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"lsm/sstable"
 )
@@ -17,6 +17,40 @@ type Strategy interface {
 	Name() string
 }
 
+// OutputLeveler is implemented by strategies that place compaction output on
+// a specific level.
+type OutputLeveler interface {
+	OutputLevel(selected []*sstable.SSTable) int
+}
+
+// OutputLevel returns the level a compaction of selected should write to:
+// the strategy's choice if it implements OutputLeveler, otherwise the
+// highest input level.
+func OutputLevel(s Strategy, selected []*sstable.SSTable) int {
+	if ol, ok := s.(OutputLeveler); ok {
+		return ol.OutputLevel(selected)
+	}
+	level := 0
+	for _, table := range selected {
+		if table.Meta.Level > level {
+			level = table.Meta.Level
+		}
+	}
+	return level
+}
+
+// tableSize returns the size of table in bytes, asking the file system only
+// for tables that do not know it.
+func tableSize(table *sstable.SSTable) int64 {
+	if table.Size > 0 {
+		return table.Size
+	}
+	if info, err := os.Stat(table.Path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
 // SizeTieredStrategy compacts tables of similar sizes
 type SizeTieredStrategy struct {
 	MinTables    int     // Minimum tables to trigger compaction
@@ -113,10 +147,7 @@ func (s *SizeTieredStrategy) groupBySize(tables []*sstable.SSTable) [][]*sstable
 }
 
 func (s *SizeTieredStrategy) getTableSize(table *sstable.SSTable) int64 {
-	if info, err := os.Stat(table.Path); err == nil {
-		return info.Size()
-	}
-	return 0
+	return tableSize(table)
 }
 
 // LeveledStrategy implements leveled compaction
@@ -175,7 +206,7 @@ func (l *LeveledStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SST
 		}
 		
 		if level == 0 && len(levelTables) >= 4 {
-			return levelTables
+			return l.withNextLevel(levels, level)
 		}
 		
 		totalSize := int64(0)
@@ -184,13 +215,68 @@ func (l *LeveledStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SST
 		}
 		
 		if totalSize > l.getLevelMaxSize(level) {
-			return levelTables
+			return l.withNextLevel(levels, level)
 		}
 	}
 	
 	return nil
 }
 
+// OutputLevel pushes the compacted data one level down, stopping at MaxLevel.
+func (l *LeveledStrategy) OutputLevel(selected []*sstable.SSTable) int {
+	level := 0
+	for _, table := range selected {
+		if table.Meta.Level > level {
+			level = table.Meta.Level
+		}
+	}
+	for _, table := range selected {
+		if table.Meta.Level < level {
+			// Merging into the next level's tables
+			return level
+		}
+	}
+	if level < l.MaxLevel {
+		return level + 1
+	}
+	return level
+}
+
+// withNextLevel returns a level's tables together with the tables of the
+// level below that overlap their key range and must be merged with them.
+// Tables outside the range are left alone, so the level below stays made
+// of disjoint tables.
+func (l *LeveledStrategy) withNextLevel(levels map[int][]*sstable.SSTable, level int) []*sstable.SSTable {
+	selected := append([]*sstable.SSTable(nil), levels[level]...)
+	if level < l.MaxLevel {
+		min, max, ok := keyRange(levels[level])
+		for _, table := range levels[level+1] {
+			if _, _, has := table.KeyRange(); !has || ok && table.Overlaps(min, max) {
+				selected = append(selected, table)
+			}
+		}
+	}
+	return selected
+}
+
+// keyRange returns the combined key range of tables.
+func keyRange(tables []*sstable.SSTable) (min, max string, ok bool) {
+	for _, table := range tables {
+		tmin, tmax, has := table.KeyRange()
+		if !has {
+			continue
+		}
+		if !ok || tmin < min {
+			min = tmin
+		}
+		if !ok || tmax > max {
+			max = tmax
+		}
+		ok = true
+	}
+	return min, max, ok
+}
+
 func (l *LeveledStrategy) groupByLevel(tables []*sstable.SSTable) map[int][]*sstable.SSTable {
 	levels := make(map[int][]*sstable.SSTable)
 	
@@ -203,19 +289,8 @@ func (l *LeveledStrategy) groupByLevel(tables []*sstable.SSTable) map[int][]*sst
 }
 
 func (l *LeveledStrategy) getTableLevel(table *sstable.SSTable) int {
-	// Extract level from filename (e.g., "ss-L1-001.sst")
-	filename := filepath.Base(table.Path)
-	if strings.Contains(filename, "-L") {
-		parts := strings.Split(filename, "-")
-		for _, part := range parts {
-			if strings.HasPrefix(part, "L") && len(part) > 1 {
-				level := 0
-				fmt.Sscanf(part[1:], "%d", &level)
-				return level
-			}
-		}
-	}
-	return 0 // Default to level 0
+	// Level is recorded in the table metadata; flushed tables are level 0
+	return table.Meta.Level
 }
 
 func (l *LeveledStrategy) getLevelMaxSize(level int) int64 {
@@ -235,22 +310,26 @@ func (l *LeveledStrategy) getLevelMaxSize(level int) int64 {
 }
 
 func (l *LeveledStrategy) getTableSize(table *sstable.SSTable) int64 {
-	if info, err := os.Stat(table.Path); err == nil {
-		return info.Size()
-	}
-	return 0
+	return tableSize(table)
 }
 
-// TimeBasedStrategy compacts based on table age
+// TimeBasedStrategy implements time-window compaction (similar to Cassandra's
+// TWCS). Tables are bucketed into fixed windows by the newest entry they hold.
+// The current window is compacted size-tiered as flushes arrive, and once a
+// window has closed its tables are compacted into a single table and never
+// touched again, which keeps write amplification low for time-series data.
 type TimeBasedStrategy struct {
-	MaxAge       int64 // Maximum age in seconds
-	MinTables    int   // Minimum tables to compact
+	WindowSize time.Duration    // Width of each time window
+	MinTables  int              // Similar-sized tables needed to compact the current window
+	SizeRatio  float64          // Size ratio for grouping tables in the current window
+	Now        func() time.Time // Clock used to find the current window (defaults to time.Now)
 }
 
 func NewTimeBasedStrategy() *TimeBasedStrategy {
 	return &TimeBasedStrategy{
-		MaxAge:    3600, // 1 hour
-		MinTables: 3,
+		WindowSize: time.Hour,
+		MinTables:  4,
+		SizeRatio:  2.0,
 	}
 }
 
@@ -259,36 +338,233 @@ func (t *TimeBasedStrategy) Name() string {
 }
 
 func (t *TimeBasedStrategy) ShouldCompact(tables []*sstable.SSTable) bool {
+	return len(t.SelectTables(tables)) >= 2
+}
+
+// SelectTables picks the current window's size tier if it is ready, otherwise
+// the newest closed window that still holds more than one table.
+func (t *TimeBasedStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SSTable {
+	windows := t.groupByWindow(tables)
+	current := t.Window(t.now()).UnixNano()
+
+	if tier := t.currentTier(windows[current]); tier != nil {
+		return tier
+	}
+
+	var closed []int64
+	for start, windowTables := range windows {
+		if start < current && len(windowTables) > 1 {
+			closed = append(closed, start)
+		}
+	}
+	if len(closed) == 0 {
+		return nil
+	}
+	sort.Slice(closed, func(i, j int) bool { return closed[i] > closed[j] })
+	return windows[closed[0]]
+}
+
+// Window returns the start of the window containing ts.
+func (t *TimeBasedStrategy) Window(ts time.Time) time.Time {
+	return ts.Truncate(t.WindowSize)
+}
+
+// currentTier applies size-tiered selection within the current window. Only
+// runs of tables next to each other in age are merged, so that no table
+// with newer versions of their keys is left between them.
+func (t *TimeBasedStrategy) currentTier(tables []*sstable.SSTable) []*sstable.SSTable {
 	if len(tables) < t.MinTables {
-		return false
+		return nil
 	}
-	
-	oldTables := 0
-	for _, table := range tables {
-		if t.isOld(table) {
-			oldTables++
+	runs := make([]*sstable.SSTable, len(tables))
+	copy(runs, tables)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Meta.MaxSeq < runs[j].Meta.MaxSeq })
+
+	start := 0
+	for end := 1; end <= len(runs); end++ {
+		if end < len(runs) && t.similarSize(runs[end-1], runs[end]) {
+			continue
+		}
+		if end-start >= t.MinTables {
+			return runs[start:end]
 		}
+		start = end
 	}
-	
-	return oldTables >= t.MinTables
+	return nil
 }
 
-func (t *TimeBasedStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SSTable {
-	var oldTables []*sstable.SSTable
-	
+// similarSize reports whether the larger of a and b is at most SizeRatio
+// times the smaller.
+func (t *TimeBasedStrategy) similarSize(a, b *sstable.SSTable) bool {
+	small, large := tableSize(a), tableSize(b)
+	if small > large {
+		small, large = large, small
+	}
+	return small == 0 || float64(large)/float64(small) <= t.SizeRatio
+}
+
+// groupByWindow buckets tables by window start in Unix nanoseconds.
+func (t *TimeBasedStrategy) groupByWindow(tables []*sstable.SSTable) map[int64][]*sstable.SSTable {
+	windows := make(map[int64][]*sstable.SSTable)
 	for _, table := range tables {
-		if t.isOld(table) {
-			oldTables = append(oldTables, table)
+		start := t.Window(table.Meta.MaxTimestamp).UnixNano()
+		windows[start] = append(windows[start], table)
+	}
+	return windows
+}
+
+func (t *TimeBasedStrategy) now() time.Time {
+	if t.Now != nil {
+		return t.Now()
+	}
+	return time.Now()
+}
+
+// Dropper is implemented by strategies that delete whole tables instead of
+// merging them. The tree removes the returned tables before any merge.
+type Dropper interface {
+	DropTables(tables []*sstable.SSTable) []*sstable.SSTable
+}
+
+// UniversalStrategy implements universal compaction (as in RocksDB). Every
+// table is a sorted run on level 0; runs next to each other in age are
+// merged when, in order of priority:
+//
+//  1. the runs other than the oldest exceed MaxSizeAmplification times the
+//     oldest, which then merges everything (space amplification);
+//  2. a sequence of at least MinMergeWidth runs has similar sizes: each
+//     older run is at most SizeRatio times the runs before it combined;
+//  3. there are more than MinTables runs, which merges the newest runs to
+//     bring the count back down (read amplification).
+type UniversalStrategy struct {
+	MinTables            int     // Runs needed before any compaction
+	SizeRatio            float64 // Size ratio for picking runs of similar size
+	MinMergeWidth        int     // Fewest runs merged by a size-ratio compaction
+	MaxSizeAmplification float64 // Allowed size of newer runs relative to the oldest
+}
+
+func NewUniversalStrategy() *UniversalStrategy {
+	return &UniversalStrategy{
+		MinTables:            4,
+		SizeRatio:            1.01,
+		MinMergeWidth:        2,
+		MaxSizeAmplification: 2.0,
+	}
+}
+
+func (u *UniversalStrategy) Name() string {
+	return "Universal"
+}
+
+func (u *UniversalStrategy) ShouldCompact(tables []*sstable.SSTable) bool {
+	return len(u.SelectTables(tables)) >= 2
+}
+
+func (u *UniversalStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SSTable {
+	if len(tables) < u.MinTables || len(tables) < 2 {
+		return nil
+	}
+	// Newest run first
+	runs := make([]*sstable.SSTable, len(tables))
+	copy(runs, tables)
+	sort.SliceStable(runs, func(i, j int) bool { return runs[i].Meta.MaxSeq > runs[j].Meta.MaxSeq })
+
+	// 1. Space amplification
+	var newer int64
+	for _, run := range runs[:len(runs)-1] {
+		newer += tableSize(run)
+	}
+	if oldest := tableSize(runs[len(runs)-1]); oldest > 0 && float64(newer) > u.MaxSizeAmplification*float64(oldest) {
+		return runs
+	}
+
+	// 2. Runs of similar size
+	for start := range runs {
+		sum := tableSize(runs[start])
+		end := start + 1
+		for end < len(runs) && float64(tableSize(runs[end])) <= u.SizeRatio*float64(sum) {
+			sum += tableSize(runs[end])
+			end++
+		}
+		if end-start >= u.MinMergeWidth && end-start >= 2 {
+			return runs[start:end]
 		}
 	}
-	
-	return oldTables
+
+	// 3. Too many runs: merge the newest ones
+	if n := len(runs) - u.MinTables + 2; n >= 2 && len(runs) > u.MinTables {
+		return runs[:n]
+	}
+	return nil
 }
 
-func (t *TimeBasedStrategy) isOld(table *sstable.SSTable) bool {
-	if info, err := os.Stat(table.Path); err == nil {
-		age := int64(info.ModTime().Unix())
-		return age > t.MaxAge
+// FIFOStrategy never merges tables. Once they hold more than MaxTotalSize
+// bytes the oldest tables are deleted, data and all, which suits buffers of
+// logs or metrics where only recent entries matter.
+type FIFOStrategy struct {
+	MaxTotalSize int64 // Bytes kept before the oldest tables are dropped
+}
+
+func NewFIFOStrategy() *FIFOStrategy {
+	return &FIFOStrategy{
+		MaxTotalSize: 1024 * 1024, // 1MB
 	}
-	return false
+}
+
+func (f *FIFOStrategy) Name() string {
+	return "FIFO"
+}
+
+func (f *FIFOStrategy) ShouldCompact(tables []*sstable.SSTable) bool {
+	return len(f.DropTables(tables)) > 0
+}
+
+// SelectTables returns nil: FIFO only drops tables.
+func (f *FIFOStrategy) SelectTables(tables []*sstable.SSTable) []*sstable.SSTable {
+	return nil
+}
+
+// DropTables returns the oldest tables that must go to bring the total size
+// under MaxTotalSize.
+func (f *FIFOStrategy) DropTables(tables []*sstable.SSTable) []*sstable.SSTable {
+	sorted := make([]*sstable.SSTable, len(tables))
+	copy(sorted, tables)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Meta.MaxSeq < sorted[j].Meta.MaxSeq })
+
+	var total int64
+	for _, table := range sorted {
+		total += tableSize(table)
+	}
+	var drop []*sstable.SSTable
+	for _, table := range sorted {
+		if total <= f.MaxTotalSize {
+			break
+		}
+		drop = append(drop, table)
+		total -= tableSize(table)
+	}
+	return drop
+}
+
+// ByName returns the strategy with the given name, with default settings:
+// size-tiered, leveled, time-based, universal or fifo.
+func ByName(name string) (Strategy, error) {
+	switch strings.ToLower(name) {
+	case "size-tiered", "sizetiered", "stcs":
+		return NewSizeTieredStrategy(), nil
+	case "leveled", "lcs":
+		return NewLeveledStrategy(), nil
+	case "time-based", "timebased", "twcs":
+		return NewTimeBasedStrategy(), nil
+	case "universal":
+		return NewUniversalStrategy(), nil
+	case "fifo":
+		return NewFIFOStrategy(), nil
+	}
+	return nil, fmt.Errorf("compaction: unknown strategy %q", name)
+}
+
+// Names lists the names accepted by ByName.
+func Names() []string {
+	return []string{"size-tiered", "leveled", "time-based", "universal", "fifo"}
 }
@@ -0,0 +1,117 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"lsm/wal"
+)
+
+// WriteBatch collects writes to one or more column families of a tree.
+// Write applies them atomically: readers see all of them or none, and
+// after a crash either all of them are recovered or none.
+type WriteBatch struct {
+	ops  []batchOp
+	size int
+}
+
+// batchOp is one write of a batch. A nil family is the default one.
+type batchOp struct {
+	family     *LSMTree
+	op         wal.Op
+	key, value string
+}
+
+// Put adds a write of key to family, nil for the default family.
+func (b *WriteBatch) Put(family *LSMTree, key, value string) {
+	b.add(batchOp{family, wal.OpPut, key, value})
+}
+
+// Merge adds a merge operand for key in family, nil for the default family.
+func (b *WriteBatch) Merge(family *LSMTree, key, operand string) {
+	b.add(batchOp{family, wal.OpMerge, key, operand})
+}
+
+// DeleteRange adds a deletion of [start, end) in family, nil for the
+// default family.
+func (b *WriteBatch) DeleteRange(family *LSMTree, start, end string) {
+	b.add(batchOp{family, wal.OpDeleteRange, start, end})
+}
+
+func (b *WriteBatch) add(op batchOp) {
+	b.ops = append(b.ops, op)
+	b.size += len(op.key) + len(op.value)
+}
+
+// Len returns the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Write applies every write in b. The batch is checked as a whole first, so
+// an invalid write fails the batch before any of it is logged.
+func (t *LSMTree) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+	var families []*LSMTree // in order of first use
+	seen := make(map[*LSMTree]bool)
+	for i, op := range b.ops {
+		if op.family == nil {
+			op.family = t.families.root
+			b.ops[i] = op
+		}
+		if op.family.families != t.families {
+			return errors.New("lsmtree: write batch holds a column family of another tree")
+		}
+		if op.op == wal.OpDeleteRange && op.key >= op.value {
+			return fmt.Errorf("lsmtree: empty range [%q, %q)", op.key, op.value)
+		}
+		if !seen[op.family] {
+			seen[op.family] = true
+			families = append(families, op.family)
+		}
+	}
+	for _, family := range families {
+		if err := family.throttle(b.size); err != nil {
+			return err
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, op := range b.ops {
+		if op.family.dropped {
+			return ErrColumnFamilyDropped
+		}
+		if op.op == wal.OpMerge && op.family.mergeOp == nil {
+			return ErrNoMergeOperator
+		}
+	}
+
+	now := time.Now().UnixNano()
+	records := make([]wal.Record, len(b.ops))
+	for i, op := range b.ops {
+		records[i] = wal.Record{Seq: *t.seq + uint64(i) + 1, Op: op.op, Key: op.key, Value: op.value, Timestamp: now, Family: op.family.family}
+	}
+	if err := t.wal.AppendBatch(records); err != nil {
+		return err
+	}
+	for i, op := range b.ops {
+		if op.family.stats != nil {
+			op.family.stats.TotalWrites++
+		}
+		op.family.apply(records[i])
+	}
+	t.families.feed.publish(records...)
+
+	// The batch is applied even if a flush fails
+	var err error
+	for _, family := range families {
+		if ferr := family.maybeFlush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
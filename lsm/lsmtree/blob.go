@@ -0,0 +1,294 @@
+package lsmtree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"lsm/blob"
+	"lsm/memtable"
+)
+
+// BlobOptions enables key-value separation: large values are written once
+// to append-only blob files and tables only hold references to them, so
+// compaction no longer rewrites the values.
+type BlobOptions struct {
+	MinBlobSize int   // values of at least this many bytes are stored in blob files
+	MaxFileSize int64 // a blob file takes no more values past this size (default 64 MiB)
+
+	// GCThreshold is the fraction of a blob file's bytes no longer
+	// referenced by any table at which compactions move the file's live
+	// values to a new blob file, so the old one can be deleted. Zero
+	// disables garbage collection; files are still deleted once nothing
+	// references them.
+	GCThreshold float64
+}
+
+const defaultMaxBlobFileSize = 64 << 20
+
+// blobState tracks the blob files of a column family. Its lock guards
+// writes to blob files, which subcompactions do in parallel.
+type blobState struct {
+	mu     sync.Mutex
+	opts   *BlobOptions     // nil until SetBlobOptions
+	active *blob.Writer     // file taking new values; nil until the first
+	next   uint64           // number of the next blob file
+	sizes  map[uint64]int64 // size of every blob file, by number
+	gc     map[uint64]bool  // files whose values compaction relocates
+}
+
+// SetBlobOptions enables key-value separation for tables written from now
+// on. Pass nil to store values inline again; values already in blob files
+// stay readable.
+func (t *LSMTree) SetBlobOptions(opts *BlobOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+	if opts != nil {
+		o := *opts
+		if o.MaxFileSize <= 0 {
+			o.MaxFileSize = defaultMaxBlobFileSize
+		}
+		opts = &o
+	}
+	t.blobs.opts = opts
+}
+
+// blobPrefix returns the file name prefix of the family's blob files.
+func (t *LSMTree) blobPrefix() string {
+	if t.family != "" {
+		return t.family + "-blob-"
+	}
+	return "blob-"
+}
+
+// blobPath returns the path of blob file number n.
+func (t *LSMTree) blobPath(n uint64) string {
+	return filepath.Join(t.Dir, fmt.Sprintf("%s%d.blob", t.blobPrefix(), n))
+}
+
+// loadBlobs records the blob files referenced by the family's tables and
+// deletes any other, such as a file left by a flush that crashed before
+// its table was recorded.
+func (t *LSMTree) loadBlobs() error {
+	t.blobs = &blobState{sizes: make(map[uint64]int64)}
+	for _, tbl := range t.Tables {
+		for n := range tbl.Meta.BlobFiles {
+			if _, ok := t.blobs.sizes[n]; ok {
+				continue
+			}
+			info, err := os.Stat(t.blobPath(n))
+			if err != nil {
+				return err
+			}
+			t.blobs.sizes[n] = info.Size()
+			if n >= t.blobs.next {
+				t.blobs.next = n + 1
+			}
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(t.Dir, t.blobPrefix()+"*.blob"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		var n uint64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(filepath.Base(path), t.blobPrefix()), "%d.blob", &n); err != nil {
+			continue // another family's file
+		}
+		if _, ok := t.blobs.sizes[n]; !ok {
+			os.Remove(path)
+		}
+	}
+	return nil
+}
+
+// fetchBlob replaces a blob reference with the value it points to. It only
+// reads the file, so it needs no lock as long as a table referencing the
+// value is held.
+func (t *LSMTree) fetchBlob(kv memtable.KV) (memtable.KV, error) {
+	if kv.Kind != memtable.KindBlob {
+		return kv, nil
+	}
+	ref, err := blob.ParseRef(kv.Value)
+	if err != nil {
+		return memtable.KV{}, err
+	}
+	value, err := blob.Read(t.blobPath(ref.File), ref)
+	if err != nil {
+		return memtable.KV{}, err
+	}
+	kv.Kind, kv.Value = memtable.KindValue, value
+	return kv, nil
+}
+
+// separate prepares kv for a table: large values are moved to the active
+// blob file and references into files being garbage collected are moved
+// along with their values. It reports whether a blob file was written.
+func (t *LSMTree) separate(kv memtable.KV) (memtable.KV, bool, error) {
+	b := t.blobs
+	switch {
+	case kv.Kind == memtable.KindBlob:
+		ref, err := blob.ParseRef(kv.Value)
+		if err != nil {
+			return memtable.KV{}, false, err
+		}
+		b.mu.Lock()
+		relocate := b.gc[ref.File]
+		b.mu.Unlock()
+		if !relocate {
+			return kv, false, nil
+		}
+		if kv, err = t.fetchBlob(kv); err != nil {
+			return memtable.KV{}, false, err
+		}
+		if t.stats != nil {
+			b.mu.Lock()
+			t.stats.BlobBytesRelocated += uint64(ref.Size)
+			b.mu.Unlock()
+		}
+	case kv.Kind != memtable.KindValue || len(kv.Operands) > 0:
+		return kv, false, nil
+	case b.opts == nil || len(kv.Value) < b.opts.MinBlobSize:
+		return kv, false, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active == nil || (b.opts != nil && b.active.Size() >= b.opts.MaxFileSize) {
+		if b.active != nil {
+			if err := b.active.Close(); err != nil {
+				return memtable.KV{}, false, err
+			}
+		}
+		w, err := blob.Create(t.blobPath(b.next), b.next)
+		if err != nil {
+			return memtable.KV{}, false, err
+		}
+		b.active = w
+		b.next++
+	}
+	ref, err := b.active.Add(kv.Value)
+	if err != nil {
+		return memtable.KV{}, false, err
+	}
+	b.sizes[ref.File] = b.active.Size()
+	if t.stats != nil {
+		t.stats.BlobBytesWritten += uint64(ref.Size)
+	}
+	return memtable.KV{Key: kv.Key, Kind: memtable.KindBlob, Value: ref.String(), Timestamp: kv.Timestamp}, true, nil
+}
+
+// syncBlobs makes the values written to the active blob file durable
+// before a table referencing them is recorded in the manifest.
+func (t *LSMTree) syncBlobs() error {
+	t.blobs.mu.Lock()
+	defer t.blobs.mu.Unlock()
+	if t.blobs.active == nil {
+		return nil
+	}
+	return t.blobs.active.Sync()
+}
+
+// liveBlobBytes returns the bytes of every blob file that live tables
+// reference.
+func (t *LSMTree) liveBlobBytes() map[uint64]int64 {
+	live := make(map[uint64]int64)
+	for _, tbl := range t.Tables {
+		for n, size := range tbl.Meta.BlobFiles {
+			live[n] += size
+		}
+	}
+	return live
+}
+
+// selectBlobGarbage marks the blob files whose share of unreferenced bytes
+// reached the GC threshold, so the compaction about to run relocates the
+// values it reads from them.
+func (t *LSMTree) selectBlobGarbage() {
+	b := t.blobs
+	b.gc = nil
+	if b.opts == nil || b.opts.GCThreshold <= 0 {
+		return
+	}
+	live := t.liveBlobBytes()
+	for n, size := range b.sizes {
+		if size == 0 || (b.active != nil && n == b.active.Number) {
+			continue
+		}
+		if garbage := 1 - float64(live[n])/float64(size); garbage >= b.opts.GCThreshold {
+			if b.gc == nil {
+				b.gc = make(map[uint64]bool)
+			}
+			b.gc[n] = true
+		}
+	}
+}
+
+// collectBlobs deletes blob files no table references any more, counting
+// retired tables still held by reads or snapshots.
+func (t *LSMTree) collectBlobs() {
+	if t.compacting {
+		return // the outputs may reference files no installed table does yet
+	}
+	b := t.blobs
+	used := t.liveBlobBytes()
+	for tbl := range t.obsolete {
+		for n := range tbl.Meta.BlobFiles {
+			used[n]++
+		}
+	}
+	for n := range b.sizes {
+		if _, ok := used[n]; ok || (b.active != nil && n == b.active.Number) {
+			continue
+		}
+		os.Remove(t.blobPath(n))
+		delete(b.sizes, n)
+		if t.stats != nil {
+			t.stats.BlobFilesDeleted++
+		}
+	}
+}
+
+// closeBlobs closes the active blob file.
+func (t *LSMTree) closeBlobs() error {
+	b := t.blobs
+	if b.active == nil {
+		return nil
+	}
+	err := b.active.Close()
+	b.active = nil
+	return err
+}
+
+// BlobFileProperties describes one blob file.
+type BlobFileProperties struct {
+	Number    uint64 `json:"number"`
+	Size      int64  `json:"size"`
+	LiveBytes int64  `json:"live_bytes"` // bytes referenced by live tables
+}
+
+// blobProperties describes the family's blob files, by number.
+func (t *LSMTree) blobProperties() []BlobFileProperties {
+	live := t.liveBlobBytes()
+	var props []BlobFileProperties
+	for n, size := range t.blobs.sizes {
+		props = append(props, BlobFileProperties{Number: n, Size: size, LiveBytes: live[n]})
+	}
+	sort.Slice(props, func(i, j int) bool { return props[i].Number < props[j].Number })
+	return props
+}
+
+// blobFiles returns the paths of the blob files live tables reference.
+func (t *LSMTree) blobFiles() []string {
+	var paths []string
+	for n := range t.liveBlobBytes() {
+		paths = append(paths, t.blobPath(n))
+	}
+	sort.Strings(paths)
+	return paths
+}
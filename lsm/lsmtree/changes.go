@@ -0,0 +1,358 @@
+package lsmtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"lsm/wal"
+)
+
+var (
+	// ErrChangesTruncated is returned when a subscription needs changes
+	// that are no longer retained in the write-ahead log or its archive.
+	ErrChangesTruncated = errors.New("lsmtree: changes no longer retained")
+
+	// ErrSubscriptionClosed is returned by a closed subscription.
+	ErrSubscriptionClosed = errors.New("lsmtree: subscription closed")
+)
+
+// archiveDir holds write-ahead log files kept for subscriptions.
+const archiveDir = "wal-archive"
+
+// maxQueuedChanges bounds the changes buffered for a subscription that
+// follows writes as they happen. A subscription falling further behind
+// reads from the log files instead.
+const maxQueuedChanges = 4096
+
+// ChangeOp is the kind of mutation in a Change.
+type ChangeOp string
+
+const (
+	ChangePut         ChangeOp = "put"
+	ChangeMerge       ChangeOp = "merge"
+	ChangeDeleteRange ChangeOp = "delete_range"
+
+	// ChangeIngest reports tables added by IngestExternalFiles. Their
+	// entries are not delivered one by one: Key and Value are the smallest
+	// and largest key ingested, and readers must re-read that range.
+	ChangeIngest ChangeOp = "ingest"
+)
+
+// Change is a committed mutation. The writes of a WriteBatch are delivered
+// together, in the order they were added to the batch, and only the final
+// one is marked Last.
+type Change struct {
+	Seq       uint64   `json:"seq"`
+	Family    string   `json:"family"`
+	Op        ChangeOp `json:"op"`
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`     // value for a put, operand for a merge, range end for a range deletion, largest key for an ingest
+	Timestamp int64    `json:"timestamp"` // write time in Unix nanoseconds
+	Last      bool     `json:"last"`      // last change of its write or WriteBatch
+}
+
+var changeOps = map[wal.Op]ChangeOp{
+	wal.OpPut:         ChangePut,
+	wal.OpMerge:       ChangeMerge,
+	wal.OpDeleteRange: ChangeDeleteRange,
+	wal.OpIngest:      ChangeIngest,
+}
+
+func newChange(r wal.Record) Change {
+	family := r.Family
+	if family == "" {
+		family = DefaultColumnFamily
+	}
+	return Change{Seq: r.Seq, Family: family, Op: changeOps[r.Op], Key: r.Key, Value: r.Value, Timestamp: r.Timestamp}
+}
+
+// changeFeed tracks the history of writes kept for subscriptions and the
+// subscriptions following new writes. It is shared by the column families
+// and guarded by the tree lock.
+type changeFeed struct {
+	retention int64        // archived log bytes to keep; 0 archives nothing
+	archives  []walArchive // oldest first
+	from      uint64       // every change from this sequence number on is retained
+	subs      map[*Subscription]bool
+}
+
+// walArchive is an archived log file. Together with the archives after it
+// and the live log it holds every change from sequence number from on;
+// to is the last sequence number assigned when it was archived.
+type walArchive struct {
+	path     string
+	from, to uint64
+	size     int64
+}
+
+// SetWALRetention keeps up to maxBytes of write-ahead log files once their
+// writes are flushed, so subscriptions can resume from older positions.
+// Zero, the default, deletes flushed writes from the log right away. The
+// retention covers every column family; it is not persisted and must be
+// set again after reopening, before the first write.
+func (t *LSMTree) SetWALRetention(maxBytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	feed := &t.families.feed
+	feed.retention = maxBytes
+	feed.trim()
+}
+
+// loadArchive lists the archived log files. Without them, changes are
+// only known to be retained past the newest write any family flushed.
+func (f *columnFamilies) loadArchive() error {
+	feed := &f.feed
+	paths, err := filepath.Glob(filepath.Join(f.root.Dir, archiveDir, "*.log"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		a := walArchive{path: path}
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d-%d.log", &a.from, &a.to); err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		a.size = info.Size()
+		feed.archives = append(feed.archives, a)
+	}
+	sort.Slice(feed.archives, func(i, j int) bool { return feed.archives[i].to < feed.archives[j].to })
+
+	if len(feed.archives) > 0 {
+		feed.from = feed.archives[0].from
+		return nil
+	}
+	for _, family := range f.all() {
+		if family.flushedSeq >= feed.from {
+			feed.from = family.flushedSeq + 1
+		}
+	}
+	return nil
+}
+
+// archiveWAL moves the log's records to the archive and keeps in the log
+// those for which keep reports true.
+func (f *columnFamilies) archiveWAL(keep func(wal.Record) bool) error {
+	feed := &f.feed
+	from, to := feed.from, *f.root.seq
+	if n := len(feed.archives); n > 0 {
+		from = feed.archives[n-1].to + 1
+	}
+	if to < from {
+		return f.root.wal.Rewrite(keep) // nothing written since the last archive
+	}
+
+	dir := filepath.Join(f.root.Dir, archiveDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%d-%d.log", from, to))
+	if err := f.root.wal.Archive(path, keep); err != nil {
+		os.Remove(path)
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	feed.archives = append(feed.archives, walArchive{path: path, from: from, to: to, size: info.Size()})
+	feed.trim()
+	return nil
+}
+
+// trim deletes the oldest archived log files until they fit the retention.
+func (f *changeFeed) trim() {
+	var total int64
+	for _, a := range f.archives {
+		total += a.size
+	}
+	for len(f.archives) > 0 && total > f.retention {
+		a := f.archives[0]
+		os.Remove(a.path)
+		total -= a.size
+		f.archives = f.archives[1:]
+		if a.to >= f.from {
+			f.from = a.to + 1
+		}
+	}
+}
+
+// publish hands newly logged records to the subscriptions following
+// writes.
+func (f *changeFeed) publish(records ...wal.Record) {
+	for s := range f.subs {
+		if len(s.queue)+len(records) > maxQueuedChanges {
+			// Too far behind: catch up from the log files instead
+			s.queue, s.live = nil, false
+			delete(f.subs, s)
+		} else {
+			for _, r := range records {
+				s.queue = append(s.queue, newChange(r))
+			}
+			s.queue[len(s.queue)-1].Last = true
+		}
+		s.signal()
+	}
+}
+
+// LastSequence returns the sequence number of the latest write, in any
+// column family.
+func (t *LSMTree) LastSequence() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return *t.seq
+}
+
+// Subscription delivers the changes committed to a tree, oldest first.
+// Its methods are safe for concurrent use.
+type Subscription struct {
+	t      *LSMTree // the default family
+	pos    uint64   // sequence number of the last change delivered
+	queue  []Change // changes loaded but not delivered yet
+	live   bool     // receives new writes as they are logged
+	closed bool
+	ready  chan struct{} // signaled when changes arrive or on Close
+}
+
+// Subscribe returns a subscription to every change with a sequence number
+// greater than fromSeq, in every column family. To resume after a restart,
+// persist the Seq of the last change processed and subscribe from it;
+// changes older than the last flush are only available as far as
+// SetWALRetention keeps them, and ErrChangesTruncated is returned for a
+// position that is no longer covered. Ingested tables are reported as a
+// single ChangeIngest spanning their keys.
+func (t *LSMTree) Subscribe(fromSeq uint64) (*Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := &Subscription{t: t.families.root, pos: fromSeq, ready: make(chan struct{}, 1)}
+	// Load the first changes right away, so a flush right after cannot
+	// drop those still only in the live log
+	if err := s.fill(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Next returns the next change, waiting for one to be written if there is
+// none yet. It returns ctx's error if ctx is done first.
+func (s *Subscription) Next(ctx context.Context) (Change, error) {
+	mu := s.t.mu
+	for {
+		mu.Lock()
+		switch {
+		case s.closed:
+			mu.Unlock()
+			return Change{}, ErrSubscriptionClosed
+		case len(s.queue) > 0:
+			c := s.queue[0]
+			s.queue = s.queue[1:]
+			s.pos = c.Seq
+			mu.Unlock()
+			return c, nil
+		case !s.live:
+			err := s.fill()
+			mu.Unlock()
+			if err != nil {
+				return Change{}, err
+			}
+			continue
+		}
+		mu.Unlock()
+
+		select {
+		case <-s.ready:
+		case <-ctx.Done():
+			return Change{}, ctx.Err()
+		}
+	}
+}
+
+// Seq returns the sequence number of the last change Next returned, or
+// the position the subscription started from.
+func (s *Subscription) Seq() uint64 {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	return s.pos
+}
+
+// Close ends the subscription. Pending and later calls to Next return
+// ErrSubscriptionClosed.
+func (s *Subscription) Close() error {
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.close()
+	return nil
+}
+
+func (s *Subscription) close() {
+	s.closed = true
+	s.queue = nil
+	delete(s.t.families.feed.subs, s)
+	s.signal()
+}
+
+func (s *Subscription) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// fill loads the changes following s.pos from the oldest archived log file
+// holding any. Once only the live log is left, it loads the rest from
+// there and subscribes to new writes. The tree must be locked.
+func (s *Subscription) fill() error {
+	feed := &s.t.families.feed
+	if s.pos+1 < feed.from {
+		return ErrChangesTruncated
+	}
+	for _, a := range feed.archives {
+		if a.to <= s.pos {
+			continue
+		}
+		if err := s.load(a.path); err != nil {
+			return err
+		}
+		if len(s.queue) > 0 {
+			return nil
+		}
+	}
+	if err := s.load(s.t.wal.Path); err != nil {
+		return err
+	}
+	s.live = true
+	if feed.subs == nil {
+		feed.subs = make(map[*Subscription]bool)
+	}
+	feed.subs[s] = true
+	return nil
+}
+
+// load queues the changes in the log file at path that follow s.pos and
+// the changes already queued. The live log repeats records also in the
+// newest archive, which the sequence numbers filter out.
+func (s *Subscription) load(path string) error {
+	last := s.pos
+	if n := len(s.queue); n > 0 {
+		last = s.queue[n-1].Seq
+	}
+	return wal.ReplayBatches(path, func(batch []wal.Record) error {
+		n := len(s.queue)
+		for _, r := range batch {
+			if r.Seq > last {
+				s.queue = append(s.queue, newChange(r))
+				last = r.Seq
+			}
+		}
+		if len(s.queue) > n {
+			s.queue[len(s.queue)-1].Last = true
+		}
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+package lsmtree
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint creates a consistent copy of the tree in destDir that can be
+// opened with New. Immutable tables are hard-linked (copied when linking is
+// not possible, e.g. across file systems) and the manifest and write-ahead
+// log are copied, all while holding the tree lock so no flush or compaction
+// can change or delete files midway. The checkpoint holds every column
+// family. destDir must not exist.
+func (t *LSMTree) Checkpoint(destDir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := os.Stat(destDir); err == nil {
+		return fmt.Errorf("lsmtree: checkpoint directory %s already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+
+	if err := t.checkpoint(destDir); err != nil {
+		os.RemoveAll(destDir)
+		return err
+	}
+	return nil
+}
+
+func (t *LSMTree) checkpoint(destDir string) error {
+	for _, family := range t.families.all() {
+		paths := append(tablePaths(family.Tables), family.blobFiles()...)
+		for _, path := range paths {
+			if err := linkOrCopy(path, filepath.Join(destDir, filepath.Base(path))); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The log tail holds writes not yet flushed to a table
+	if err := t.wal.Sync(); err != nil {
+		return err
+	}
+	if err := copyFile(t.wal.Path, filepath.Join(destDir, walName)); err != nil {
+		return err
+	}
+	return writeManifest(destDir, t.manifest())
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// copyFile copies src to a new file at dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
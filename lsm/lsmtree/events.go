@@ -0,0 +1,138 @@
+package lsmtree
+
+import (
+	"time"
+
+	"lsm/sstable"
+)
+
+// EventListener is notified of flushes, compactions, table files, write
+// stalls and errors in work the tree does on behalf of writes. Callbacks
+// run synchronously with the tree locked: they should return quickly and
+// must not call methods of the tree. Embed NoopEventListener to implement
+// only some of them.
+type EventListener interface {
+	OnFlushBegin(FlushEvent)
+	OnFlushEnd(FlushEvent)
+	OnCompactionBegin(CompactionEvent)
+	OnCompactionEnd(CompactionEvent)
+	OnTableFileCreated(TableFileEvent)
+	OnTableFileDeleted(TableFileEvent)
+	OnWriteStall(WriteStallEvent)
+	OnBackgroundError(BackgroundErrorEvent)
+}
+
+// FlushEvent describes a memtable flush. Table, Bytes, Duration and Err
+// are only set when it ends.
+type FlushEvent struct {
+	Entries  int // records in the memtable
+	Table    string
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// CompactionEvent describes a compaction. Outputs, BytesWritten, Duration
+// and Err are only set when it ends.
+type CompactionEvent struct {
+	Strategy     string // empty for a full compaction
+	Inputs       []string
+	Outputs      []string
+	OutputLevel  int
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+	Err          error
+}
+
+// Table file events give the reason a file was created or deleted.
+const (
+	ReasonFlush      = "flush"
+	ReasonCompaction = "compaction"
+	ReasonIngest     = "ingest"
+	ReasonDrop       = "drop" // deleted whole by a range deletion or a Dropper strategy
+)
+
+// TableFileEvent describes a table file added to or removed from the tree.
+type TableFileEvent struct {
+	Path   string
+	Level  int
+	Size   int64
+	Reason string
+}
+
+// WriteStallEvent describes a write held back by write stalls.
+type WriteStallEvent struct {
+	Stopped      bool // waited for compaction at a hard limit, rather than slowed down
+	L0Tables     int
+	PendingBytes int64
+	Duration     time.Duration
+}
+
+// BackgroundErrorEvent reports a flush or compaction triggered by a write
+// that failed. The error is also returned to the writer.
+type BackgroundErrorEvent struct {
+	Operation string // "flush" or "compaction"
+	Err       error
+}
+
+// NoopEventListener ignores every event.
+type NoopEventListener struct{}
+
+func (NoopEventListener) OnFlushBegin(FlushEvent)                {}
+func (NoopEventListener) OnFlushEnd(FlushEvent)                  {}
+func (NoopEventListener) OnCompactionBegin(CompactionEvent)      {}
+func (NoopEventListener) OnCompactionEnd(CompactionEvent)        {}
+func (NoopEventListener) OnTableFileCreated(TableFileEvent)      {}
+func (NoopEventListener) OnTableFileDeleted(TableFileEvent)      {}
+func (NoopEventListener) OnWriteStall(WriteStallEvent)           {}
+func (NoopEventListener) OnBackgroundError(BackgroundErrorEvent) {}
+
+// SetEventListener sets the listener notified of the tree's events. Pass
+// nil to remove it.
+func (t *LSMTree) SetEventListener(l EventListener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listener = l
+}
+
+// tableEvent returns the file event for tbl.
+func tableEvent(tbl *sstable.SSTable, reason string) TableFileEvent {
+	return TableFileEvent{Path: tbl.Path, Level: tbl.Meta.Level, Size: tbl.Size, Reason: reason}
+}
+
+// tablesCreated reports new table files to the listener.
+func (t *LSMTree) tablesCreated(tables []*sstable.SSTable, reason string) {
+	if t.listener == nil {
+		return
+	}
+	for _, tbl := range tables {
+		t.listener.OnTableFileCreated(tableEvent(tbl, reason))
+	}
+}
+
+// backgroundError reports err, if any, as a failed operation and returns it.
+func (t *LSMTree) backgroundError(op string, err error) error {
+	if err != nil && t.listener != nil {
+		t.listener.OnBackgroundError(BackgroundErrorEvent{Operation: op, Err: err})
+	}
+	return err
+}
+
+// tablePaths returns the paths of tables.
+func tablePaths(tables []*sstable.SSTable) []string {
+	paths := make([]string, len(tables))
+	for i, tbl := range tables {
+		paths[i] = tbl.Path
+	}
+	return paths
+}
+
+// totalSize returns the combined size of tables in bytes.
+func totalSize(tables []*sstable.SSTable) int64 {
+	var size int64
+	for _, tbl := range tables {
+		size += tbl.Size
+	}
+	return size
+}
@@ -0,0 +1,236 @@
+package lsmtree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"lsm/compaction"
+	"lsm/memtable"
+	"lsm/wal"
+)
+
+// DefaultColumnFamily is the name of the column family held by the tree
+// itself.
+const DefaultColumnFamily = "default"
+
+var (
+	// ErrNoColumnFamily is returned for a column family that does not exist.
+	ErrNoColumnFamily = errors.New("lsmtree: no such column family")
+
+	// ErrColumnFamilyDropped is returned when writing to a dropped family.
+	ErrColumnFamilyDropped = errors.New("lsmtree: column family dropped")
+)
+
+// ColumnFamilyOptions configures a column family. Zero fields keep the
+// family's current setting.
+type ColumnFamilyOptions struct {
+	FlushThreshold int                 // memtable entries before a flush; the default family's for a new family
+	Strategy       compaction.Strategy // enables strategy compaction and statistics, as NewWithStrategy
+}
+
+// columnFamilies holds the column families of one directory. They share
+// the lock, write-ahead log, sequence numbers and manifest of the default
+// family, so a WriteBatch spanning families is applied atomically, while
+// each has its own memtable, tables and options.
+type columnFamilies struct {
+	root   *LSMTree            // the default family
+	byName map[string]*LSMTree // every other family
+	feed   changeFeed          // logged writes kept for subscriptions
+
+	compactionDone *sync.Cond // broadcast when a compaction installs its outputs
+}
+
+// get returns the family named name, empty for the default one, or nil.
+func (f *columnFamilies) get(name string) *LSMTree {
+	if name == "" {
+		return f.root
+	}
+	return f.byName[name]
+}
+
+// all returns every family, the default one first.
+func (f *columnFamilies) all() []*LSMTree {
+	families := []*LSMTree{f.root}
+	for _, name := range f.names() {
+		families = append(families, f.byName[name])
+	}
+	return families
+}
+
+// names returns the names of the families other than the default one,
+// sorted.
+func (f *columnFamilies) names() []string {
+	names := make([]string, 0, len(f.byName))
+	for name := range f.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// add creates an empty family. It sees no write logged before it existed.
+func (f *columnFamilies) add(name string, threshold int) *LSMTree {
+	root := f.root
+	if threshold <= 0 {
+		threshold = root.Mem.FlushThreshold
+	}
+	family := &LSMTree{
+		Mem:        memtable.New(threshold),
+		Dir:        root.Dir,
+		mu:         root.mu,
+		wal:        root.wal,
+		seq:        root.seq,
+		flushedSeq: *root.seq,
+		family:     name,
+		families:   f,
+		cache:      root.cache,
+		blobs:      &blobState{sizes: make(map[uint64]int64)},
+	}
+	if f.byName == nil {
+		f.byName = make(map[string]*LSMTree)
+	}
+	f.byName[name] = family
+	family.tablesChanged()
+	return family
+}
+
+// resetWAL drops logged writes that every family has flushed: the whole
+// log once all memtables are empty, otherwise the records of flushed
+// writes only. With a WAL retention the dropped writes are archived.
+func (f *columnFamilies) resetWAL() error {
+	unflushed := false
+	for _, family := range f.all() {
+		if family.Mem.Len() > 0 {
+			unflushed = true
+		}
+	}
+	var dropped uint64
+	keep := func(r wal.Record) bool {
+		family := f.get(r.Family)
+		if unflushed && family != nil && r.Seq > family.flushedSeq {
+			return true
+		}
+		if r.Seq > dropped {
+			dropped = r.Seq
+		}
+		return false
+	}
+	if f.feed.retention > 0 {
+		return f.archiveWAL(keep)
+	}
+
+	// Archived files from before the retention was disabled would leave
+	// a gap behind them
+	f.feed.trim()
+	var err error
+	if unflushed {
+		err = f.root.wal.Rewrite(keep)
+	} else {
+		dropped = *f.root.seq
+		err = f.root.wal.Reset()
+	}
+	if dropped >= f.feed.from {
+		f.feed.from = dropped + 1
+	}
+	return err
+}
+
+// validFamilyName reports whether name can be used in table file names and
+// log records.
+func validFamilyName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\:\t\n")
+}
+
+// ColumnFamily returns the column family name, creating it if it does not
+// exist, and applies opts to it. Families live in the tree's directory and
+// are reopened with it; options other than the flush threshold are not
+// persisted and must be applied again after reopening. Every LSMTree
+// method works on the returned family, except that Close and Checkpoint
+// always cover the whole directory.
+func (t *LSMTree) ColumnFamily(name string, opts ColumnFamilyOptions) (*LSMTree, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var family *LSMTree
+	switch {
+	case name == DefaultColumnFamily:
+		family = t.families.root
+	case !validFamilyName(name):
+		return nil, fmt.Errorf("lsmtree: invalid column family name %q", name)
+	case t.families.byName[name] != nil:
+		family = t.families.byName[name]
+	default:
+		family = t.families.add(name, opts.FlushThreshold)
+		if err := t.saveManifest(); err != nil {
+			delete(t.families.byName, name)
+			return nil, err
+		}
+	}
+
+	if opts.FlushThreshold > 0 {
+		family.Mem.FlushThreshold = opts.FlushThreshold
+	}
+	if opts.Strategy != nil {
+		family.strategy = &opts.Strategy
+		if family.stats == nil {
+			family.enableStats()
+		}
+	}
+	return family, nil
+}
+
+// ColumnFamilies returns the names of all column families, the default one
+// first.
+func (t *LSMTree) ColumnFamilies() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string{DefaultColumnFamily}, t.families.names()...)
+}
+
+// Name returns the name of the column family.
+func (t *LSMTree) Name() string {
+	if t.family == "" {
+		return DefaultColumnFamily
+	}
+	return t.family
+}
+
+// DropColumnFamily deletes a column family with all its data. Writes to a
+// handle of the dropped family fail with ErrColumnFamilyDropped; its table
+// files are deleted once no read or snapshot uses them.
+func (t *LSMTree) DropColumnFamily(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if name == DefaultColumnFamily {
+		return errors.New("lsmtree: cannot drop the default column family")
+	}
+	family := t.families.byName[name]
+	if family == nil {
+		return ErrNoColumnFamily
+	}
+	family.waitForCompaction()
+	if t.families.byName[name] != family {
+		return ErrNoColumnFamily // dropped meanwhile
+	}
+	delete(t.families.byName, name)
+	if err := t.saveManifest(); err != nil {
+		t.families.byName[name] = family
+		return err
+	}
+
+	family.dropped = true
+	family.Mem.Flush()
+	retired := family.Tables
+	family.Tables = nil
+	family.tablesChanged()
+	err := family.closeBlobs()
+	family.retire(retired, ReasonDrop)
+	if werr := t.families.resetWAL(); err == nil {
+		err = werr
+	}
+	return err
+}
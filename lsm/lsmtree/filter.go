@@ -0,0 +1,74 @@
+package lsmtree
+
+import "lsm/memtable"
+
+// FilterDecision tells compaction what to do with an entry.
+type FilterDecision int
+
+const (
+	FilterKeep   FilterDecision = iota // write the entry unchanged
+	FilterRemove                       // drop the entry
+	FilterChange                       // replace the value with the one returned
+)
+
+// CompactionFilter inspects every value rewritten by compaction, which makes
+// it a cheap place for schema migrations and garbage collection such as
+// purging a tenant's keys by prefix. Compactions call it without holding
+// the tree's lock and, with subcompactions, from several goroutines at
+// once, so a filter that keeps state must guard it itself.
+type CompactionFilter interface {
+	// Name identifies the filter.
+	Name() string
+	// Filter decides the fate of key/value in a compaction writing to level.
+	// bottommost reports that no older version of the key exists outside the
+	// compaction. For FilterChange the returned string is the new value.
+	Filter(level int, bottommost bool, key, value string) (FilterDecision, string)
+}
+
+// SetCompactionFilter registers the filter applied by Compact and
+// CompactWithStrategy. Pass nil to remove it.
+func (t *LSMTree) SetCompactionFilter(f CompactionFilter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+	t.filter = f
+}
+
+// applyFilter runs the compaction filter over resolved values. Removed keys
+// become tombstones unless bottommost, so older versions in tables outside
+// the compaction cannot reappear.
+func (t *LSMTree) applyFilter(kvs []memtable.KV, level int, bottommost bool) []memtable.KV {
+	if t.filter == nil {
+		return kvs
+	}
+	out := kvs[:0]
+	for _, kv := range kvs {
+		value := kv.Value
+		switch kv.Kind {
+		case memtable.KindValue:
+		case memtable.KindBlob:
+			// The filter sees the value, not its reference. One that cannot
+			// be read is kept.
+			fetched, err := t.fetchBlob(kv)
+			if err != nil {
+				out = append(out, kv)
+				continue
+			}
+			value = fetched.Value
+		default:
+			out = append(out, kv)
+			continue
+		}
+		switch decision, value := t.filter.Filter(level, bottommost, kv.Key, value); decision {
+		case FilterRemove:
+			if bottommost {
+				continue
+			}
+			kv = memtable.KV{Key: kv.Key, Kind: memtable.KindDelete, Timestamp: kv.Timestamp}
+		case FilterChange:
+			kv.Kind, kv.Value = memtable.KindValue, value
+		}
+		out = append(out, kv)
+	}
+	return out
+}
@@ -0,0 +1,106 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"time"
+)
+
+// histogramBuckets is the number of latency buckets. Bucket i counts
+// durations below 2^i microseconds, so the last one starts at about 4.6
+// hours.
+const histogramBuckets = 25
+
+// Histogram records a latency distribution in power-of-two microsecond
+// buckets. Percentiles are estimated from the upper bound of the bucket
+// they fall in. The zero value is empty and ready to use.
+type Histogram struct {
+	buckets [histogramBuckets]uint64
+	count   uint64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+// Record adds one observation.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+	h.buckets[i]++
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.count++
+	h.sum += d
+}
+
+// Count returns the number of observations.
+func (h Histogram) Count() uint64 { return h.count }
+
+// Min returns the shortest observation.
+func (h Histogram) Min() time.Duration { return h.min }
+
+// Max returns the longest observation.
+func (h Histogram) Max() time.Duration { return h.max }
+
+// Mean returns the average observation.
+func (h Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Percentile estimates the p-th percentile, 0 < p <= 100, as the bucket
+// holding the observation of nearest rank.
+func (h Histogram) Percentile(p float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(p * float64(h.count) / 100))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= rank {
+			upper := time.Duration(1<<i) * time.Microsecond
+			if upper > h.max {
+				upper = h.max
+			}
+			return upper
+		}
+	}
+	return h.max
+}
+
+// String summarizes the distribution.
+func (h Histogram) String() string {
+	return fmt.Sprintf("count=%d mean=%v p50=%v p99=%v max=%v",
+		h.count, h.Mean(), h.Percentile(50), h.Percentile(99), h.max)
+}
+
+// MarshalJSON encodes the summary, with durations in microseconds.
+func (h Histogram) MarshalJSON() ([]byte, error) {
+	us := func(d time.Duration) float64 { return float64(d) / float64(time.Microsecond) }
+	return json.Marshal(struct {
+		Count  uint64  `json:"count"`
+		MinUS  float64 `json:"min_us"`
+		MeanUS float64 `json:"mean_us"`
+		P50US  float64 `json:"p50_us"`
+		P90US  float64 `json:"p90_us"`
+		P99US  float64 `json:"p99_us"`
+		MaxUS  float64 `json:"max_us"`
+	}{h.count, us(h.min), us(h.Mean()), us(h.Percentile(50)), us(h.Percentile(90)), us(h.Percentile(99)), us(h.max)})
+}
@@ -0,0 +1,191 @@
+package lsmtree
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"lsm/sstable"
+	"lsm/wal"
+)
+
+// IngestExternalFiles adds tables built with sstable.Writer to the tree
+// without passing their entries through the memtable. Each file must be
+// sorted by key and the files must not overlap each other. The whole batch
+// is assigned one new sequence number, so its entries shadow all existing
+// data, and every file is copied into the tree directory on the deepest
+// level where no newer data overlaps it. The source files are left in place
+// and the caller may reuse or delete them afterwards. Subscriptions see the
+// batch as one ChangeIngest.
+func (t *LSMTree) IngestExternalFiles(paths []string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Levels are chosen against the tables a running compaction replaces
+	t.waitForCompaction()
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	type external struct {
+		path     string
+		min, max string
+	}
+	files := make([]external, 0, len(paths))
+	for _, path := range paths {
+		tbl, err := sstable.Load(path)
+		if err != nil {
+			return err
+		}
+		min, max, ok, err := sortedRange(tbl)
+		if err != nil {
+			return fmt.Errorf("lsmtree: ingest %s: %w", path, err)
+		}
+		if ok {
+			files = append(files, external{path: path, min: min, max: max})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].min < files[j].min })
+	for i := 1; i < len(files); i++ {
+		if files[i].min <= files[i-1].max {
+			return fmt.Errorf("lsmtree: ingest: %s and %s overlap", files[i-1].path, files[i].path)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	// Memtable data is older than the batch but would be read first
+	for _, f := range files {
+		if t.memOverlaps(f.min, f.max) {
+			if err := t.flush(); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	// The tree is only changed once the manifest lists the new tables, so a
+	// failure leaves it as it was
+	seq := *t.seq + 1
+	flushedSeq := t.flushedSeq
+	if t.Mem.Len() == 0 {
+		flushedSeq = seq
+	}
+	nextID := t.nextID
+	tables := slices.Clone(t.Tables)
+	ingested := maps.Clone(t.ingested)
+	if ingested == nil {
+		ingested = make(map[string]ingestedTable)
+	}
+
+	var added []string
+	var loaded []*sstable.SSTable
+	fail := func(err error) error {
+		for _, path := range added {
+			os.Remove(path)
+		}
+		return err
+	}
+	for _, f := range files {
+		level := ingestLevel(tables, f.min, f.max)
+		dst := t.tablePath(nextID)
+		name := filepath.Base(dst)
+		// A link would share the file with the caller, who may rewrite it.
+		// A file already at dst was left by an interrupted ingest and is not
+		// in the manifest
+		os.Remove(dst)
+		if err := copyFile(f.path, dst); err != nil {
+			return fail(err)
+		}
+		added = append(added, dst)
+		nextID++
+
+		tbl, err := sstable.Load(dst)
+		if err != nil {
+			return fail(err)
+		}
+		if err := tbl.SetPrefixExtractor(t.prefix); err != nil {
+			return fail(err)
+		}
+		tbl.Meta.Level = level
+		tbl.Meta.MinSeq, tbl.Meta.MaxSeq = seq, seq
+		ingested[name] = ingestedTable{Level: level, Seq: seq}
+		tables = append(tables, tbl)
+		loaded = append(loaded, tbl)
+	}
+	sortTables(tables)
+
+	// The ingest is logged for subscriptions. Once logged it has used up its
+	// sequence number, even if the manifest cannot be written
+	r := wal.Record{Seq: seq, Op: wal.OpIngest, Key: files[0].min, Value: files[len(files)-1].max, Timestamp: time.Now().UnixNano(), Family: t.family}
+	if err := t.wal.Append(r); err != nil {
+		return fail(err)
+	}
+	*t.seq = seq
+	t.families.feed.publish(r)
+
+	fm := tableManifest(nextID, flushedSeq, tables, ingested)
+	if err := writeManifest(t.Dir, t.manifestWith(fm)); err != nil {
+		return fail(err)
+	}
+	t.flushedSeq, t.nextID = flushedSeq, nextID
+	t.Tables, t.ingested = tables, ingested
+	t.tablesChanged()
+	t.tablesCreated(loaded, ReasonIngest)
+	return nil
+}
+
+// ingestLevel picks the deepest level in use such that no table on it or
+// above overlaps [min, max]. Without overlap checks on the deeper levels the
+// batch could be placed below older versions of its keys.
+func ingestLevel(tables []*sstable.SSTable, min, max string) int {
+	deepest := 0
+	for _, tbl := range tables {
+		if tbl.Meta.Level > deepest {
+			deepest = tbl.Meta.Level
+		}
+	}
+	level := deepest
+	for _, tbl := range tables {
+		if tbl.Overlaps(min, max) && tbl.Meta.Level-1 < level {
+			level = tbl.Meta.Level - 1
+		}
+	}
+	if level < 0 {
+		level = 0
+	}
+	return level
+}
+
+// memOverlaps reports whether the memtable holds any key in [min, max].
+func (t *LSMTree) memOverlaps(min, max string) bool {
+	for _, kv := range t.Mem.Entries() {
+		if kv.Key >= min && kv.Key <= max {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedRange returns the smallest and largest key of tbl, checking that its
+// keys are strictly increasing. ok is false for an empty table.
+func sortedRange(tbl *sstable.SSTable) (min, max string, ok bool, err error) {
+	entries, err := tbl.Entries()
+	if err != nil {
+		return "", "", false, err
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Key <= entries[i-1].Key {
+			return "", "", false, fmt.Errorf("keys out of order at %q", entries[i].Key)
+		}
+	}
+	if len(entries) == 0 {
+		return "", "", false, nil
+	}
+	return entries[0].Key, entries[len(entries)-1].Key, true, nil
+}
@@ -0,0 +1,86 @@
+package lsmtree
+
+import (
+	"lsm/memtable"
+	"lsm/sstable"
+)
+
+// Iterator walks the live keys of the tree in order, as they were when the
+// iterator was created. Merge operands are combined as entries are produced.
+type Iterator struct {
+	kvs []memtable.KV
+	pos int
+}
+
+// NewIterator returns an iterator over keys in [start, end). An empty end
+// means no upper bound. Tables are read without holding the tree's lock.
+func (t *LSMTree) NewIterator(start, end string) (*Iterator, error) {
+	s := t.NewSnapshot()
+	defer s.Release()
+	return s.NewIterator(start, end)
+}
+
+// buildIterator builds an iterator over [start, end) from tables, oldest
+// first, and the memtable contents mem and memDels written up to seq.
+func (t *LSMTree) buildIterator(tables []*sstable.SSTable, mem []memtable.KV, memDels []memtable.RangeTombstone, seq uint64, start, end string, use func(tbl *sstable.SSTable) bool) (*Iterator, error) {
+	inRange := func(key string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+
+	// Oldest tables first so newer data is layered on top
+	v := newView(t, inRange)
+	for _, tbl := range tables {
+		if !tbl.Overlaps(start, end) {
+			continue // no keys or range tombstones in [start, end)
+		}
+		if use != nil && !use(tbl) {
+			if err := v.add(nil, tbl.RangeDels, tbl.Meta.MaxSeq); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := v.addTable(tbl); err != nil {
+			return nil, err
+		}
+	}
+	if err := v.add(mem, memDels, seq); err != nil {
+		return nil, err
+	}
+
+	kvs := v.sorted()
+	kvs, err := t.resolveAll(kvs, true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range kvs {
+		if kvs[i], err = t.fetchBlob(kvs[i]); err != nil {
+			return nil, err
+		}
+	}
+	return &Iterator{kvs: kvs, pos: -1}, nil
+}
+
+// Next advances to the next entry, reporting false when none remain.
+func (it *Iterator) Next() bool {
+	if it.pos < len(it.kvs) {
+		it.pos++
+	}
+	return it.pos < len(it.kvs)
+}
+
+// Key returns the key at the current position.
+func (it *Iterator) Key() string {
+	return it.kvs[it.pos].Key
+}
+
+// Value returns the value at the current position.
+func (it *Iterator) Value() string {
+	return it.kvs[it.pos].Value
+}
+
+// Close releases the iterator.
+func (it *Iterator) Close() error {
+	it.kvs = nil
+	it.pos = 0
+	return nil
+}
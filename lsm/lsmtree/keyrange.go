@@ -0,0 +1,103 @@
+package lsmtree
+
+import (
+	"sort"
+
+	"lsm/sstable"
+)
+
+// tableIndex finds the tables whose key range holds a key without checking
+// every table. Levels above 0 whose tables do not overlap are searched by
+// binary search over their ranges; level 0 and any level with overlapping
+// tables are scanned.
+type tableIndex struct {
+	pos     map[*sstable.SSTable]int   // position in Tables, oldest first
+	scanned []*sstable.SSTable         // tables checked one by one
+	sorted  map[int][]*sstable.SSTable // disjoint levels, by smallest key
+}
+
+// tablesChanged rebuilds the table index. It must be called whenever
+// Tables changes.
+func (t *LSMTree) tablesChanged() {
+	idx := &tableIndex{
+		pos:    make(map[*sstable.SSTable]int, len(t.Tables)),
+		sorted: make(map[int][]*sstable.SSTable),
+	}
+	levels := make(map[int][]*sstable.SSTable)
+	for i, tbl := range t.Tables {
+		idx.pos[tbl] = i
+		tbl.SetCache(t.cache)
+		if t.mmap {
+			// A table that cannot be mapped is read from its file
+			tbl.Mmap()
+		}
+		if _, _, ok := tbl.KeyRange(); !ok {
+			continue // holds nothing to find
+		}
+		levels[tbl.Meta.Level] = append(levels[tbl.Meta.Level], tbl)
+	}
+	for level, tables := range levels {
+		if level == 0 || !sortDisjoint(tables) {
+			idx.scanned = append(idx.scanned, tables...)
+			continue
+		}
+		idx.sorted[level] = tables
+	}
+	t.index = idx
+}
+
+// sortDisjoint sorts tables by smallest key and reports whether their key
+// ranges are disjoint.
+func sortDisjoint(tables []*sstable.SSTable) bool {
+	sort.Slice(tables, func(i, j int) bool {
+		a, _, _ := tables[i].KeyRange()
+		b, _, _ := tables[j].KeyRange()
+		return a < b
+	})
+	for i := 1; i < len(tables); i++ {
+		_, prevMax, _ := tables[i-1].KeyRange()
+		min, _, _ := tables[i].KeyRange()
+		if min <= prevMax {
+			return false
+		}
+	}
+	return true
+}
+
+// tablesFor returns the tables whose key range, including range tombstones,
+// holds key, oldest first. Other tables can neither hold key nor delete it.
+func (t *LSMTree) tablesFor(key string) []*sstable.SSTable {
+	var found []*sstable.SSTable
+	for _, tbl := range t.index.scanned {
+		if tbl.Overlaps(key, key) {
+			found = append(found, tbl)
+		}
+	}
+	for _, tables := range t.index.sorted {
+		i := sort.Search(len(tables), func(i int) bool {
+			_, max, _ := tables[i].KeyRange()
+			return max >= key
+		})
+		if i < len(tables) && tables[i].Overlaps(key, key) {
+			found = append(found, tables[i])
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return t.index.pos[found[i]] < t.index.pos[found[j]] })
+	return found
+}
+
+// SetMmapReads maps every table into memory, including tables written
+// later, so lookups binary search the mapping instead of opening and
+// scanning the file. Mappings are released when tables are deleted or the
+// tree is closed. Passing false releases them.
+func (t *LSMTree) SetMmapReads(enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mmap = enabled
+	if !enabled {
+		for _, tbl := range t.Tables {
+			tbl.Close()
+		}
+	}
+	t.tablesChanged()
+}
@@ -0,0 +1,95 @@
+package lsmtree
+
+import (
+	"os"
+
+	"lsm/sstable"
+)
+
+// defaultTableCacheSize is the number of table files a tree keeps open.
+const defaultTableCacheSize = 64
+
+// SetTableCacheSize sets how many table files are kept open for reads. Zero
+// or less opens the file for every read.
+func (t *LSMTree) SetTableCacheSize(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old := t.cache
+	t.cache = nil
+	if n > 0 {
+		t.cache = sstable.NewTableCache(n)
+	}
+	t.tablesChanged()
+	if old != nil {
+		for _, tbl := range t.Tables {
+			old.Evict(tbl.Path)
+		}
+	}
+}
+
+// TableCache returns the tree's open-file cache, or nil if it has none.
+func (t *LSMTree) TableCache() *sstable.TableCache {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.cache
+}
+
+// ref keeps tables' files until unref, even if they are compacted away in
+// the meantime. Reads that run without the lock hold references.
+func (t *LSMTree) ref(tables []*sstable.SSTable) {
+	if t.refs == nil {
+		t.refs = make(map[*sstable.SSTable]int)
+	}
+	for _, tbl := range tables {
+		t.refs[tbl]++
+	}
+}
+
+// unref drops references taken by ref, deleting tables that were retired
+// while referenced.
+func (t *LSMTree) unref(tables []*sstable.SSTable) {
+	if t.refs == nil {
+		return // closed
+	}
+	for _, tbl := range tables {
+		t.refs[tbl]--
+		if t.refs[tbl] > 0 {
+			continue
+		}
+		delete(t.refs, tbl)
+		if reason, ok := t.obsolete[tbl]; ok {
+			delete(t.obsolete, tbl)
+			t.removeTable(tbl, reason)
+			t.collectBlobs()
+		}
+	}
+}
+
+// retire deletes tables no longer listed in the manifest, deferring the
+// deletion of any still referenced by a read or snapshot.
+func (t *LSMTree) retire(tables []*sstable.SSTable, reason string) {
+	for _, tbl := range tables {
+		if t.refs[tbl] > 0 {
+			if t.obsolete == nil {
+				t.obsolete = make(map[*sstable.SSTable]string)
+			}
+			t.obsolete[tbl] = reason
+			continue
+		}
+		t.removeTable(tbl, reason)
+	}
+	t.collectBlobs()
+}
+
+// removeTable releases tbl's mapping and cached file, deletes the file and
+// reports it to the listener.
+func (t *LSMTree) removeTable(tbl *sstable.SSTable, reason string) {
+	tbl.Close()
+	if t.cache != nil {
+		t.cache.Evict(tbl.Path)
+	}
+	os.Remove(tbl.Path)
+	if t.listener != nil {
+		t.listener.OnTableFileDeleted(tableEvent(tbl, reason))
+	}
+}
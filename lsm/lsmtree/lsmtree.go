@@ -1,40 +1,90 @@
 package lsmtree
 
 import (
-	"bufio"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"lsm/bloom"
 	"lsm/compaction"
 	"lsm/memtable"
+	"lsm/ratelimit"
 	"lsm/sstable"
+	"lsm/wal"
 )
 
 // LSMTree coordinates memtable and SSTables with optional advanced features.
+// Its methods are safe for concurrent use.
 type LSMTree struct {
 	Mem    *memtable.Memtable
 	Tables []*sstable.SSTable
 	Dir    string
 	nextID int
 
+	mu         *sync.Mutex // shared by the tree's column families
+	wal        *wal.Log    // shared by the tree's column families
+	seq        *uint64     // last sequence number assigned to a write, in any family
+	flushedSeq uint64      // every write up to this sequence number is in a table
+	ingested   map[string]ingestedTable
+
+	family   string          // column family name; empty for the default one
+	families *columnFamilies // every family of the directory
+	dropped  bool            // set by DropColumnFamily
+
 	// Optional advanced features
-	strategy *compaction.Strategy // nil for basic mode
-	stats    *LSMStats            // nil for basic mode
+	strategy *compaction.Strategy    // nil for basic mode
+	stats    *LSMStats               // nil for basic mode
+	mergeOp  MergeOperator           // nil until SetMergeOperator
+	filter   CompactionFilter        // nil until SetCompactionFilter
+	prefix   sstable.PrefixExtractor // nil until SetPrefixExtractor
+	policy   bloom.Policy            // nil until SetFilterPolicy
+	limiter  *ratelimit.Limiter      // nil until SetRateLimiter
+	stall    *WriteStallOptions      // nil until SetWriteStall
+	delay    *ratelimit.Limiter      // paces writes while slowed down
+
+	subcompactions int           // key ranges merged in parallel per compaction
+	compacting     bool          // a compaction is merging its inputs without the lock
+	listener       EventListener // nil until SetEventListener
+
+	levels  map[int]*levelCounters // lookup counters by level; nil for basic mode
+	latency *[numOps]Histogram     // nil for basic mode
+	index   *tableIndex            // rebuilt by tablesChanged
+	mmap    bool                   // map tables into memory for reads
+
+	cache    *sstable.TableCache         // open table files; nil to reopen per read
+	refs     map[*sstable.SSTable]int    // references held by reads and snapshots
+	obsolete map[*sstable.SSTable]string // retired tables awaiting their last reference
+	blobs    *blobState                  // blob files for key-value separation
 }
 
 // LSMStats tracks performance metrics
 type LSMStats struct {
-	TotalWrites      uint64
-	TotalReads       uint64
-	MemtableHits     uint64
-	SSTableHits      uint64
-	BloomFilterSaves uint64
-	CompactionCount  uint64
-	TotalFlushes     uint64
+	TotalWrites      uint64 `json:"total_writes"`
+	TotalReads       uint64 `json:"total_reads"`
+	MemtableHits     uint64 `json:"memtable_hits"`
+	SSTableHits      uint64 `json:"sstable_hits"`
+	BloomFilterSaves uint64 `json:"bloom_filter_saves"`
+	KeyRangeSaves    uint64 `json:"key_range_saves"` // tables skipped by Get as outside their key range
+	CompactionCount  uint64 `json:"compactions"`
+	TotalFlushes     uint64 `json:"flushes"`
+	Subcompactions   uint64 `json:"subcompactions"` // key ranges merged in parallel by compactions
+
+	TablesDropped     uint64 `json:"tables_dropped"`      // tables deleted whole, by range deletions or a FIFO strategy
+	PrefixScans       uint64 `json:"prefix_scans"`        // prefix iterators created
+	PrefixFilterSaves uint64 `json:"prefix_filter_saves"` // tables skipped by a prefix scan
+
+	StallSlowdowns    uint64        `json:"stall_slowdowns"`        // writes delayed by a soft stall limit
+	StallSlowdownTime time.Duration `json:"stall_slowdown_time_ns"` // time writes spent delayed
+	StallStops        uint64        `json:"stall_stops"`            // writes that waited for compaction at a hard limit
+	StallStopTime     time.Duration `json:"stall_stop_time_ns"`     // time writes spent waiting for compaction
+
+	BlobBytesWritten   uint64 `json:"blob_bytes_written"`   // value bytes written to blob files
+	BlobBytesRelocated uint64 `json:"blob_bytes_relocated"` // live value bytes moved out of garbage collected blob files
+	BlobFilesDeleted   uint64 `json:"blob_files_deleted"`   // blob files deleted once no table referenced them
 }
 
 // New creates a basic LSM tree without advanced features.
@@ -56,111 +106,386 @@ func newLSMTree(dir string, threshold int, strategy *compaction.Strategy, enable
 	t := &LSMTree{
 		Mem:      memtable.New(threshold),
 		Dir:      dir,
+		mu:       new(sync.Mutex),
+		seq:      new(uint64),
 		strategy: strategy,
+		cache:    sstable.NewTableCache(defaultTableCacheSize),
 	}
+	t.families = &columnFamilies{root: t, compactionDone: sync.NewCond(t.mu)}
 
 	if enableStats {
-		t.stats = &LSMStats{}
+		t.enableStats()
 	}
 
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
-			return err
-		}
-		if filepath.Ext(path) == ".sst" {
-			table, err := sstable.Load(path)
-			if err != nil {
-				return err
-			}
-			t.Tables = append(t.Tables, table)
+	if err := t.loadTables(); err != nil {
+		return nil, err
+	}
+	for _, family := range t.families.all() {
+		if err := family.loadBlobs(); err != nil {
+			return nil, err
 		}
-		return nil
-	})
-	if err != nil {
+	}
+	t.tablesChanged()
+	if err := t.openWAL(); err != nil {
 		return nil, err
 	}
-	sort.Slice(t.Tables, func(i, j int) bool { return t.Tables[i].Path < t.Tables[j].Path })
-	t.nextID = len(t.Tables)
 	return t, nil
 }
 
+// enableStats starts collecting statistics and latency histograms.
+func (t *LSMTree) enableStats() {
+	t.stats = &LSMStats{}
+	t.latency = new([numOps]Histogram)
+}
+
+// Close flushes the write-ahead log and releases its file. Unflushed
+// memtable contents are recovered from the log on the next open.
+func (t *LSMTree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.family != "" {
+		return nil // closed with the default family
+	}
+	t.families.waitForCompactions()
+	for s := range t.families.feed.subs {
+		s.close()
+	}
+	var err error
+	for _, family := range t.families.all() {
+		if ferr := family.close(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	if werr := t.wal.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// close releases the family's table and blob files.
+func (t *LSMTree) close() error {
+	for _, tbl := range t.Tables {
+		tbl.Close()
+		if t.cache != nil {
+			t.cache.Evict(tbl.Path)
+		}
+	}
+	// Snapshots cannot be used after Close
+	for tbl, reason := range t.obsolete {
+		t.removeTable(tbl, reason)
+	}
+	t.obsolete, t.refs = nil, nil
+	return t.closeBlobs()
+}
+
+// sortTables orders tables oldest to newest by the newest write they hold:
+// first by sequence number, then by write time for tables written before
+// sequence numbers were recorded. A compacted table inherits the newest
+// write of its inputs, so it keeps the position of its newest input.
+func sortTables(tables []*sstable.SSTable) {
+	sort.SliceStable(tables, func(i, j int) bool {
+		if a, b := tables[i].Meta.MaxSeq, tables[j].Meta.MaxSeq; a != b {
+			return a < b
+		}
+		a, b := tables[i].Meta.MaxTimestamp, tables[j].Meta.MaxTimestamp
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return tableID(tables[i].Path) < tableID(tables[j].Path)
+	})
+}
+
+// seqRange returns the sequence range covered by tables.
+func seqRange(tables []*sstable.SSTable) (min, max uint64) {
+	for i, tbl := range tables {
+		if i == 0 || tbl.Meta.MinSeq < min {
+			min = tbl.Meta.MinSeq
+		}
+		if tbl.Meta.MaxSeq > max {
+			max = tbl.Meta.MaxSeq
+		}
+	}
+	return min, max
+}
+
+// tableID extracts the numeric id from an "ss-<id>.sst" file name, or -1.
+func tableID(path string) int {
+	name := filepath.Base(path)
+	if i := strings.LastIndex(name, "ss-"); i > 0 {
+		name = name[i:] // column family tables are prefixed by the family name
+	}
+	var id int
+	if _, err := fmt.Sscanf(name, "ss-%d.sst", &id); err != nil {
+		return -1
+	}
+	return id
+}
+
+// tablePath returns the path of table file id. Tables of column families
+// other than the default one are prefixed by the family name.
+func (t *LSMTree) tablePath(id int) string {
+	name := fmt.Sprintf("ss-%d.sst", id)
+	if t.family != "" {
+		name = t.family + "-" + name
+	}
+	return filepath.Join(t.Dir, name)
+}
+
 // Put inserts a key-value pair.
 func (t *LSMTree) Put(key, value string) error {
+	start := time.Now()
+	if err := t.throttle(len(key) + len(value)); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.observe(opPut, start)
+
 	// Track statistics if enabled
 	if t.stats != nil {
 		t.stats.TotalWrites++
 	}
 
-	t.Mem.Put(key, value)
+	if err := t.logWrite(wal.OpPut, key, value); err != nil {
+		return err
+	}
+	return t.maybeFlush()
+}
+
+// maybeFlush flushes a full memtable and runs strategy compaction if needed.
+func (t *LSMTree) maybeFlush() error {
 	if t.Mem.IsFull() {
 		if t.stats != nil {
 			t.stats.TotalFlushes++
 		}
 
 		if err := t.flush(); err != nil {
-			return err
+			return t.backgroundError("flush", err)
 		}
 
-		// Check if compaction is needed using strategy (if available)
-		if t.strategy != nil && (*t.strategy).ShouldCompact(t.Tables) {
-			return t.CompactWithStrategy()
+		// Check if compaction is needed using strategy (if available). A
+		// compaction already running picks up the new table later.
+		if t.strategy != nil && !t.compacting && (*t.strategy).ShouldCompact(t.Tables) {
+			return t.backgroundError("compaction", t.compactWithStrategy())
 		}
 	}
 	return nil
 }
 
 func (t *LSMTree) flush() error {
-	kvs := t.Mem.Flush()
-	path := filepath.Join(t.Dir, fmt.Sprintf("ss-%d.sst", t.nextID))
-	tbl, err := sstable.New(path, kvs)
+	defer t.observe(opFlush, time.Now())
+	if t.listener == nil {
+		return t.flushMemtable()
+	}
+	ev := FlushEvent{Entries: t.Mem.Len()}
+	t.listener.OnFlushBegin(ev)
+	start := time.Now()
+	err := t.flushMemtable()
+	ev.Duration, ev.Err = time.Since(start), err
+	if err == nil {
+		tbl := t.Tables[len(t.Tables)-1]
+		ev.Table, ev.Bytes = tbl.Path, tbl.Size
+	}
+	t.listener.OnFlushEnd(ev)
+	return err
+}
+
+// flushMemtable writes the memtable to a new level 0 table.
+func (t *LSMTree) flushMemtable() error {
+	bottommost := len(t.Tables) == 0
+	var rangeDels []memtable.RangeTombstone
+	if !bottommost {
+		rangeDels = t.Mem.RangeTombstones()
+	}
+	kvs, err := t.resolveAll(t.Mem.Flush(), bottommost)
+	if err != nil {
+		return err
+	}
+	tbl, err := t.writeTable(kvs, rangeDels, sstable.Options{MinSeq: t.flushedSeq + 1, MaxSeq: *t.seq})
 	if err != nil {
 		return err
 	}
 	t.Tables = append(t.Tables, tbl)
-	t.nextID++
-	return nil
+	t.tablesChanged()
+	t.flushedSeq = *t.seq
+	if err := t.saveManifest(); err != nil {
+		return err
+	}
+	t.tablesCreated([]*sstable.SSTable{tbl}, ReasonFlush)
+	return t.families.resetWAL()
 }
 
-// Get searches memtable then SSTables newest to oldest.
+// Get searches memtable then SSTables newest to oldest. Tables are read
+// without holding the tree's lock, so reads run concurrently with each
+// other and with writes.
 func (t *LSMTree) Get(key string) (string, bool, error) {
+	start := time.Now()
+	t.mu.Lock()
+
 	// Track statistics if enabled
 	if t.stats != nil {
 		t.stats.TotalReads++
 	}
 
 	// Check memtable first
-	if v, ok := t.Mem.Get(key); ok {
-		if t.stats != nil {
-			t.stats.MemtableHits++
+	var pending []string // merge operands seen so far, oldest first
+	if kv, ok := t.Mem.Lookup(key); ok {
+		if kv.Kind == memtable.KindValue {
+			defer t.mu.Unlock()
+			defer t.observe(opGet, start)
+			if t.stats != nil {
+				t.stats.MemtableHits++
+			}
+			return t.mergeValue(kv, nil)
 		}
-		return v, true, nil
+		pending = append([]string(nil), kv.Operands...)
 	}
 
-	// Check SSTables newest to oldest
-	for i := len(t.Tables) - 1; i >= 0; i-- {
-		// Use Bloom filter to avoid unnecessary disk reads (if available)
-		if t.Tables[i].Bloom != nil && !t.Tables[i].Bloom.Contains(key) {
-			if t.stats != nil {
-				t.stats.BloomFilterSaves++
-			}
+	// Range tombstones hide data in tables older than themselves
+	covered := coveringSeq(0, t.Mem.RangeTombstones(), key)
+
+	// Skip tables whose key range cannot hold key. The references keep the
+	// files of tables compacted away while they are read.
+	tables := t.tablesFor(key)
+	if t.stats != nil {
+		t.stats.KeyRangeSaves += uint64(len(t.Tables) - len(tables))
+	}
+	t.ref(tables)
+	t.mu.Unlock()
+
+	var counts readCounts
+	kv, found, pending, err := searchTables(tables, key, pending, covered, &counts)
+	if err == nil && found {
+		kv, err = t.fetchBlob(kv)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	defer t.observe(opGet, start)
+	t.unref(tables)
+	t.addReadCounts(&counts)
+	if err != nil {
+		return "", false, err
+	}
+	if found {
+		return t.mergeValue(kv, pending)
+	}
+	if pending != nil {
+		// Operands with no base value anywhere in the tree
+		return t.mergeValue(memtable.KV{Key: key, Kind: memtable.KindMerge}, pending)
+	}
+	return "", false, nil
+}
+
+// readCounts collects the statistics of reads done without the lock.
+type readCounts struct {
+	bloomSaves  uint64
+	sstableHits uint64
+	levels      map[int]*levelCounters
+}
+
+// level returns the counters of a level.
+func (c *readCounts) level(level int) *levelCounters {
+	if c.levels == nil {
+		c.levels = make(map[int]*levelCounters)
+	}
+	lc := c.levels[level]
+	if lc == nil {
+		lc = &levelCounters{}
+		c.levels[level] = lc
+	}
+	return lc
+}
+
+// addReadCounts adds counts to the statistics, if enabled.
+func (t *LSMTree) addReadCounts(c *readCounts) {
+	if t.stats == nil {
+		return
+	}
+	t.stats.BloomFilterSaves += c.bloomSaves
+	t.stats.SSTableHits += c.sstableHits
+	for level, lc := range c.levels {
+		total := t.levelStats(level)
+		total.hits += lc.hits
+		total.bloomUseful += lc.bloomUseful
+		total.bloomFalsePositives += lc.bloomFalsePositives
+	}
+}
+
+// searchTables looks key up in tables, ordered oldest first, from the
+// newest down. covered is the newest range tombstone over key seen so far
+// and pending the merge operands found above the tables. It returns the
+// newest value record and the operands written after it, or found false
+// and every operand if no value exists. Only immutable table state is
+// read, so it needs no lock.
+func searchTables(tables []*sstable.SSTable, key string, pending []string, covered uint64, counts *readCounts) (kv memtable.KV, found bool, operands []string, err error) {
+	for i := len(tables) - 1; i >= 0; i-- {
+		tbl := tables[i]
+		if covered > tbl.Meta.MaxSeq {
+			break // this and all older tables are deleted for key
+		}
+		if !tbl.MayContainKey(key) {
+			// Only its range tombstones reach key
+			covered = coveringSeq(covered, tbl.RangeDels, key)
 			continue
 		}
 
-		if v, ok, err := t.Tables[i].Get(key); err != nil {
-			return "", false, err
-		} else if ok {
-			if t.stats != nil {
-				t.stats.SSTableHits++
-			}
-			return v, true, nil
+		// Use the table's filter to avoid unnecessary disk reads (if available)
+		level := counts.level(tbl.Meta.Level)
+		if tbl.Filter != nil && !tbl.Filter.Contains(key) {
+			counts.bloomSaves++
+			level.bloomUseful++
+			covered = coveringSeq(covered, tbl.RangeDels, key)
+			continue
+		}
+
+		kv, ok, err := tbl.Lookup(key)
+		if err != nil {
+			return memtable.KV{}, false, nil, err
+		}
+		switch {
+		case ok:
+			level.hits++
+		case tbl.Filter != nil:
+			level.bloomFalsePositives++
 		}
+		if ok && kv.Kind == memtable.KindDelete {
+			break
+		}
+		if ok && (kv.Kind == memtable.KindValue || kv.Kind == memtable.KindBlob) {
+			counts.sstableHits++
+			return kv, true, pending, nil
+		}
+		if ok {
+			pending = append(append([]string(nil), kv.Operands...), pending...)
+		}
+		covered = coveringSeq(covered, tbl.RangeDels, key)
 	}
+	return memtable.KV{}, false, pending, nil
+}
 
-	return "", false, nil
+// mergeValue applies pending operands on top of a record found by Get.
+func (t *LSMTree) mergeValue(kv memtable.KV, pending []string) (string, bool, error) {
+	kv.Operands = append(kv.Operands, pending...)
+	resolved, err := t.resolve(kv, true)
+	if err != nil {
+		return "", false, err
+	}
+	return resolved.Value, true, nil
 }
 
 // Compact merges all tables into one (basic compaction).
 func (t *LSMTree) Compact() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.compact()
+}
+
+func (t *LSMTree) compact() error {
+	t.waitForCompaction()
+	if err := t.dropCoveredTables(); err != nil {
+		return err
+	}
 	if len(t.Tables) < 2 {
 		return nil
 	}
@@ -169,52 +494,166 @@ func (t *LSMTree) Compact() error {
 		t.stats.CompactionCount++
 	}
 
-	merged := make(map[string]string)
-	// newer tables override old
+	level := 0
 	for _, tbl := range t.Tables {
-		f, err := os.Open(tbl.Path)
-		if err != nil {
-			return err
-		}
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			parts := strings.SplitN(scanner.Text(), "\t", 2)
-			if len(parts) == 2 {
-				merged[parts[0]] = parts[1]
-			}
+		if tbl.Meta.Level > level {
+			level = tbl.Meta.Level
 		}
-		f.Close()
-		if err := scanner.Err(); err != nil {
-			return err
+	}
+	return t.runCompaction("", t.Tables, level, true)
+}
+
+// waitForCompaction waits, releasing the lock meanwhile, until no
+// compaction of the family is running. Compactions of a family run one at
+// a time, and the options they read are only changed between them.
+func (t *LSMTree) waitForCompaction() {
+	for t.compacting {
+		t.families.compactionDone.Wait()
+	}
+}
+
+// waitForCompactions waits until no family is compacting.
+func (f *columnFamilies) waitForCompactions() {
+	for _, family := range f.all() {
+		if family.compacting {
+			family.waitForCompaction()
+			f.waitForCompactions() // families may have changed meanwhile
+			return
 		}
 	}
-	// use memtable KV type to sort
-	kvs := make([]memtable.KV, 0, len(merged))
-	for k, v := range merged {
-		kvs = append(kvs, memtable.KV{Key: k, Value: v})
+}
+
+// mergeTables reads tables oldest to newest and returns their sorted union,
+// with entries from newer tables overriding older ones, keys deleted by
+// range tombstones dropped, merge operands combined and the compaction
+// filter applied for the output level. The range tombstones are returned
+// for the output unless bottommost, i.e. no older tables exist outside the
+// inputs for them to hide.
+func (t *LSMTree) mergeTables(tables []*sstable.SSTable, level int, bottommost bool) ([]memtable.KV, []memtable.RangeTombstone, error) {
+	v := newView(t, nil)
+	for _, tbl := range tables {
+		if err := v.addTable(tbl); err != nil {
+			return nil, nil, err
+		}
 	}
-	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
-	path := filepath.Join(t.Dir, fmt.Sprintf("ss-%d.sst", t.nextID))
-	tbl, err := sstable.New(path, kvs)
+	kvs, err := t.resolveAll(v.sorted(), bottommost)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	// remove old tables
-	for _, old := range t.Tables {
-		os.Remove(old.Path)
+	var rangeDels []memtable.RangeTombstone
+	if !bottommost {
+		rangeDels = v.rangeDels
 	}
-	t.Tables = []*sstable.SSTable{tbl}
-	t.nextID++
-	return nil
+	return t.applyFilter(kvs, level, bottommost), rangeDels, nil
+}
+
+// isBottommost reports whether selected holds the oldest tables in the tree,
+// so that no older version of any key exists outside it.
+func (t *LSMTree) isBottommost(selected []*sstable.SSTable) bool {
+	in := make(map[string]bool, len(selected))
+	for _, tbl := range selected {
+		in[tbl.Path] = true
+	}
+	for _, tbl := range t.Tables[:len(selected)] {
+		if !in[tbl.Path] {
+			return false
+		}
+	}
+	return true
+}
+
+// withInterleaved adds to selected every other table that shares keys with
+// it and whose newest entry is newer than selected's oldest but older than
+// its newest. The merged output is ordered by its newest entry, so leaving
+// such a table out would place older versions of its keys above it and
+// undo its overwrites, range deletions and merge operands.
+func (t *LSMTree) withInterleaved(selected []*sstable.SSTable) []*sstable.SSTable {
+	selected = append([]*sstable.SSTable(nil), selected...)
+	in := make(map[*sstable.SSTable]bool, len(selected))
+	for _, tbl := range selected {
+		in[tbl] = true
+	}
+	for added := true; added; {
+		added = false
+		minSeq, maxSeq := seqRange(selected)
+		var minKey, maxKey string
+		var hasKeys bool
+		for _, tbl := range selected {
+			if min, max, ok := tbl.KeyRange(); ok {
+				if !hasKeys || min < minKey {
+					minKey = min
+				}
+				if !hasKeys || max > maxKey {
+					maxKey = max
+				}
+				hasKeys = true
+			}
+		}
+		if !hasKeys {
+			break
+		}
+		for _, tbl := range t.Tables {
+			if in[tbl] || tbl.Meta.MaxSeq <= minSeq || tbl.Meta.MaxSeq >= maxSeq || !tbl.Overlaps(minKey, maxKey) {
+				continue
+			}
+			selected = append(selected, tbl)
+			in[tbl] = true
+			added = true
+		}
+	}
+	return selected
 }
 
 // CompactWithStrategy uses the configured strategy for compaction.
 func (t *LSMTree) CompactWithStrategy() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.compactWithStrategy()
+}
+
+// dropTables removes tables and their data from the tree without merging
+// them into any other table.
+func (t *LSMTree) dropTables(drop []*sstable.SSTable) error {
+	if len(drop) == 0 {
+		return nil
+	}
+	dropped := make(map[*sstable.SSTable]bool, len(drop))
+	for _, tbl := range drop {
+		dropped[tbl] = true
+	}
+	var kept []*sstable.SSTable
+	for _, tbl := range t.Tables {
+		if !dropped[tbl] {
+			kept = append(kept, tbl)
+		}
+	}
+	t.Tables = kept
+	t.tablesChanged()
+	if t.stats != nil {
+		t.stats.TablesDropped += uint64(len(drop))
+	}
+	if err := t.saveManifest(); err != nil {
+		return err
+	}
+	t.retire(drop, ReasonDrop)
+	return nil
+}
+
+func (t *LSMTree) compactWithStrategy() error {
 	if t.strategy == nil {
 		// Fall back to basic compaction if no strategy is set
-		return t.Compact()
+		return t.compact()
 	}
 
+	t.waitForCompaction()
+	if err := t.dropCoveredTables(); err != nil {
+		return err
+	}
+	if dropper, ok := (*t.strategy).(compaction.Dropper); ok {
+		if err := t.dropTables(dropper.DropTables(t.Tables)); err != nil {
+			return err
+		}
+	}
 	if !(*t.strategy).ShouldCompact(t.Tables) {
 		return nil
 	}
@@ -228,50 +667,62 @@ func (t *LSMTree) CompactWithStrategy() error {
 		return nil // Nothing to compact
 	}
 
-	// Merge selected tables
-	merged := make(map[string]string)
-
-	// Process tables in order (newer tables override older ones)
-	for _, tbl := range selectedTables {
-		f, err := os.Open(tbl.Path)
-		if err != nil {
-			return err
-		}
-
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			parts := strings.SplitN(scanner.Text(), "\t", 2)
-			if len(parts) == 2 {
-				merged[parts[0]] = parts[1]
-			}
-		}
-		f.Close()
+	// Merge selected tables in age order (newer tables override older ones)
+	selectedTables = t.withInterleaved(selectedTables)
+	sortTables(selectedTables)
+	level := compaction.OutputLevel(*t.strategy, selectedTables)
+	return t.runCompaction((*t.strategy).Name(), selectedTables, level, t.isBottommost(selectedTables))
+}
 
-		if err := scanner.Err(); err != nil {
-			return err
-		}
+// runCompaction merges selected into new tables at level, replaces them in
+// the tree with a single manifest update and reports the compaction to the
+// listener.
+func (t *LSMTree) runCompaction(strategy string, selected []*sstable.SSTable, level int, bottommost bool) error {
+	ev := CompactionEvent{
+		Strategy:    strategy,
+		Inputs:      tablePaths(selected),
+		OutputLevel: level,
+		BytesRead:   totalSize(selected),
 	}
-
-	// Convert to sorted KV pairs
-	kvs := make([]memtable.KV, 0, len(merged))
-	for k, v := range merged {
-		kvs = append(kvs, memtable.KV{Key: k, Value: v})
+	if t.listener != nil {
+		t.listener.OnCompactionBegin(ev)
 	}
-	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	start := time.Now()
+	outputs, err := t.replaceTables(selected, level, bottommost)
+	t.observe(opCompaction, start)
+	if t.listener != nil {
+		ev.Outputs = tablePaths(outputs)
+		ev.BytesWritten = totalSize(outputs)
+		ev.Duration, ev.Err = time.Since(start), err
+		t.listener.OnCompactionEnd(ev)
+	}
+	return err
+}
 
-	// Create new SSTable
-	newPath := filepath.Join(t.Dir, fmt.Sprintf("ss-%d.sst", t.nextID))
-	newTable, err := sstable.New(newPath, kvs)
+// replaceTables compacts selected and swaps the outputs in for them. The
+// lock is released while the inputs are merged and the outputs written.
+func (t *LSMTree) replaceTables(selected []*sstable.SSTable, level int, bottommost bool) ([]*sstable.SSTable, error) {
+	t.selectBlobGarbage()
+	// The references keep the inputs' files if the family is dropped
+	// meanwhile. Until the outputs are installed, collectBlobs leaves the
+	// blob files they reference alone.
+	t.compacting = true
+	t.ref(selected)
+	defer func() {
+		t.compacting = false
+		t.unref(selected)
+		t.families.compactionDone.Broadcast()
+	}()
+	outputs, err := t.compactTables(selected, level, bottommost)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Remove old tables from list and disk
+	// Remove old tables from list
 	var remainingTables []*sstable.SSTable
 	selectedPaths := make(map[string]bool)
-	for _, tbl := range selectedTables {
+	for _, tbl := range selected {
 		selectedPaths[tbl.Path] = true
-		os.Remove(tbl.Path)
 	}
 
 	for _, tbl := range t.Tables {
@@ -280,23 +731,59 @@ func (t *LSMTree) CompactWithStrategy() error {
 		}
 	}
 
-	// Add new table and update state
-	t.Tables = append(remainingTables, newTable)
-	t.nextID++
+	// Add new tables in age order and update state
+	t.Tables = append(remainingTables, outputs...)
+	sortTables(t.Tables)
+	t.tablesChanged()
+	if err := t.saveManifest(); err != nil {
+		return nil, err
+	}
+	t.tablesCreated(outputs, ReasonCompaction)
 
-	return nil
+	// Old tables are only deleted once the manifest no longer lists them
+	t.retire(selected, ReasonCompaction)
+	return outputs, nil
 }
 
-// Stats returns performance statistics (nil if statistics are not enabled).
+// Stats returns a snapshot of the performance statistics (nil if
+// statistics are not enabled). See Properties for per-level figures and
+// latencies.
 func (t *LSMTree) Stats() *LSMStats {
-	return t.stats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.copyStats()
+}
+
+// copyStats returns a copy of the statistics, or nil. Compactions running
+// without the tree lock update the blob counters under the blob lock.
+func (t *LSMTree) copyStats() *LSMStats {
+	if t.stats == nil {
+		return nil
+	}
+	t.blobs.mu.Lock()
+	defer t.blobs.mu.Unlock()
+	stats := *t.stats
+	return &stats
 }
 
 // SetStrategy changes the compaction strategy.
 func (t *LSMTree) SetStrategy(strategy compaction.Strategy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	t.strategy = &strategy
 }
 
+// SetFilterPolicy chooses the filter built for tables written from now on,
+// such as bloom.XorPolicy{} for smaller filters on immutable tables. Existing
+// tables keep the filter they were written with. Pass nil for the default
+// Bloom filter.
+func (t *LSMTree) SetFilterPolicy(policy bloom.Policy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+	t.policy = policy
+}
+
 // String returns a formatted string representation of stats.
 func (s LSMStats) String() string {
 	hitRate := float64(0)
@@ -316,11 +803,19 @@ func (s LSMStats) String() string {
   SSTable Hits: %d
   Hit Rate: %.2f%%
   Bloom Filter Saves: %d (%.2f%% efficiency)
+  Key Range Saves: %d
+  Prefix Scans: %d (%d tables skipped)
   Total Flushes: %d
-  Compactions: %d`,
+  Compactions: %d (%d subcompactions)
+  Tables Dropped: %d
+  Write Stalls: %d slowdowns (%v), %d stops (%v)
+  Blob Files: %d bytes written, %d relocated, %d files deleted`,
 		s.TotalWrites, s.TotalReads, s.MemtableHits, s.SSTableHits,
-		hitRate, s.BloomFilterSaves, bloomEfficiency,
-		s.TotalFlushes, s.CompactionCount)
+		hitRate, s.BloomFilterSaves, bloomEfficiency, s.KeyRangeSaves,
+		s.PrefixScans, s.PrefixFilterSaves,
+		s.TotalFlushes, s.CompactionCount, s.Subcompactions, s.TablesDropped,
+		s.StallSlowdowns, s.StallSlowdownTime, s.StallStops, s.StallStopTime,
+		s.BlobBytesWritten, s.BlobBytesRelocated, s.BlobFilesDeleted)
 }
 
 // CompactionInfo provides details about the current state.
@@ -334,6 +829,9 @@ type CompactionInfo struct {
 
 // GetCompactionInfo returns information about compaction readiness.
 func (t *LSMTree) GetCompactionInfo() *CompactionInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	if t.strategy == nil {
 		return &CompactionInfo{
 			Strategy:      "Basic",
@@ -1,10 +1,22 @@
 package lsmtree
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"lsm/bloom"
 	"lsm/compaction"
+	"lsm/memtable"
+	"lsm/merge"
+	"lsm/ratelimit"
+	"lsm/sstable"
 )
 
 func TestBasicLSMOperations(t *testing.T) {
@@ -245,3 +257,2121 @@ func TestLSMOverwrite(t *testing.T) {
 		t.Fatalf("Expected value2 after compaction, got %s", value)
 	}
 }
+
+func TestTimeWindowCompaction(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_time_window_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+	if err := os.MkdirAll(testDir, 0o755); err != nil {
+		t.Fatalf("Failed to create test dir: %v", err)
+	}
+
+	now := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	at := func(d time.Duration) int64 { return now.Add(d).UnixNano() }
+
+	// Two tables in the closed 08:00 window and one in the current window
+	tables := [][]memtable.KV{
+		{{Key: "a", Value: "old", Timestamp: at(-150 * time.Minute)}, {Key: "k", Value: "v1", Timestamp: at(-140 * time.Minute)}},
+		{{Key: "b", Value: "old", Timestamp: at(-130 * time.Minute)}, {Key: "k", Value: "v2", Timestamp: at(-125 * time.Minute)}},
+		{{Key: "c", Value: "new", Timestamp: at(-10 * time.Minute)}},
+	}
+	for i, kvs := range tables {
+		if _, err := sstable.New(filepath.Join(testDir, fmt.Sprintf("ss-%d.sst", i)), kvs); err != nil {
+			t.Fatalf("Failed to write table %d: %v", i, err)
+		}
+	}
+
+	strategy := compaction.NewTimeBasedStrategy()
+	strategy.Now = func() time.Time { return now }
+	tree, err := NewWithStrategy(testDir, 10, strategy)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+
+	if !strategy.ShouldCompact(tree.Tables) {
+		t.Fatalf("Closed window with two tables should be compacted")
+	}
+	if err := tree.CompactWithStrategy(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(tree.Tables) != 2 {
+		t.Fatalf("Expected 2 tables after compaction, got %d", len(tree.Tables))
+	}
+	if strategy.ShouldCompact(tree.Tables) {
+		t.Fatalf("Closed window should not be compacted twice")
+	}
+
+	merged := tree.Tables[0].Meta
+	if !merged.MinTimestamp.Equal(time.Unix(0, at(-150*time.Minute))) ||
+		!merged.MaxTimestamp.Equal(time.Unix(0, at(-125*time.Minute))) {
+		t.Fatalf("Unexpected merged time range %v - %v", merged.MinTimestamp, merged.MaxTimestamp)
+	}
+
+	expected := map[string]string{"a": "old", "b": "old", "c": "new", "k": "v2"}
+	for key, want := range expected {
+		value, found, err := tree.Get(key)
+		if err != nil || !found || value != want {
+			t.Fatalf("Expected %s for key %s, got %q (found=%t, err=%v)", want, key, value, found, err)
+		}
+	}
+}
+
+func TestMergeOperator(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_merge_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	if err := tree.Merge("hits", "1"); err != ErrNoMergeOperator {
+		t.Fatalf("Expected ErrNoMergeOperator, got %v", err)
+	}
+	tree.SetMergeOperator(merge.Counter{})
+
+	// Operands spread across the memtable and several flushed tables
+	if err := tree.Put("hits", "10"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tree.Merge("hits", "2"); err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+		if err := tree.Merge(fmt.Sprintf("new%d", i), "1"); err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+	}
+
+	check := func(stage string) {
+		value, found, err := tree.Get("hits")
+		if err != nil || !found || value != "20" {
+			t.Fatalf("%s: expected hits=20, got %q (found=%t, err=%v)", stage, value, found, err)
+		}
+		value, found, err = tree.Get("new3")
+		if err != nil || !found || value != "1" {
+			t.Fatalf("%s: expected new3=1, got %q (found=%t, err=%v)", stage, value, found, err)
+		}
+	}
+	check("before compaction")
+
+	it, err := tree.NewIterator("hits", "new2")
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key()+"="+it.Value())
+	}
+	it.Close()
+	if fmt.Sprint(keys) != "[hits=20 new0=1 new1=1]" {
+		t.Fatalf("Unexpected iterator output: %v", keys)
+	}
+
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("after compaction")
+
+	// Merge records must survive a restart
+	if err := tree.Merge("hits", "5"); err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	if err := tree.Merge("flush", "0"); err != nil {
+		t.Fatalf("Failed to merge: %v", err)
+	}
+	reopened, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if _, _, err := reopened.Get("hits"); err != ErrNoMergeOperator {
+		t.Fatalf("Expected ErrNoMergeOperator without operator, got %v", err)
+	}
+	reopened.SetMergeOperator(merge.Counter{})
+	if value, _, err := reopened.Get("hits"); err != nil || value != "25" {
+		t.Fatalf("Expected hits=25 after restart, got %q (err=%v)", value, err)
+	}
+}
+
+// newestTables is a test strategy that always compacts the two newest tables.
+type newestTables struct{}
+
+func (newestTables) Name() string { return "Newest" }
+
+func (newestTables) ShouldCompact(tables []*sstable.SSTable) bool { return len(tables) >= 3 }
+
+func (newestTables) SelectTables(tables []*sstable.SSTable) []*sstable.SSTable {
+	return append([]*sstable.SSTable(nil), tables[len(tables)-2:]...)
+}
+
+func TestMergeOperandsAcrossSkippedTable(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_merge_interleaved_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+	tree.SetMergeOperator(merge.Counter{})
+
+	// One operand in each of three tables; the middle table is large, so
+	// size-tiered selects the other two
+	big := strings.Repeat("v", 1000)
+	for i, operand := range []string{"1", "10", "100"} {
+		if err := tree.Merge("m", operand); err != nil {
+			t.Fatalf("Failed to merge: %v", err)
+		}
+		for j := 0; j < 3; j++ {
+			value := "a"
+			if i == 1 {
+				value = big
+			}
+			if err := tree.Put(fmt.Sprintf("x%d%d", i, j), value); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	if len(tree.Tables) != 3 {
+		t.Fatalf("Expected 3 tables, got %d", len(tree.Tables))
+	}
+
+	check := func(stage string) {
+		value, found, err := tree.Get("m")
+		if err != nil || !found || value != "111" {
+			t.Fatalf("%s: expected m=111, got %q (found=%t, err=%v)", stage, value, found, err)
+		}
+	}
+	check("before compaction")
+
+	tree.SetStrategy(&compaction.SizeTieredStrategy{MinTables: 2, SizeRatio: 2, MaxTableSize: 1 << 20})
+	if err := tree.CompactWithStrategy(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("after compaction")
+}
+
+// tenantFilter drops one tenant's keys and migrates old schema values.
+type tenantFilter struct {
+	calls []bool // bottommost flag of each call
+}
+
+func (f *tenantFilter) Name() string { return "Tenant" }
+
+func (f *tenantFilter) Filter(level int, bottommost bool, key, value string) (FilterDecision, string) {
+	f.calls = append(f.calls, bottommost)
+	switch {
+	case strings.HasPrefix(key, "t1:"):
+		return FilterRemove, ""
+	case value == "schema-v1":
+		return FilterChange, "schema-v2"
+	}
+	return FilterKeep, ""
+}
+
+func TestCompactionFilter(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_filter_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	puts := [][2]string{
+		{"t1:a", "old"}, {"t2:a", "keep"}, // oldest table, outside the first compaction
+		{"t1:a", "new"}, {"t2:b", "schema-v1"},
+		{"t1:b", "x"}, {"t2:c", "keep"},
+	}
+	for _, p := range puts {
+		if err := tree.Put(p[0], p[1]); err != nil {
+			t.Fatalf("Failed to put %s: %v", p[0], err)
+		}
+	}
+
+	filter := &tenantFilter{}
+	tree.SetCompactionFilter(filter)
+	tree.SetStrategy(newestTables{})
+	if err := tree.CompactWithStrategy(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(filter.calls) == 0 || filter.calls[0] {
+		t.Fatalf("Expected non-bottommost filter calls, got %v", filter.calls)
+	}
+
+	check := func(stage string) {
+		for key, want := range map[string]string{"t2:a": "keep", "t2:b": "schema-v2", "t2:c": "keep"} {
+			if value, found, err := tree.Get(key); err != nil || !found || value != want {
+				t.Fatalf("%s: expected %s=%s, got %q (found=%t, err=%v)", stage, key, want, value, found, err)
+			}
+		}
+		// The removed newer version must not expose the older one
+		for _, key := range []string{"t1:a", "t1:b"} {
+			if value, found, err := tree.Get(key); err != nil || found {
+				t.Fatalf("%s: expected %s to be removed, got %q (err=%v)", stage, key, value, err)
+			}
+		}
+	}
+	check("partial compaction")
+
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if !filter.calls[len(filter.calls)-1] {
+		t.Fatalf("Expected bottommost filter call for full compaction")
+	}
+	check("full compaction")
+	if entries, _ := tree.Tables[0].Entries(); len(entries) != 3 {
+		t.Fatalf("Expected tombstones to be dropped at the bottom, got %v", entries)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	// Clean up test directories
+	testDir := "test_checkpoint_lsm"
+	checkpointDir := "test_checkpoint_lsm_copy"
+	os.RemoveAll(testDir)
+	os.RemoveAll(checkpointDir)
+	defer os.RemoveAll(testDir)
+	defer os.RemoveAll(checkpointDir)
+
+	tree, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	// Two flushed tables plus one write still in the memtable and log
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := tree.Put(key, "v-"+key); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	if err := tree.Checkpoint(checkpointDir); err != nil {
+		t.Fatalf("Failed to checkpoint: %v", err)
+	}
+	if err := tree.Checkpoint(checkpointDir); err == nil {
+		t.Fatalf("Checkpoint into an existing directory should fail")
+	}
+
+	// Later changes to the live tree must not leak into the checkpoint
+	if err := tree.Put("a", "changed"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	copyTree, err := New(checkpointDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to open checkpoint: %v", err)
+	}
+	defer copyTree.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		value, found, err := copyTree.Get(key)
+		if err != nil || !found || value != "v-"+key {
+			t.Fatalf("Expected v-%s in checkpoint, got %q (found=%t, err=%v)", key, value, found, err)
+		}
+	}
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	// Clean up test directories
+	testDir := "test_ingest_lsm"
+	externalDir := "test_ingest_external"
+	os.RemoveAll(testDir)
+	os.RemoveAll(externalDir)
+	defer os.RemoveAll(testDir)
+	defer os.RemoveAll(externalDir)
+	if err := os.MkdirAll(externalDir, 0o755); err != nil {
+		t.Fatalf("Failed to create external dir: %v", err)
+	}
+
+	build := func(name string, keys ...string) string {
+		path := filepath.Join(externalDir, name)
+		w, err := sstable.NewWriter(path, sstable.Options{})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, key := range keys {
+			if err := w.Add(key, "bulk-"+key); err != nil {
+				w.Abort()
+				return ""
+			}
+		}
+		if _, err := w.Finish(); err != nil {
+			t.Fatalf("Failed to finish table: %v", err)
+		}
+		return path
+	}
+
+	if build("unsorted.sst", "b", "a") != "" {
+		t.Fatalf("Writer should reject keys out of order")
+	}
+	first := build("first.sst", "a", "b", "c")
+	second := build("second.sst", "m", "n")
+	overlapping := build("overlap.sst", "c", "d")
+
+	tree, err := New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	// Older data for an ingested key, still in the memtable
+	if err := tree.Put("b", "old"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	if err := tree.Put("z", "kept"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+
+	if err := tree.IngestExternalFiles([]string{first, overlapping}); err == nil {
+		t.Fatalf("Ingesting overlapping files should fail")
+	}
+	if err := tree.IngestExternalFiles([]string{second, first}); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	if len(tree.Tables) != 3 {
+		t.Fatalf("Expected flushed memtable plus 2 ingested tables, got %d tables", len(tree.Tables))
+	}
+
+	check := func(tree *LSMTree, stage string) {
+		for key, want := range map[string]string{"a": "bulk-a", "b": "bulk-b", "n": "bulk-n", "z": "kept"} {
+			value, found, err := tree.Get(key)
+			if err != nil || !found || value != want {
+				t.Fatalf("%s: expected %s=%s, got %q (found=%t, err=%v)", stage, key, want, value, found, err)
+			}
+		}
+	}
+	check(tree, "after ingest")
+
+	// The tree owns its copy: rewriting a source file does not change it
+	w, err := sstable.NewWriter(first, sstable.Options{})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	w.Abort()
+	check(tree, "after rewriting a source file")
+
+	// Writes after the ingest are newer than the ingested data
+	if err := tree.Put("a", "newer"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	reopened, err := New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if value, _, _ := reopened.Get("a"); value != "newer" {
+		t.Fatalf("Expected a=newer after restart, got %q", value)
+	}
+	if err := reopened.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if value, _, _ := reopened.Get("b"); value != "bulk-b" {
+		t.Fatalf("Expected b=bulk-b after compaction, got %q", value)
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_delete_range_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	put := func(tree *LSMTree, key, value string) {
+		if err := tree.Put(key, value); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+
+	// Two flushed tables: [a b] and [c d]
+	put(tree, "a", "1")
+	put(tree, "b", "2")
+	put(tree, "c", "3")
+	put(tree, "d", "4")
+	if err := tree.DeleteRange("c", "c"); err == nil {
+		t.Fatalf("Empty range should be rejected")
+	}
+	if err := tree.DeleteRange("a", "c"); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	if _, found, _ := tree.Get("a"); found {
+		t.Fatalf("Key a should be hidden by the memtable tombstone")
+	}
+
+	// Flushes the tombstone with e; b is then rewritten
+	put(tree, "e", "5")
+	put(tree, "b", "new")
+	put(tree, "x", "6")
+
+	check := func(tree *LSMTree, stage string) {
+		expected := map[string]string{"b": "new", "c": "3", "d": "4", "e": "5", "x": "6"}
+		for key, want := range expected {
+			value, found, err := tree.Get(key)
+			if err != nil || !found || value != want {
+				t.Fatalf("%s: expected %s=%s, got %q (found=%v, err=%v)", stage, key, want, value, found, err)
+			}
+		}
+		if _, found, _ := tree.Get("a"); found {
+			t.Fatalf("%s: key a should stay deleted", stage)
+		}
+
+		it, err := tree.NewIterator("", "")
+		if err != nil {
+			t.Fatalf("%s: failed to create iterator: %v", stage, err)
+		}
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if got := strings.Join(keys, ","); got != "b,c,d,e,x" {
+			t.Fatalf("%s: expected iterator keys b,c,d,e,x, got %s", stage, got)
+		}
+	}
+	check(tree, "before reopen")
+
+	// Pending tombstone in the WAL survives a restart
+	if err := tree.DeleteRange("w", "y"); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	reopened, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if _, found, _ := reopened.Get("x"); found {
+		t.Fatalf("Key x should be deleted after replaying the WAL")
+	}
+	put(reopened, "x", "6")
+
+	// The oldest table lies wholly inside [a, c) and is dropped unread
+	oldest := reopened.Tables[0].Path
+	tables := len(reopened.Tables)
+	if err := reopened.dropCoveredTables(); err != nil {
+		t.Fatalf("Failed to drop covered tables: %v", err)
+	}
+	if len(reopened.Tables) != tables-1 {
+		t.Fatalf("Expected %d tables after dropping covered ones, got %d", tables-1, len(reopened.Tables))
+	}
+	if _, err := os.Stat(oldest); !os.IsNotExist(err) {
+		t.Fatalf("Covered table file %s should be removed", oldest)
+	}
+	check(reopened, "after dropping tables")
+
+	if err := reopened.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check(reopened, "after compaction")
+	if n := len(reopened.Tables[0].RangeDels); n != 0 {
+		t.Fatalf("Full compaction should drop range tombstones, %d left", n)
+	}
+}
+
+func TestPrefixIterator(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_prefix_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	// Never compacts, so every flush stays a separate table
+	strategy := &compaction.SizeTieredStrategy{MinTables: 100, SizeRatio: 2, MaxTableSize: 1 << 30}
+	tree, err := NewWithStrategy(testDir, 3, strategy)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	put := func(keys ...string) {
+		for _, key := range keys {
+			if err := tree.Put(key, "v-"+key); err != nil {
+				t.Fatalf("Failed to put %s: %v", key, err)
+			}
+		}
+	}
+	scan := func(prefix string) string {
+		it, err := tree.NewPrefixIterator(prefix)
+		if err != nil {
+			t.Fatalf("Failed to create prefix iterator: %v", err)
+		}
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		return strings.Join(keys, ",")
+	}
+
+	// Written before the extractor is set; its filter is rebuilt
+	put("user:1:a", "user:1:b", "user:1:c")
+	if err := tree.SetPrefixExtractor(sstable.DelimitedPrefix{Sep: ":", Fields: 2}); err != nil {
+		t.Fatalf("Failed to set prefix extractor: %v", err)
+	}
+	put("user:2:a", "user:2:b", "user:2:c")
+	put("user:3:a", "user:3:b", "user:1:d")
+	// Flushed with keys of another user only
+	if err := tree.DeleteRange("user:2:b", "user:2:c"); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	put("user:4:a", "user:4:b")
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables, got %d", len(tree.Tables))
+	}
+
+	if got := scan("user:1:"); got != "user:1:a,user:1:b,user:1:c,user:1:d" {
+		t.Fatalf("Unexpected keys for user 1: %s", got)
+	}
+	before := tree.Stats().PrefixFilterSaves
+	if got := scan("user:2:"); got != "user:2:a,user:2:c" {
+		t.Fatalf("Unexpected keys for user 2: %s", got)
+	}
+	// The first table is skipped by its key range, the last two by their
+	// prefix filters
+	if saved := tree.Stats().PrefixFilterSaves - before; saved != 2 {
+		t.Fatalf("Expected 2 tables skipped for user 2, got %d", saved)
+	}
+
+	// A prefix shorter than the extracted ones cannot use the filters
+	before = tree.Stats().PrefixFilterSaves
+	if got := scan("user:"); strings.Count(got, ",") != 9 {
+		t.Fatalf("Expected 10 keys under user:, got %s", got)
+	}
+	if saved := tree.Stats().PrefixFilterSaves - before; saved != 0 {
+		t.Fatalf("Expected no tables skipped for a short prefix, got %d", saved)
+	}
+	if got := scan("user:9:"); got != "" {
+		t.Fatalf("Expected no keys for user 9, got %s", got)
+	}
+}
+
+func TestFilterPolicy(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_filter_policy_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	put := func(key string) {
+		if err := tree.Put(key, "v-"+key); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+	}
+	put("a")
+	put("b")
+	tree.SetFilterPolicy(bloom.XorPolicy{})
+	put("c")
+	put("d")
+	tree.SetFilterPolicy(bloom.CuckooPolicy{})
+	put("e")
+	put("f")
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	// Each table keeps the filter it was written with
+	reopened, err := New(testDir, 2)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	expected := []string{"", "xor8", "cuckoo"}
+	if len(reopened.Tables) != len(expected) {
+		t.Fatalf("Expected %d tables, got %d", len(expected), len(reopened.Tables))
+	}
+	for i, tbl := range reopened.Tables {
+		if tbl.Meta.Filter != expected[i] {
+			t.Fatalf("Table %d: expected filter %q, got %q", i, expected[i], tbl.Meta.Filter)
+		}
+	}
+	if _, ok := reopened.Tables[1].Filter.(*bloom.Xor8); !ok {
+		t.Fatalf("Expected an xor filter after reload, got %T", reopened.Tables[1].Filter)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e", "f"} {
+		value, found, err := reopened.Get(key)
+		if err != nil || !found || value != "v-"+key {
+			t.Fatalf("Expected %s=v-%s, got %q (found=%v, err=%v)", key, key, value, found, err)
+		}
+	}
+}
+
+func TestStrategyCompactionKeepsTablesInOrder(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_interleaved_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+
+	// Two small tables around a large one that deletes k and overwrites n.
+	// Size-tiered picks the small ones, skipping the large one in between.
+	big := strings.Repeat("v", 1000)
+	for _, p := range [][2]string{
+		{"k", "old"}, {"n", "old"}, {"x0", "a"}, {"x1", "a"},
+		{"n", "new"}, {"y0", big}, {"y1", big},
+		{"x2", "a"}, {"x3", "a"}, {"x4", "a"}, {"x5", "a"},
+	} {
+		if p[0] == "n" && p[1] == "new" {
+			if err := tree.DeleteRange("a", "l"); err != nil {
+				t.Fatalf("Failed to delete range: %v", err)
+			}
+		}
+		if err := tree.Put(p[0], p[1]); err != nil {
+			t.Fatalf("Failed to put %s: %v", p[0], err)
+		}
+	}
+	if len(tree.Tables) != 3 {
+		t.Fatalf("Expected 3 tables, got %d", len(tree.Tables))
+	}
+	strategy := &compaction.SizeTieredStrategy{MinTables: 2, SizeRatio: 2, MaxTableSize: 1 << 20}
+	if selected := strategy.SelectTables(tree.Tables); len(selected) != 2 {
+		t.Fatalf("Expected the strategy to select the 2 small tables, got %d", len(selected))
+	}
+
+	check := func(stage string) {
+		if value, found, err := tree.Get("k"); err != nil || found {
+			t.Fatalf("%s: expected k to be deleted, got %q (err=%v)", stage, value, err)
+		}
+		if value, found, err := tree.Get("n"); err != nil || !found || value != "new" {
+			t.Fatalf("%s: expected n=new, got %q (found=%t, err=%v)", stage, value, found, err)
+		}
+	}
+	check("before compaction")
+
+	tree.SetStrategy(strategy)
+	if err := tree.CompactWithStrategy(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(tree.Tables) != 1 {
+		t.Fatalf("Expected the table in between to be merged too, got %d tables", len(tree.Tables))
+	}
+	check("after compaction")
+}
+
+func TestFIFOStrategy(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_fifo_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 2, &compaction.FIFOStrategy{MaxTotalSize: 1024})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	for i := 0; i < 40; i++ {
+		if err := tree.Put(fmt.Sprintf("log-%03d", i), strings.Repeat("x", 50)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	var total int64
+	for _, tbl := range tree.Tables {
+		total += tbl.Size
+	}
+	if total > 1024 {
+		t.Fatalf("Expected at most 1024 bytes of tables, got %d", total)
+	}
+	stats := tree.Stats()
+	if stats.TablesDropped == 0 || stats.CompactionCount != 0 {
+		t.Fatalf("Expected tables dropped without compactions, got %d dropped, %d compactions", stats.TablesDropped, stats.CompactionCount)
+	}
+	files, _ := filepath.Glob(filepath.Join(testDir, "*.sst"))
+	if len(files) != len(tree.Tables) {
+		t.Fatalf("Expected %d table files, found %d", len(tree.Tables), len(files))
+	}
+
+	// The oldest entries expire, the newest remain
+	if _, found, _ := tree.Get("log-000"); found {
+		t.Fatalf("Oldest entry should have been dropped")
+	}
+	if _, found, _ := tree.Get("log-039"); !found {
+		t.Fatalf("Newest entry should still be present")
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_stall_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	// A strategy that never compacts leaves it all to the stall
+	tree, err := NewWithStrategy(testDir, 2, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetRateLimiter(ratelimit.New(64<<20, 0))
+	tree.SetWriteStall(&WriteStallOptions{
+		L0SlowdownTables: 3,
+		L0StopTables:     5,
+		DelayedWriteRate: 1 << 20,
+	})
+
+	for i := 0; i < 40; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+		l0 := 0
+		for _, tbl := range tree.Tables {
+			if tbl.Meta.Level == 0 {
+				l0++
+			}
+		}
+		if l0 > 5 {
+			t.Fatalf("Expected at most 5 level 0 tables, got %d", l0)
+		}
+	}
+
+	stats := tree.Stats()
+	if stats.StallSlowdowns == 0 || stats.StallStops == 0 {
+		t.Fatalf("Expected slowdowns and stops, got %d and %d", stats.StallSlowdowns, stats.StallStops)
+	}
+	for i := 0; i < 40; i++ {
+		value, found, err := tree.Get(fmt.Sprintf("key-%03d", i))
+		if err != nil || !found || value != fmt.Sprintf("value-%d", i) {
+			t.Fatalf("Expected key-%03d=value-%d, got %q (found=%v, err=%v)", i, i, value, found, err)
+		}
+	}
+
+	// Without limits writes go straight through
+	tree.SetWriteStall(nil)
+	before := stats.StallSlowdowns + stats.StallStops
+	if err := tree.Put("after", "v"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	stats = tree.Stats()
+	if stats.StallSlowdowns+stats.StallStops != before {
+		t.Fatalf("Expected no stalls once disabled")
+	}
+}
+
+func TestWriteStallKeepsTablesApart(t *testing.T) {
+	for _, strategy := range []compaction.Strategy{
+		&compaction.FIFOStrategy{MaxTotalSize: 1 << 20},
+		&compaction.TimeBasedStrategy{WindowSize: time.Hour, MinTables: 1000, SizeRatio: 2},
+	} {
+		// Clean up test directory
+		testDir := "test_stall_keep_lsm"
+		os.RemoveAll(testDir)
+		defer os.RemoveAll(testDir)
+
+		tree, err := NewWithStrategy(testDir, 10, strategy)
+		if err != nil {
+			t.Fatalf("Failed to create LSM tree: %v", err)
+		}
+		tree.SetWriteStall(&WriteStallOptions{L0StopTables: 4})
+		for i := 0; i < 45; i++ {
+			if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+				t.Fatalf("%s: failed to put: %v", strategy.Name(), err)
+			}
+		}
+
+		// Every flush is still a table of its own
+		if len(tree.Tables) != 4 {
+			t.Fatalf("%s: expected 4 tables, got %d", strategy.Name(), len(tree.Tables))
+		}
+		for _, tbl := range tree.Tables {
+			if n := tbl.Meta.MaxSeq - tbl.Meta.MinSeq + 1; n != 10 {
+				t.Fatalf("%s: expected tables of 10 writes, got %s with %d", strategy.Name(), tbl.Path, n)
+			}
+		}
+		if err := tree.Close(); err != nil {
+			t.Fatalf("%s: failed to close: %v", strategy.Name(), err)
+		}
+		os.RemoveAll(testDir)
+	}
+}
+
+// compactionStarted closes started when a compaction begins.
+type compactionStarted struct {
+	NoopEventListener
+	started chan struct{}
+}
+
+func (l compactionStarted) OnCompactionBegin(ev CompactionEvent) { close(l.started) }
+
+func TestRateLimitedCompactionDoesNotBlockReads(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_rate_limited_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+	value := strings.Repeat("v", 200)
+	for i := 0; i < 40; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), value); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	// Writing the merged table takes about a second at this rate
+	tree.SetRateLimiter(ratelimit.New(8<<10, 1))
+	listener := compactionStarted{started: make(chan struct{})}
+	tree.SetEventListener(listener)
+	done := make(chan error, 1)
+	go func() { done <- tree.Compact() }()
+	<-listener.started
+
+	start := time.Now()
+	if _, found, err := tree.Get("key-005"); err != nil || !found {
+		t.Fatalf("Expected key-005 during compaction, got found=%v, err=%v", found, err)
+	}
+	if err := tree.Put("during", "compaction"); err != nil {
+		t.Fatalf("Failed to put: %v", err)
+	}
+	elapsed := time.Since(start)
+	select {
+	case err := <-done:
+		t.Fatalf("Compaction finished before the read was timed (err=%v)", err)
+	default:
+	}
+	if elapsed > 200*time.Millisecond {
+		t.Fatalf("Read and write waited %v for the rate-limited compaction", elapsed)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(tree.Tables) != 1 {
+		t.Fatalf("Expected 1 table after compaction, got %d", len(tree.Tables))
+	}
+	for _, key := range []string{"key-000", "key-039", "during"} {
+		if _, found, err := tree.Get(key); err != nil || !found {
+			t.Fatalf("Expected %s after compaction, got found=%v, err=%v", key, found, err)
+		}
+	}
+}
+
+func TestSubcompactions(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_subcompaction_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 50, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetSubcompactions(4)
+
+	// Four flushes of consecutive keys give four table boundaries; the
+	// updates and the range deletion fill a fifth table spanning them all
+	for i := 0; i < 200; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := tree.DeleteRange("key-040", "key-060"); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	for i := 0; i < 200; i += 4 {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), "updated"); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if len(tree.Tables) != 5 {
+		t.Fatalf("Expected 5 tables before compaction, got %d", len(tree.Tables))
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables from 4 subcompactions, got %d", len(tree.Tables))
+	}
+	var ranges [][2]string
+	for _, tbl := range tree.Tables {
+		min, max, ok, err := sortedRange(tbl)
+		if err != nil || !ok {
+			t.Fatalf("Failed to read table %s: %v", tbl.Path, err)
+		}
+		ranges = append(ranges, [2]string{min, max})
+	}
+	for i := range ranges {
+		for j := i + 1; j < len(ranges); j++ {
+			if ranges[i][0] <= ranges[j][1] && ranges[j][0] <= ranges[i][1] {
+				t.Fatalf("Tables overlap: %v and %v", ranges[i], ranges[j])
+			}
+		}
+	}
+
+	check := func(tree *LSMTree) {
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			value, found, err := tree.Get(key)
+			if err != nil {
+				t.Fatalf("Failed to get %s: %v", key, err)
+			}
+			switch {
+			case i%4 == 0:
+				if !found || value != "updated" {
+					t.Fatalf("Expected %s=updated, got %q (found=%v)", key, value, found)
+				}
+			case i >= 40 && i < 60:
+				if found {
+					t.Fatalf("Expected %s to be deleted, got %q", key, value)
+				}
+			default:
+				if !found || value != fmt.Sprintf("value-%d", i) {
+					t.Fatalf("Expected %s=value-%d, got %q (found=%v)", key, i, value, found)
+				}
+			}
+		}
+	}
+	check(tree)
+
+	// All outputs were committed in the same manifest
+	tree.Close()
+	reopened, err := New(testDir, 50)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+	if len(reopened.Tables) != 4 {
+		t.Fatalf("Expected 4 tables after reopen, got %d", len(reopened.Tables))
+	}
+	check(reopened)
+}
+
+// countingFilter counts the values it sees per key and upper-cases them.
+// Subcompactions call it from several goroutines, so it guards its state.
+type countingFilter struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (f *countingFilter) Name() string { return "Counting" }
+
+func (f *countingFilter) Filter(level int, bottommost bool, key, value string) (FilterDecision, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[key]++
+	return FilterChange, strings.ToUpper(value)
+}
+
+func TestSubcompactionsWithStatefulFilter(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_subcompaction_filter_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 50, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer tree.Close()
+	tree.SetSubcompactions(4)
+	filter := &countingFilter{calls: make(map[string]int)}
+	tree.SetCompactionFilter(filter)
+
+	for i := 0; i < 200; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables from 4 subcompactions, got %d", len(tree.Tables))
+	}
+
+	if len(filter.calls) != 200 {
+		t.Fatalf("Expected the filter to see 200 keys, got %d", len(filter.calls))
+	}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		if n := filter.calls[key]; n != 1 {
+			t.Fatalf("Expected the filter to see %s once, got %d", key, n)
+		}
+		value, found, err := tree.Get(key)
+		if err != nil || !found || value != fmt.Sprintf("VALUE-%d", i) {
+			t.Fatalf("Expected %s=VALUE-%d, got %q (found=%v, err=%v)", key, i, value, found, err)
+		}
+	}
+}
+
+// recordingListener keeps the events it receives.
+type recordingListener struct {
+	NoopEventListener
+	flushes, compactions []string
+	created, deleted     map[string]string
+	compacted            []CompactionEvent
+	stalls               []WriteStallEvent
+	errors               []BackgroundErrorEvent
+}
+
+func (l *recordingListener) OnFlushBegin(ev FlushEvent) { l.flushes = append(l.flushes, "begin") }
+func (l *recordingListener) OnFlushEnd(ev FlushEvent)   { l.flushes = append(l.flushes, "end") }
+func (l *recordingListener) OnCompactionBegin(ev CompactionEvent) {
+	l.compactions = append(l.compactions, "begin")
+}
+func (l *recordingListener) OnCompactionEnd(ev CompactionEvent) {
+	l.compactions = append(l.compactions, "end")
+	l.compacted = append(l.compacted, ev)
+}
+func (l *recordingListener) OnTableFileCreated(ev TableFileEvent) { l.created[ev.Path] = ev.Reason }
+func (l *recordingListener) OnTableFileDeleted(ev TableFileEvent) { l.deleted[ev.Path] = ev.Reason }
+func (l *recordingListener) OnWriteStall(ev WriteStallEvent)      { l.stalls = append(l.stalls, ev) }
+func (l *recordingListener) OnBackgroundError(ev BackgroundErrorEvent) {
+	l.errors = append(l.errors, ev)
+}
+
+func TestEventListener(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_events_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 5, &compaction.SizeTieredStrategy{MinTables: 3, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	l := &recordingListener{created: make(map[string]string), deleted: make(map[string]string)}
+	tree.SetEventListener(l)
+	tree.SetWriteStall(&WriteStallOptions{L0SlowdownTables: 2, DelayedWriteRate: 1 << 30})
+
+	for i := 0; i < 40; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+
+	if len(l.flushes) != 16 || l.flushes[0] != "begin" || l.flushes[15] != "end" {
+		t.Fatalf("Expected 8 flush begin/end pairs, got %v", l.flushes)
+	}
+	if len(l.compacted) == 0 {
+		t.Fatalf("Expected compaction events")
+	}
+	for _, ev := range l.compacted {
+		if ev.Err != nil || len(ev.Inputs) < 2 || len(ev.Outputs) != 1 || ev.BytesRead == 0 || ev.BytesWritten == 0 {
+			t.Fatalf("Unexpected compaction event: %+v", ev)
+		}
+		for _, path := range ev.Inputs {
+			if l.deleted[path] != ReasonCompaction {
+				t.Fatalf("Expected input %s to be reported deleted by compaction", path)
+			}
+		}
+	}
+	if len(l.stalls) == 0 {
+		t.Fatalf("Expected write stall events")
+	}
+
+	// Every live table was reported created and never deleted
+	for _, tbl := range tree.Tables {
+		if l.created[tbl.Path] == "" || l.deleted[tbl.Path] != "" {
+			t.Fatalf("Table %s: created by %q, deleted by %q", tbl.Path, l.created[tbl.Path], l.deleted[tbl.Path])
+		}
+	}
+	if len(l.created) != len(tree.Tables)+len(l.deleted) {
+		t.Fatalf("Expected %d created files, got %d", len(tree.Tables)+len(l.deleted), len(l.created))
+	}
+
+	// A flush that cannot write its table is reported
+	os.RemoveAll(testDir)
+	for i := 0; i < 5; i++ {
+		tree.Put(fmt.Sprintf("lost-%d", i), "v")
+	}
+	if len(l.errors) != 1 || l.errors[0].Operation != "flush" || l.errors[0].Err == nil {
+		t.Fatalf("Expected one flush error, got %+v", l.errors)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	if h.Percentile(50) != 0 || h.Mean() != 0 {
+		t.Fatalf("Expected an empty histogram to report zero")
+	}
+	for i := 1; i <= 100; i++ {
+		h.Record(time.Duration(i) * time.Millisecond)
+	}
+	if h.Count() != 100 || h.Min() != time.Millisecond || h.Max() != 100*time.Millisecond {
+		t.Fatalf("Unexpected count, min or max: %v", h)
+	}
+	if h.Mean() != 50500*time.Microsecond {
+		t.Fatalf("Expected mean 50.5ms, got %v", h.Mean())
+	}
+	// Percentiles are bucket upper bounds: at most twice the true value
+	for _, c := range []struct {
+		p    float64
+		want time.Duration
+	}{{50, 50 * time.Millisecond}, {90, 90 * time.Millisecond}, {99, 99 * time.Millisecond}} {
+		got := h.Percentile(c.p)
+		if got < c.want || got > 2*c.want {
+			t.Fatalf("p%v: expected between %v and %v, got %v", c.p, c.want, 2*c.want, got)
+		}
+	}
+	if h.Percentile(100) != h.Max() {
+		t.Fatalf("Expected p100 to be the maximum, got %v", h.Percentile(100))
+	}
+
+	// The median of three is the middle observation, not the lowest
+	var three Histogram
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond} {
+		three.Record(d)
+	}
+	if got := three.Percentile(50); got < 10*time.Millisecond || got > 20*time.Millisecond {
+		t.Fatalf("Expected p50 of three between 10ms and 20ms, got %v", got)
+	}
+}
+
+func TestProperties(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_properties_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	for i := 0; i < 35; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		tree.Get(fmt.Sprintf("key-%03d", i))
+	}
+
+	props := tree.Properties()
+	if props.MemtableEntries != 5 || len(props.Tables) != 3 {
+		t.Fatalf("Expected 5 memtable entries and 3 tables, got %d and %d", props.MemtableEntries, len(props.Tables))
+	}
+	if len(props.Levels) != 1 || props.Levels[0].Files != 3 || props.Levels[0].Entries != 30 {
+		t.Fatalf("Expected level 0 with 3 files and 30 entries, got %+v", props.Levels)
+	}
+	var size int64
+	for _, tp := range props.Tables {
+		if tp.Entries != 10 || tp.Size == 0 {
+			t.Fatalf("Unexpected table properties: %+v", tp)
+		}
+		size += tp.Size
+	}
+	l0 := props.Levels[0]
+	if l0.Size != size || l0.Hits != 30 || l0.BloomFalsePositives != 0 {
+		t.Fatalf("Unexpected level properties: %+v", l0)
+	}
+	// Every lookup skips the tables outside its key range
+	if props.Stats.TotalReads != 50 || props.Stats.SSTableHits != 30 || props.Stats.KeyRangeSaves != 105 {
+		t.Fatalf("Unexpected stats: %+v", props.Stats)
+	}
+	if props.Latency["get"].Count() != 50 || props.Latency["put"].Count() != 35 || props.Latency["flush"].Count() != 3 {
+		t.Fatalf("Unexpected latency counts: %v", props.Latency)
+	}
+
+	data, err := props.JSON()
+	if err != nil {
+		t.Fatalf("Failed to encode properties: %v", err)
+	}
+	var decoded struct {
+		Stats   map[string]float64            `json:"stats"`
+		Levels  []map[string]float64          `json:"levels"`
+		Latency map[string]map[string]float64 `json:"latency"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode properties: %v", err)
+	}
+	if decoded.Stats["total_reads"] != 50 || decoded.Levels[0]["hits"] != 30 || decoded.Latency["get"]["count"] != 50 {
+		t.Fatalf("Unexpected JSON: %s", data)
+	}
+	if !strings.Contains(props.String(), "L0: 3 files") {
+		t.Fatalf("Expected level summary in:\n%s", props.String())
+	}
+
+	// A basic tree has table properties but no statistics
+	basic, err := New(testDir+"_basic", 10)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	defer os.RemoveAll(testDir + "_basic")
+	if p := basic.Properties(); p.Stats != nil || p.Latency != nil {
+		t.Fatalf("Expected no statistics in basic mode")
+	}
+}
+
+func TestKeyRangePruning(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_keyrange_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 25, compaction.NewLeveledStrategy())
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetSubcompactions(4)
+
+	// Four flushes of consecutive keys compact into four disjoint level 1 tables
+	for i := 0; i < 100; i++ {
+		if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatalf("Failed to put: %v", err)
+		}
+	}
+	if len(tree.Tables) != 4 || len(tree.index.sorted[1]) != 4 {
+		t.Fatalf("Expected 4 disjoint level 1 tables, got %d tables, %d indexed", len(tree.Tables), len(tree.index.sorted[1]))
+	}
+	untouched := make(map[string]bool)
+	for _, tbl := range tree.Tables {
+		if tbl.Meta.SmallestKey == "" || tbl.Meta.Entries != 25 {
+			t.Fatalf("Expected key range and 25 entries, got %+v", tbl.Meta)
+		}
+		if tbl.Meta.SmallestKey != "key-000" {
+			untouched[tbl.Path] = true
+		}
+	}
+
+	// Level 0 tables holding only the first range are merged with the one
+	// level 1 table they overlap
+	for round := 0; round < 4; round++ {
+		for i := 0; i < 25; i++ {
+			if err := tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("round-%d", round)); err != nil {
+				t.Fatalf("Failed to put: %v", err)
+			}
+		}
+	}
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables after compaction, got %d", len(tree.Tables))
+	}
+	for _, tbl := range tree.Tables {
+		if tbl.Meta.Level != 1 {
+			t.Fatalf("Expected only level 1 tables, got level %d", tbl.Meta.Level)
+		}
+		if tbl.Meta.SmallestKey != "key-000" && !untouched[tbl.Path] {
+			t.Fatalf("Table %s was compacted without overlapping the input", tbl.Path)
+		}
+	}
+
+	before := tree.Stats().KeyRangeSaves
+	for i := 0; i < 100; i++ {
+		want := fmt.Sprintf("value-%d", i)
+		if i < 25 {
+			want = "round-3"
+		}
+		value, found, err := tree.Get(fmt.Sprintf("key-%03d", i))
+		if err != nil || !found || value != want {
+			t.Fatalf("Expected key-%03d=%s, got %q (found=%v, err=%v)", i, want, value, found, err)
+		}
+	}
+	// Each lookup reads one table of four
+	if saved := tree.Stats().KeyRangeSaves - before; saved != 300 {
+		t.Fatalf("Expected 300 tables skipped by key range, got %d", saved)
+	}
+
+	// Key ranges are stored in the table files
+	tree.Close()
+	reopened, err := New(testDir, 25)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer reopened.Close()
+	for _, tbl := range reopened.Tables {
+		if tbl.Meta.SmallestKey == "" || tbl.Meta.LargestKey < tbl.Meta.SmallestKey {
+			t.Fatalf("Expected key range after reload, got %+v", tbl.Meta)
+		}
+	}
+	it, err := reopened.NewIterator("key-030", "key-040")
+	if err != nil {
+		t.Fatalf("Failed to create iterator: %v", err)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 10 {
+		t.Fatalf("Expected 10 keys in range, got %d", n)
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_mmap_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetMergeOperator(merge.Append{Separator: ","})
+
+	// Tables written before and after enabling are both mapped
+	for i := 0; i < 20; i++ {
+		tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))
+	}
+	tree.SetMmapReads(true)
+	for i := 20; i < 40; i++ {
+		tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))
+	}
+	tree.Merge("key-005", "more")
+	for i := 0; i < 9; i++ {
+		tree.Put(fmt.Sprintf("pad-%d", i), "x")
+	}
+	if len(tree.Tables) != 5 {
+		t.Fatalf("Expected 5 tables, got %d", len(tree.Tables))
+	}
+	old := append([]*sstable.SSTable(nil), tree.Tables...)
+	for _, tbl := range old {
+		if !tbl.Mapped() {
+			t.Fatalf("Expected table %s to be mapped", tbl.Path)
+		}
+	}
+
+	check := func() {
+		for i := 0; i < 40; i++ {
+			want := fmt.Sprintf("value-%d", i)
+			if i == 5 {
+				want = "value-5,more"
+			}
+			value, found, err := tree.Get(fmt.Sprintf("key-%03d", i))
+			if err != nil || !found || value != want {
+				t.Fatalf("Expected key-%03d=%s, got %q (found=%v, err=%v)", i, want, value, found, err)
+			}
+		}
+		if _, found, _ := tree.Get("key-999"); found {
+			t.Fatalf("Expected key-999 to be missing")
+		}
+	}
+	check()
+
+	// Compaction releases the mappings of the tables it deletes
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	for _, tbl := range old {
+		if tbl.Mapped() {
+			t.Fatalf("Expected deleted table %s to be unmapped", tbl.Path)
+		}
+	}
+	if len(tree.Tables) != 1 || !tree.Tables[0].Mapped() {
+		t.Fatalf("Expected the compacted table to be mapped")
+	}
+	check()
+
+	// Without mappings reads go back to the file
+	tree.SetMmapReads(false)
+	if tree.Tables[0].Mapped() {
+		t.Fatalf("Expected mappings to be released")
+	}
+	check()
+	tree.Close()
+}
+
+func TestSnapshotsAndTableCache(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_snapshot_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetTableCacheSize(2)
+	for i := 0; i < 40; i++ {
+		tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))
+	}
+	tree.Put("key-040", "in-memtable")
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables, got %d", len(tree.Tables))
+	}
+
+	// A snapshot keeps its tables' files through a compaction
+	snap := tree.NewSnapshot()
+	old := append([]*sstable.SSTable(nil), tree.Tables...)
+	tree.Put("key-000", "changed")
+	tree.DeleteRange("key-001", "key-002")
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	for _, tbl := range old {
+		if _, err := os.Stat(tbl.Path); err != nil {
+			t.Fatalf("Expected %s to be kept while the snapshot is held: %v", tbl.Path, err)
+		}
+	}
+	for i := 0; i <= 40; i++ {
+		want := fmt.Sprintf("value-%d", i)
+		if i == 40 {
+			want = "in-memtable"
+		}
+		value, found, err := snap.Get(fmt.Sprintf("key-%03d", i))
+		if err != nil || !found || value != want {
+			t.Fatalf("Expected snapshot key-%03d=%s, got %q (found=%v, err=%v)", i, want, value, found, err)
+		}
+	}
+	it, err := snap.NewIterator("key-000", "key-002")
+	if err != nil {
+		t.Fatalf("Failed to create snapshot iterator: %v", err)
+	}
+	var got []string
+	for it.Next() {
+		got = append(got, it.Key()+"="+it.Value())
+	}
+	if strings.Join(got, " ") != "key-000=value-0 key-001=value-1" {
+		t.Fatalf("Unexpected snapshot scan: %v", got)
+	}
+
+	// The tree itself sees the new data
+	if value, _, _ := tree.Get("key-000"); value != "changed" {
+		t.Fatalf("Expected key-000=changed, got %q", value)
+	}
+	if _, found, _ := tree.Get("key-001"); found {
+		t.Fatalf("Expected key-001 to be deleted")
+	}
+
+	// Releasing the snapshot deletes the compacted-away files
+	snap.Release()
+	for _, tbl := range old {
+		if _, err := os.Stat(tbl.Path); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted after release", tbl.Path)
+		}
+	}
+	if _, _, err := snap.Get("key-000"); err != ErrSnapshotReleased {
+		t.Fatalf("Expected ErrSnapshotReleased, got %v", err)
+	}
+
+	// Repeated reads find their file open, and the cache stays bounded
+	for i := 0; i < 40; i++ {
+		tree.Put(fmt.Sprintf("more-%03d", i), "x")
+	}
+	cache := tree.TableCache()
+	hitsBefore, _ := cache.Stats()
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 40; i++ {
+			tree.Get(fmt.Sprintf("more-%03d", i))
+		}
+		if cache.Len() > 2 {
+			t.Fatalf("Expected at most 2 open files, got %d", cache.Len())
+		}
+	}
+	if hits, _ := cache.Stats(); hits <= hitsBefore {
+		t.Fatalf("Expected table cache hits, got %d", hits-hitsBefore)
+	}
+	tree.Close()
+}
+
+func TestConcurrentReadsDuringCompaction(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_concurrent_reads_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetTableCacheSize(3)
+	for i := 0; i < 100; i++ {
+		tree.Put(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	// Readers never see a missing key while tables are replaced under them
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for n := r; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := n % 100
+				value, found, err := tree.Get(fmt.Sprintf("key-%03d", i))
+				if err != nil || !found || value != fmt.Sprintf("value-%d", i) {
+					errs <- fmt.Errorf("key-%03d: got %q (found=%v, err=%v)", i, value, found, err)
+					return
+				}
+				if n%25 == 0 {
+					it, err := tree.NewIterator("key-010", "key-020")
+					if err != nil {
+						errs <- err
+						return
+					}
+					count := 0
+					for it.Next() {
+						count++
+					}
+					if count != 10 {
+						errs <- fmt.Errorf("scan found %d keys, want 10", count)
+						return
+					}
+				}
+			}
+		}(r)
+	}
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 30; i++ {
+			tree.Put(fmt.Sprintf("other-%d-%d", round, i), "x")
+		}
+		if err := tree.Compact(); err != nil {
+			t.Fatalf("Failed to compact: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent read failed: %v", err)
+	}
+	tree.Close()
+}
+
+func TestColumnFamilies(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_column_families_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	meta, err := tree.ColumnFamily("meta", ColumnFamilyOptions{FlushThreshold: 5, Strategy: &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2}})
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	blobs, err := tree.ColumnFamily("blobs", ColumnFamilyOptions{FlushThreshold: 100})
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	if _, err := tree.ColumnFamily("a/b", ColumnFamilyOptions{}); err == nil {
+		t.Fatalf("Expected an invalid column family name to be rejected")
+	}
+	if got := strings.Join(tree.ColumnFamilies(), ","); got != "default,blobs,meta" {
+		t.Fatalf("Unexpected column families: %s", got)
+	}
+
+	// Families are independent keyspaces with their own tables
+	tree.Put("k", "default")
+	meta.Put("k", "meta")
+	for i := 0; i < 5; i++ {
+		meta.Put(fmt.Sprintf("m-%d", i), "x")
+	}
+	if len(meta.Tables) != 1 || len(tree.Tables) != 0 || len(blobs.Tables) != 0 {
+		t.Fatalf("Expected only meta to flush, got %d/%d/%d tables", len(tree.Tables), len(meta.Tables), len(blobs.Tables))
+	}
+	if !strings.HasPrefix(filepath.Base(meta.Tables[0].Path), "meta-") {
+		t.Fatalf("Expected the meta table file to be prefixed, got %s", meta.Tables[0].Path)
+	}
+	if meta.Stats() == nil || tree.Stats() != nil {
+		t.Fatalf("Expected statistics only for the family with a strategy")
+	}
+	for family, want := range map[*LSMTree]string{tree: "default", meta: "meta"} {
+		if value, found, _ := family.Get("k"); !found || value != want {
+			t.Fatalf("Expected k=%s in %s, got %q", want, family.Name(), value)
+		}
+	}
+	if _, found, _ := blobs.Get("k"); found {
+		t.Fatalf("Expected k to be missing in blobs")
+	}
+
+	// A batch spans families atomically
+	var batch WriteBatch
+	batch.Put(meta, "doc-1", "blob-1")
+	batch.Put(blobs, "blob-1", "payload")
+	batch.Put(nil, "count", "1")
+	if err := tree.Write(&batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	var bad WriteBatch
+	bad.Put(blobs, "blob-2", "payload")
+	bad.Merge(meta, "doc-2", "x")
+	if err := tree.Write(&bad); err != ErrNoMergeOperator {
+		t.Fatalf("Expected ErrNoMergeOperator, got %v", err)
+	}
+	if _, found, _ := blobs.Get("blob-2"); found {
+		t.Fatalf("Expected a failed batch to write nothing")
+	}
+	tree.Close()
+
+	// Reopening recovers every family from the shared log and manifest
+	tree, err = New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	if got := strings.Join(tree.ColumnFamilies(), ","); got != "default,blobs,meta" {
+		t.Fatalf("Unexpected column families after reopen: %s", got)
+	}
+	meta, _ = tree.ColumnFamily("meta", ColumnFamilyOptions{})
+	blobs, _ = tree.ColumnFamily("blobs", ColumnFamilyOptions{})
+	if meta.Mem.FlushThreshold != 5 {
+		t.Fatalf("Expected the flush threshold to be kept, got %d", meta.Mem.FlushThreshold)
+	}
+	checks := []struct {
+		family     *LSMTree
+		key, value string
+	}{
+		{tree, "k", "default"}, {tree, "count", "1"}, {meta, "k", "meta"},
+		{meta, "m-4", "x"}, {meta, "doc-1", "blob-1"}, {blobs, "blob-1", "payload"},
+	}
+	for _, c := range checks {
+		if value, found, _ := c.family.Get(c.key); !found || value != c.value {
+			t.Fatalf("Expected %s=%s in %s after reopen, got %q", c.key, c.value, c.family.Name(), value)
+		}
+	}
+
+	// Flushing one family keeps the others' writes in the log
+	for i := 0; i < 5; i++ {
+		meta.Put(fmt.Sprintf("n-%d", i), "y")
+	}
+	tree.Close()
+	tree, err = New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	blobs, _ = tree.ColumnFamily("blobs", ColumnFamilyOptions{})
+	if value, _, _ := blobs.Get("blob-1"); value != "payload" {
+		t.Fatalf("Expected blob-1 to survive another family's flush, got %q", value)
+	}
+
+	// Dropping a family deletes its tables
+	meta, _ = tree.ColumnFamily("meta", ColumnFamilyOptions{})
+	paths := tablePaths(meta.Tables)
+	if err := tree.DropColumnFamily("meta"); err != nil {
+		t.Fatalf("Failed to drop column family: %v", err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected %s to be deleted", path)
+		}
+	}
+	if err := meta.Put("k", "v"); err != ErrColumnFamilyDropped {
+		t.Fatalf("Expected ErrColumnFamilyDropped, got %v", err)
+	}
+	if err := tree.DropColumnFamily("meta"); err != ErrNoColumnFamily {
+		t.Fatalf("Expected ErrNoColumnFamily, got %v", err)
+	}
+	tree.Close()
+
+	// A recreated family does not see the dropped family's writes
+	tree, err = New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer tree.Close()
+	meta, _ = tree.ColumnFamily("meta", ColumnFamilyOptions{})
+	if _, found, _ := meta.Get("k"); found {
+		t.Fatalf("Expected a recreated family to be empty")
+	}
+}
+
+func TestTornWriteBatch(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_torn_batch_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 100)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	other, _ := tree.ColumnFamily("other", ColumnFamilyOptions{})
+	tree.Put("before", "1")
+	var batch WriteBatch
+	batch.Put(nil, "a", "1")
+	batch.Put(other, "b", "2")
+	batch.Put(other, "c", "3")
+	if err := tree.Write(&batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	tree.Close()
+
+	// Cut the log inside the batch, as a crash while writing it would
+	path := filepath.Join(testDir, walName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+	cut := strings.LastIndex(strings.TrimSuffix(string(data), "\n"), "\n") + 1
+	if err := os.WriteFile(path, data[:cut], 0o644); err != nil {
+		t.Fatalf("Failed to truncate log: %v", err)
+	}
+
+	tree, err = New(testDir, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	other, _ = tree.ColumnFamily("other", ColumnFamilyOptions{})
+	if _, found, _ := tree.Get("before"); !found {
+		t.Fatalf("Expected the write before the batch to be recovered")
+	}
+	if _, found, _ := tree.Get("a"); found {
+		t.Fatalf("Expected no write of a torn batch to be recovered")
+	}
+	if _, found, _ := other.Get("b"); found {
+		t.Fatalf("Expected no write of a torn batch to be recovered")
+	}
+
+	// New writes are not mistaken for the rest of the torn batch
+	other.Put("d", "4")
+	tree.Close()
+	tree, err = New(testDir, 100)
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer tree.Close()
+	other, _ = tree.ColumnFamily("other", ColumnFamilyOptions{})
+	if value, found, _ := other.Get("d"); !found || value != "4" {
+		t.Fatalf("Expected d=4 after reopen, got %q", value)
+	}
+}
+
+func TestBlobSeparation(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_blob_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetMergeOperator(merge.Append{Separator: ","})
+	tree.SetBlobOptions(&BlobOptions{MinBlobSize: 100, MaxFileSize: 4000, GCThreshold: 0.5})
+
+	big := func(i, version int) string {
+		return strings.Repeat(fmt.Sprintf("%d.%d|", i, version), 200)
+	}
+	values := make(map[string]string)
+	put := func(key, value string) {
+		if err := tree.Put(key, value); err != nil {
+			t.Fatalf("Failed to put %s: %v", key, err)
+		}
+		values[key] = value
+	}
+	check := func(when string) {
+		for key, want := range values {
+			value, found, err := tree.Get(key)
+			if err != nil || !found || value != want {
+				t.Fatalf("%s: expected %s=%.20q..., got %.20q (found=%v, err=%v)", when, key, want, value, found, err)
+			}
+		}
+		it, err := tree.NewIterator("", "")
+		if err != nil {
+			t.Fatalf("%s: failed to create iterator: %v", when, err)
+		}
+		n := 0
+		for it.Next() {
+			if values[it.Key()] != it.Value() {
+				t.Fatalf("%s: iterator returned a wrong value for %s", when, it.Key())
+			}
+			n++
+		}
+		if n != len(values) {
+			t.Fatalf("%s: iterator returned %d keys, want %d", when, n, len(values))
+		}
+	}
+
+	// Large values go to blob files, small ones stay in the table
+	for i := 0; i < 20; i++ {
+		put(fmt.Sprintf("big-%02d", i), big(i, 0))
+		put(fmt.Sprintf("small-%02d", i), "s")
+	}
+	if len(tree.Tables) != 4 {
+		t.Fatalf("Expected 4 tables, got %d", len(tree.Tables))
+	}
+	for _, tbl := range tree.Tables {
+		if len(tbl.Meta.BlobFiles) == 0 || tbl.Size > 2000 {
+			t.Fatalf("Expected table %s to reference blob files (size %d)", tbl.Path, tbl.Size)
+		}
+	}
+	written := tree.Stats().BlobBytesWritten
+	if written < 15000 {
+		t.Fatalf("Expected the large values in blob files, got %d bytes", written)
+	}
+	tree.Merge("big-00", "tail")
+	values["big-00"] += ",tail"
+	check("after flush")
+
+	// Compaction moves references, not values
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("after compaction")
+	if tree.Stats().BlobBytesWritten != written {
+		t.Fatalf("Expected compaction not to rewrite values, wrote %d bytes", tree.Stats().BlobBytesWritten-written)
+	}
+
+	// Overwriting most values leaves garbage that a later compaction
+	// collects by relocating the remaining live values
+	first := tree.Properties().Blobs[0]
+	for i := 0; i < 20; i++ {
+		if i%4 != 3 {
+			put(fmt.Sprintf("big-%02d", i), big(i, 1))
+		}
+	}
+	for i := 0; i < 5; i++ {
+		put(fmt.Sprintf("small-%02d", i), "t")
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		put(fmt.Sprintf("pad-%02d", i), "p")
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatalf("Failed to compact: %v", err)
+	}
+	check("after garbage collection")
+	stats := tree.Stats()
+	if stats.BlobBytesRelocated == 0 || stats.BlobFilesDeleted == 0 {
+		t.Fatalf("Expected blob garbage collection, got %d bytes relocated, %d files deleted", stats.BlobBytesRelocated, stats.BlobFilesDeleted)
+	}
+	if _, err := os.Stat(tree.blobPath(first.Number)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the first blob file to be deleted")
+	}
+	tree.Close()
+
+	// Reopening reads the blob files back and removes stray ones
+	stray := filepath.Join(testDir, "blob-999.blob")
+	os.WriteFile(stray, []byte("orphan"), 0o644)
+	tree, err = NewWithStrategy(testDir, 10, &compaction.SizeTieredStrategy{MinTables: 1000, SizeRatio: 2})
+	if err != nil {
+		t.Fatalf("Failed to reopen LSM tree: %v", err)
+	}
+	defer tree.Close()
+	tree.SetMergeOperator(merge.Append{Separator: ","})
+	check("after reopen")
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stray blob file to be removed")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	// Clean up test directory
+	testDir := "test_subscribe_lsm"
+	os.RemoveAll(testDir)
+	defer os.RemoveAll(testDir)
+
+	tree, err := New(testDir, 4)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	tree.SetWALRetention(1 << 20)
+	users, err := tree.ColumnFamily("users", ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	live, err := tree.Subscribe(0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+
+	// next reads n changes and checks they continue from seq without gaps
+	next := func(s *Subscription, seq uint64, n int) []Change {
+		t.Helper()
+		var changes []Change
+		for i := 0; i < n; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			c, err := s.Next(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("Failed to read change %d: %v", i, err)
+			}
+			if c.Seq != seq+uint64(i)+1 {
+				t.Fatalf("Expected change %d, got %+v", seq+uint64(i)+1, c)
+			}
+			changes = append(changes, c)
+		}
+		return changes
+	}
+
+	tree.Put("a", "1")
+	var batch WriteBatch
+	batch.Put(users, "u1", "ada")
+	batch.DeleteRange(nil, "a", "b")
+	if err := tree.Write(&batch); err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	changes := next(live, 0, 3)
+	want := []Change{
+		{Seq: 1, Family: "default", Op: ChangePut, Key: "a", Value: "1"},
+		{Seq: 2, Family: "users", Op: ChangePut, Key: "u1", Value: "ada"},
+		{Seq: 3, Family: "default", Op: ChangeDeleteRange, Key: "a", Value: "b"},
+	}
+	if !changes[0].Last || changes[1].Last || !changes[2].Last {
+		t.Fatalf("Expected the batch to end at its last change: %+v", changes)
+	}
+	for i, c := range changes {
+		c.Timestamp, c.Last = 0, false
+		if c != want[i] {
+			t.Fatalf("Expected %+v, got %+v", want[i], c)
+		}
+	}
+
+	// Next waits for the next write
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	if _, err := live.Next(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected Next to time out, got %v", err)
+	}
+	cancel()
+	go tree.Put("b", "2")
+	next(live, 3, 1)
+
+	// Flushed writes are archived, so a new subscription can start back in
+	// history and read through archived and live logs
+	for i := 0; i < 30; i++ {
+		tree.Put(fmt.Sprintf("k%02d", i), "v")
+	}
+	if len(tree.Tables) == 0 {
+		t.Fatalf("Expected writes to be flushed")
+	}
+	next(live, 4, 30)
+	resumed, err := tree.Subscribe(2)
+	if err != nil {
+		t.Fatalf("Failed to subscribe from history: %v", err)
+	}
+	next(resumed, 2, 32)
+	resumed.Close()
+	if _, err := resumed.Next(context.Background()); err != ErrSubscriptionClosed {
+		t.Fatalf("Expected ErrSubscriptionClosed, got %v", err)
+	}
+
+	// A subscription falling far behind catches up from the logs
+	if _, err := tree.ColumnFamily("users", ColumnFamilyOptions{FlushThreshold: 2 * maxQueuedChanges}); err != nil {
+		t.Fatalf("Failed to set options: %v", err)
+	}
+	for i := 0; i < maxQueuedChanges+10; i++ {
+		users.Put(fmt.Sprintf("u%05d", i), "x")
+	}
+	next(live, 34, maxQueuedChanges+10)
+	seq := live.Seq()
+
+	// Positions survive reopening while the archive retains them
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	if _, err := live.Next(context.Background()); err != ErrSubscriptionClosed {
+		t.Fatalf("Expected Close to end subscriptions, got %v", err)
+	}
+	tree, err = New(testDir, 4)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer tree.Close()
+	tree.SetWALRetention(1 << 30)
+	tree.Put("c", "3")
+	resumed, err = tree.Subscribe(10)
+	if err != nil {
+		t.Fatalf("Failed to resume after reopening: %v", err)
+	}
+	next(resumed, 10, int(seq-10)+1)
+
+	// Without retention only writes not yet flushed are kept
+	tree.SetWALRetention(0)
+	if _, err := tree.Subscribe(10); err != ErrChangesTruncated {
+		t.Fatalf("Expected ErrChangesTruncated, got %v", err)
+	}
+	tree.Put("d", "4")
+	next(resumed, seq+1, 1)
+}
+
+func TestSubscribeIngest(t *testing.T) {
+	// Clean up test directories
+	testDir := "test_subscribe_ingest_lsm"
+	externalDir := "test_subscribe_ingest_external"
+	os.RemoveAll(testDir)
+	os.RemoveAll(externalDir)
+	defer os.RemoveAll(testDir)
+	defer os.RemoveAll(externalDir)
+	if err := os.MkdirAll(externalDir, 0o755); err != nil {
+		t.Fatalf("Failed to create external dir: %v", err)
+	}
+
+	var paths []string
+	for i, keys := range [][]string{{"b", "c"}, {"m", "n"}} {
+		path := filepath.Join(externalDir, fmt.Sprintf("%d.sst", i))
+		w, err := sstable.NewWriter(path, sstable.Options{})
+		if err != nil {
+			t.Fatalf("Failed to create writer: %v", err)
+		}
+		for _, key := range keys {
+			if err := w.Add(key, "bulk"); err != nil {
+				t.Fatalf("Failed to add %s: %v", key, err)
+			}
+		}
+		if _, err := w.Finish(); err != nil {
+			t.Fatalf("Failed to finish table: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	tree, err := New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to create LSM tree: %v", err)
+	}
+	sub, err := tree.Subscribe(0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+
+	tree.Put("a", "1")
+	if err := tree.IngestExternalFiles(paths); err != nil {
+		t.Fatalf("Failed to ingest: %v", err)
+	}
+	tree.Put("z", "2")
+
+	// The ingest fills the gap in sequence numbers with one change
+	want := []Change{
+		{Seq: 1, Family: "default", Op: ChangePut, Key: "a", Value: "1"},
+		{Seq: 2, Family: "default", Op: ChangeIngest, Key: "b", Value: "n"},
+		{Seq: 3, Family: "default", Op: ChangePut, Key: "z", Value: "2"},
+	}
+	check := func(s *Subscription) {
+		for _, w := range want {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			c, err := s.Next(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("Failed to read change %d: %v", w.Seq, err)
+			}
+			c.Timestamp, c.Last = 0, false
+			if c != w {
+				t.Fatalf("Expected %+v, got %+v", w, c)
+			}
+		}
+	}
+	check(sub)
+
+	// The ingest is read back from the log, and replaying it after a
+	// restart does not reuse its sequence number
+	resumed, err := tree.Subscribe(0)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	check(resumed)
+	resumed.Close()
+	if err := tree.Close(); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+	tree, err = New(testDir, 10)
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	defer tree.Close()
+	if seq := tree.LastSequence(); seq != 3 {
+		t.Fatalf("Expected sequence 3 after reopening, got %d", seq)
+	}
+	if value, found, err := tree.Get("m"); err != nil || !found || value != "bulk" {
+		t.Fatalf("Expected m=bulk, got %q (found=%t, err=%v)", value, found, err)
+	}
+}
@@ -0,0 +1,289 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"lsm/memtable"
+	"lsm/sstable"
+	"lsm/wal"
+)
+
+const (
+	manifestName = "MANIFEST"
+	walName      = "wal.log"
+)
+
+// manifest is the authoritative list of live tables. It is rewritten
+// atomically whenever the set of tables changes, so files written by an
+// interrupted flush or compaction are never picked up.
+type manifest struct {
+	NextID  int      // id of the next table file
+	LastSeq uint64   // every write up to this sequence number is in a table
+	Tables  []string // table file names, oldest first
+
+	// Ingested holds the level and sequence number assigned to externally
+	// built tables, which are linked in unchanged and so keep the values
+	// written by their builder in the file footer.
+	Ingested map[string]ingestedTable `json:",omitempty"`
+
+	// Families describes each column family other than the default one,
+	// which the top-level fields describe.
+	Families       map[string]*manifest `json:",omitempty"`
+	FlushThreshold int                  `json:",omitempty"` // of a column family's memtable
+}
+
+// ingestedTable is the placement of an ingested table.
+type ingestedTable struct {
+	Level int
+	Seq   uint64
+}
+
+// readManifest loads the manifest in dir, returning nil if there is none.
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest in dir via write-and-rename. The new
+// file is synced before the rename and the directory after it, so a crash
+// leaves either the old manifest or the complete new one.
+func writeManifest(dir string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, manifestName)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the creation, renaming and removal of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// manifest describes the current tables of every column family.
+func (t *LSMTree) manifest() manifest {
+	m := t.families.root.familyManifest()
+	for name, family := range t.families.byName {
+		fm := family.familyManifest()
+		fm.FlushThreshold = family.Mem.FlushThreshold
+		if m.Families == nil {
+			m.Families = make(map[string]*manifest)
+		}
+		m.Families[name] = &fm
+	}
+	return m
+}
+
+// familyManifest describes the column family's current tables.
+func (t *LSMTree) familyManifest() manifest {
+	return tableManifest(t.nextID, t.flushedSeq, t.Tables, t.ingested)
+}
+
+// tableManifest describes a column family holding tables.
+func tableManifest(nextID int, lastSeq uint64, tables []*sstable.SSTable, ingested map[string]ingestedTable) manifest {
+	m := manifest{NextID: nextID, LastSeq: lastSeq}
+	for _, tbl := range tables {
+		name := filepath.Base(tbl.Path)
+		m.Tables = append(m.Tables, name)
+		if placement, ok := ingested[name]; ok {
+			if m.Ingested == nil {
+				m.Ingested = make(map[string]ingestedTable)
+			}
+			m.Ingested[name] = placement
+		}
+	}
+	return m
+}
+
+// manifestWith describes every column family like manifest, but with fm in
+// place of the family's current tables, so that a change can be persisted
+// before it is applied.
+func (t *LSMTree) manifestWith(fm manifest) manifest {
+	m := t.manifest()
+	if t.family == "" {
+		fm.Families = m.Families
+		return fm
+	}
+	fm.FlushThreshold = t.Mem.FlushThreshold
+	m.Families[t.family] = &fm
+	return m
+}
+
+// saveManifest persists the current set of tables.
+func (t *LSMTree) saveManifest() error {
+	return writeManifest(t.Dir, t.manifest())
+}
+
+// loadTables opens the tables listed in the manifest, including those of
+// other column families. Directories written before the manifest existed
+// are scanned for table files instead.
+func (t *LSMTree) loadTables() error {
+	m, err := readManifest(t.Dir)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		if err := t.loadManifest(m); err != nil {
+			return err
+		}
+		for name, fm := range m.Families {
+			family := t.families.add(name, fm.FlushThreshold)
+			if err := family.loadManifest(fm); err != nil {
+				return err
+			}
+			family.tablesChanged()
+		}
+		return nil
+	}
+
+	err = filepath.WalkDir(t.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != t.Dir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".sst" {
+			table, err := sstable.Load(path)
+			if err != nil {
+				return err
+			}
+			t.Tables = append(t.Tables, table)
+			if id := tableID(path); id >= t.nextID {
+				t.nextID = id + 1
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sortTables(t.Tables)
+	return t.saveManifest()
+}
+
+// loadManifest opens the tables listed in a column family's entry of the
+// manifest.
+func (t *LSMTree) loadManifest(m *manifest) error {
+	t.ingested = m.Ingested
+	for _, name := range m.Tables {
+		table, err := sstable.Load(filepath.Join(t.Dir, name))
+		if err != nil {
+			return err
+		}
+		if placement, ok := m.Ingested[name]; ok {
+			table.Meta.Level = placement.Level
+			table.Meta.MinSeq, table.Meta.MaxSeq = placement.Seq, placement.Seq
+		}
+		t.Tables = append(t.Tables, table)
+	}
+	t.nextID = m.NextID
+	t.flushedSeq = m.LastSeq
+	if m.LastSeq > *t.seq {
+		*t.seq = m.LastSeq
+	}
+	if _, maxSeq := seqRange(t.Tables); maxSeq > *t.seq {
+		*t.seq = maxSeq // ingested tables consume sequence numbers too
+	}
+	return nil
+}
+
+// openWAL replays unflushed writes into the memtables of their column
+// families and opens the log for new writes.
+func (t *LSMTree) openWAL() error {
+	if err := t.families.loadArchive(); err != nil {
+		return err
+	}
+	path := filepath.Join(t.Dir, walName)
+	err := wal.Replay(path, func(r wal.Record) error {
+		family := t.families.get(r.Family)
+		if family == nil || r.Seq <= family.flushedSeq {
+			return nil // dropped family, or already persisted in a table
+		}
+		family.apply(r)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if t.wal, err = wal.Open(path); err != nil {
+		return err
+	}
+	for _, family := range t.families.byName {
+		family.wal = t.wal
+	}
+	return nil
+}
+
+// logWrite assigns the next sequence number to a mutation, logs it and
+// applies it to the memtable.
+func (t *LSMTree) logWrite(op wal.Op, key, value string) error {
+	if t.dropped {
+		return ErrColumnFamilyDropped
+	}
+	r := wal.Record{Seq: *t.seq + 1, Op: op, Key: key, Value: value, Timestamp: time.Now().UnixNano(), Family: t.family}
+	if err := t.wal.Append(r); err != nil {
+		return err
+	}
+	t.apply(r)
+	t.families.feed.publish(r)
+	return nil
+}
+
+// apply inserts a logged mutation into the memtable.
+func (t *LSMTree) apply(r wal.Record) {
+	switch r.Op {
+	case wal.OpPut:
+		t.Mem.PutAt(r.Key, r.Value, r.Timestamp)
+	case wal.OpMerge:
+		t.Mem.MergeAt(r.Key, r.Value, r.Timestamp)
+	case wal.OpDeleteRange:
+		t.Mem.DeleteRange(memtable.RangeTombstone{Start: r.Key, End: r.Value, Seq: r.Seq, Timestamp: r.Timestamp})
+	}
+	if r.Seq > *t.seq {
+		*t.seq = r.Seq
+	}
+}
@@ -0,0 +1,132 @@
+package lsmtree
+
+import (
+	"errors"
+
+	"lsm/memtable"
+	"lsm/wal"
+)
+
+// ErrNoMergeOperator is returned when merge operands are written or read
+// without a MergeOperator registered on the tree.
+var ErrNoMergeOperator = errors.New("lsmtree: no merge operator registered")
+
+// MergeOperator combines operands written with Merge into values. Operands are
+// stored as merge records and only combined when a read, iterator or
+// compaction needs the result. Reads, iterators and subcompactions call it
+// concurrently and without holding the tree's lock, so an operator must be
+// safe for concurrent use.
+type MergeOperator interface {
+	// Name identifies the operator.
+	Name() string
+	// FullMerge applies operands (oldest first) to the existing value, which
+	// is absent when exists is false.
+	FullMerge(key, existing string, exists bool, operands []string) (string, error)
+	// PartialMerge combines two adjacent operands into one, reporting false if
+	// they can only be combined with a base value.
+	PartialMerge(key, older, newer string) (string, bool)
+}
+
+// SetMergeOperator registers the operator used to combine merge operands.
+func (t *LSMTree) SetMergeOperator(op MergeOperator) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+	t.mergeOp = op
+}
+
+// Merge records operand for key to be combined with its current value by the
+// registered MergeOperator, without reading the current value.
+func (t *LSMTree) Merge(key, operand string) error {
+	if err := t.throttle(len(key) + len(operand)); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.mergeOp == nil {
+		return ErrNoMergeOperator
+	}
+	if t.stats != nil {
+		t.stats.TotalWrites++
+	}
+	if err := t.logWrite(wal.OpMerge, key, operand); err != nil {
+		return err
+	}
+	return t.maybeFlush()
+}
+
+// combine layers newer on top of older for the same key.
+func (t *LSMTree) combine(older, newer memtable.KV) (memtable.KV, error) {
+	if newer.Kind != memtable.KindMerge {
+		return newer, nil
+	}
+	switch older.Kind {
+	case memtable.KindMerge:
+		newer.Operands = append(append([]string(nil), older.Operands...), newer.Operands...)
+	case memtable.KindDelete:
+		// Nothing below a tombstone is visible to the operands
+		return t.resolve(newer, true)
+	default:
+		older, err := t.fetchBlob(older)
+		if err != nil {
+			return memtable.KV{}, err
+		}
+		resolved, err := t.resolve(older, false)
+		if err != nil {
+			return memtable.KV{}, err
+		}
+		newer.Kind = memtable.KindValue
+		newer.Value = resolved.Value
+	}
+	return newer, nil
+}
+
+// resolve collapses a record as far as the data it covers allows: a value
+// with operands becomes a plain value, and merge records are partially
+// merged or, when no older data can exist (bottommost), fully merged.
+func (t *LSMTree) resolve(kv memtable.KV, bottommost bool) (memtable.KV, error) {
+	if len(kv.Operands) == 0 {
+		return kv, nil
+	}
+	if t.mergeOp == nil {
+		return memtable.KV{}, ErrNoMergeOperator
+	}
+	if kv.Kind == memtable.KindValue || bottommost {
+		v, err := t.mergeOp.FullMerge(kv.Key, kv.Value, kv.Kind == memtable.KindValue, kv.Operands)
+		if err != nil {
+			return memtable.KV{}, err
+		}
+		return memtable.KV{Key: kv.Key, Value: v, Timestamp: kv.Timestamp}, nil
+	}
+
+	var ops []string
+	acc := kv.Operands[0]
+	for _, op := range kv.Operands[1:] {
+		if m, ok := t.mergeOp.PartialMerge(kv.Key, acc, op); ok {
+			acc = m
+			continue
+		}
+		ops = append(ops, acc)
+		acc = op
+	}
+	kv.Operands = append(ops, acc)
+	return kv, nil
+}
+
+// resolveAll resolves every record in kvs. Tombstones are dropped when
+// bottommost, since there is nothing left for them to hide.
+func (t *LSMTree) resolveAll(kvs []memtable.KV, bottommost bool) ([]memtable.KV, error) {
+	out := kvs[:0]
+	for _, kv := range kvs {
+		if kv.Kind == memtable.KindDelete && bottommost {
+			continue
+		}
+		resolved, err := t.resolve(kv, bottommost)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, resolved)
+	}
+	return out, nil
+}
@@ -0,0 +1,57 @@
+package lsmtree
+
+import "lsm/sstable"
+
+// SetPrefixExtractor makes every table keep a filter of its key
+// prefixes as produced by pe, which prefix iterators use to skip tables.
+// Filters for existing tables are rebuilt from their keys. Pass nil to
+// remove them.
+func (t *LSMTree) SetPrefixExtractor(pe sstable.PrefixExtractor) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+
+	for _, tbl := range t.Tables {
+		if err := tbl.SetPrefixExtractor(pe); err != nil {
+			return err
+		}
+	}
+	t.prefix = pe
+	return nil
+}
+
+// NewPrefixIterator returns an iterator over the keys starting with prefix.
+// Tables whose prefix filter rules out prefix are not read. Like
+// NewIterator, it reads tables without holding the tree's lock.
+func (t *LSMTree) NewPrefixIterator(prefix string) (*Iterator, error) {
+	end := prefixEnd(prefix)
+	use := func(tbl *sstable.SSTable) bool { return tbl.MayContainPrefix(prefix) }
+
+	t.mu.Lock()
+	s := t.newSnapshot()
+	if t.stats != nil {
+		t.stats.PrefixScans++
+		for _, tbl := range s.tables {
+			if tbl.Overlaps(prefix, end) && !use(tbl) {
+				t.stats.PrefixFilterSaves++
+			}
+		}
+	}
+	t.mu.Unlock()
+	defer s.Release()
+
+	return t.buildIterator(s.tables, s.mem, s.rangeDels, s.seq, prefix, end, use)
+}
+
+// prefixEnd returns the smallest key greater than every key starting with
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package lsmtree
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Operations with a latency histogram.
+const (
+	opGet = iota
+	opPut
+	opFlush
+	opCompaction
+	numOps
+)
+
+var opNames = [numOps]string{"get", "put", "flush", "compaction"}
+
+// levelCounters counts point lookups against the tables of one level.
+type levelCounters struct {
+	hits                uint64 // lookups that found a record for the key
+	bloomUseful         uint64 // lookups the filter answered without a read
+	bloomFalsePositives uint64 // reads the filter allowed that found nothing
+}
+
+// Properties is a snapshot of the tree's shape and statistics.
+type Properties struct {
+	Stats           *LSMStats            `json:"stats,omitempty"` // nil without statistics
+	MemtableEntries int                  `json:"memtable_entries"`
+	Levels          []LevelProperties    `json:"levels"`
+	Tables          []TableProperties    `json:"tables"`
+	Latency         map[string]Histogram `json:"latency,omitempty"` // by operation: get, put, flush, compaction
+	Blobs           []BlobFileProperties `json:"blobs,omitempty"`
+}
+
+// LevelProperties describes the tables on one level. The read counters are
+// zero without statistics.
+type LevelProperties struct {
+	Level               int    `json:"level"`
+	Files               int    `json:"files"`
+	Size                int64  `json:"size"`
+	Entries             int    `json:"entries"`
+	Hits                uint64 `json:"hits"`
+	BloomUseful         uint64 `json:"bloom_useful"`
+	BloomFalsePositives uint64 `json:"bloom_false_positives"`
+}
+
+// TableProperties describes one table, oldest first.
+type TableProperties struct {
+	Path      string    `json:"path"`
+	Level     int       `json:"level"`
+	Size      int64     `json:"size"`
+	Entries   int       `json:"entries"`
+	RangeDels int       `json:"range_dels"`
+	MinSeq    uint64    `json:"min_seq"`
+	MaxSeq    uint64    `json:"max_seq"`
+	Filter    string    `json:"filter"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Properties returns a consistent snapshot of per-level and per-table
+// properties together with the statistics and latency histograms.
+func (t *LSMTree) Properties() Properties {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := Properties{MemtableEntries: t.Mem.Len()}
+	p.Stats = t.copyStats()
+
+	levels := make(map[int]*LevelProperties)
+	for _, tbl := range t.Tables {
+		p.Tables = append(p.Tables, TableProperties{
+			Path:      tbl.Path,
+			Level:     tbl.Meta.Level,
+			Size:      tbl.Size,
+			Entries:   tbl.Meta.Entries,
+			RangeDels: tbl.Meta.RangeDels,
+			MinSeq:    tbl.Meta.MinSeq,
+			MaxSeq:    tbl.Meta.MaxSeq,
+			Filter:    tbl.Meta.Filter,
+			CreatedAt: tbl.Meta.CreatedAt,
+		})
+		lp := levels[tbl.Meta.Level]
+		if lp == nil {
+			lp = &LevelProperties{Level: tbl.Meta.Level}
+			levels[tbl.Meta.Level] = lp
+		}
+		lp.Files++
+		lp.Size += tbl.Size
+		lp.Entries += tbl.Meta.Entries
+	}
+	for level, c := range t.levels {
+		lp := levels[level]
+		if lp == nil {
+			// Counters outlive the tables they were counted on
+			lp = &LevelProperties{Level: level}
+			levels[level] = lp
+		}
+		lp.Hits, lp.BloomUseful, lp.BloomFalsePositives = c.hits, c.bloomUseful, c.bloomFalsePositives
+	}
+	for _, lp := range levels {
+		p.Levels = append(p.Levels, *lp)
+	}
+	sort.Slice(p.Levels, func(i, j int) bool { return p.Levels[i].Level < p.Levels[j].Level })
+
+	p.Blobs = t.blobProperties()
+
+	if t.latency != nil {
+		p.Latency = make(map[string]Histogram, numOps)
+		for op, h := range t.latency {
+			p.Latency[opNames[op]] = h
+		}
+	}
+	return p
+}
+
+// JSON encodes the properties as indented JSON.
+func (p Properties) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// String formats the properties as text.
+func (p Properties) String() string {
+	var b strings.Builder
+	if p.Stats != nil {
+		b.WriteString(p.Stats.String())
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "Levels (%d memtable entries):\n", p.MemtableEntries)
+	for _, lp := range p.Levels {
+		fmt.Fprintf(&b, "  L%d: %d files, %d bytes, %d entries, %d hits, bloom %d useful / %d false positives\n",
+			lp.Level, lp.Files, lp.Size, lp.Entries, lp.Hits, lp.BloomUseful, lp.BloomFalsePositives)
+	}
+	if len(p.Latency) > 0 {
+		b.WriteString("Latency:\n")
+		for _, name := range opNames {
+			if h, ok := p.Latency[name]; ok {
+				fmt.Fprintf(&b, "  %s: %v\n", name, h)
+			}
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// levelStats returns the lookup counters of level, or nil without
+// statistics.
+func (t *LSMTree) levelStats(level int) *levelCounters {
+	if t.stats == nil {
+		return nil
+	}
+	if t.levels == nil {
+		t.levels = make(map[int]*levelCounters)
+	}
+	c := t.levels[level]
+	if c == nil {
+		c = &levelCounters{}
+		t.levels[level] = c
+	}
+	return c
+}
+
+// observe records the latency of op since start, if statistics are on.
+func (t *LSMTree) observe(op int, start time.Time) {
+	if t.latency != nil {
+		t.latency[op].Record(time.Since(start))
+	}
+}
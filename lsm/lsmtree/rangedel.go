@@ -0,0 +1,213 @@
+package lsmtree
+
+import (
+	"fmt"
+	"sort"
+
+	"lsm/memtable"
+	"lsm/sstable"
+	"lsm/wal"
+)
+
+// DeleteRange deletes every key in [start, end) with a single range
+// tombstone instead of one tombstone per key. Keys written afterwards are
+// not affected.
+func (t *LSMTree) DeleteRange(start, end string) error {
+	if start >= end {
+		return fmt.Errorf("lsmtree: empty range [%q, %q)", start, end)
+	}
+	if err := t.throttle(len(start) + len(end)); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stats != nil {
+		t.stats.TotalWrites++
+	}
+	if err := t.logWrite(wal.OpDeleteRange, start, end); err != nil {
+		return err
+	}
+	return t.maybeFlush()
+}
+
+// coveringSeq returns the newest sequence number among rangeDels covering
+// key, or seq if that is newer.
+func coveringSeq(seq uint64, rangeDels []memtable.RangeTombstone, key string) uint64 {
+	for _, rt := range rangeDels {
+		if rt.Covers(key) && rt.Seq > seq {
+			seq = rt.Seq
+		}
+	}
+	return seq
+}
+
+// view merges sources layered oldest to newest into a single set of
+// records, applying each source's range tombstones to the older ones.
+type view struct {
+	t         *LSMTree
+	keep      func(key string) bool // nil keeps every key
+	merged    map[string]memtable.KV
+	seqs      map[string]uint64 // newest source sequence number of each key
+	rangeDels []memtable.RangeTombstone
+}
+
+func newView(t *LSMTree, keep func(key string) bool) *view {
+	return &view{
+		t:      t,
+		keep:   keep,
+		merged: make(map[string]memtable.KV),
+		seqs:   make(map[string]uint64),
+	}
+}
+
+// add layers a source on top of the view. seq is the newest sequence number
+// written to the source; its tombstones only hide keys from older sources.
+func (v *view) add(kvs []memtable.KV, rangeDels []memtable.RangeTombstone, seq uint64) error {
+	for _, rt := range rangeDels {
+		for k := range v.merged {
+			if rt.Covers(k) && v.seqs[k] < rt.Seq {
+				delete(v.merged, k)
+				delete(v.seqs, k)
+			}
+		}
+	}
+	v.rangeDels = append(v.rangeDels, rangeDels...)
+
+	for _, kv := range kvs {
+		if v.keep != nil && !v.keep(kv.Key) {
+			continue
+		}
+		if older, ok := v.merged[kv.Key]; ok {
+			var err error
+			if kv, err = v.t.combine(older, kv); err != nil {
+				return err
+			}
+		}
+		v.merged[kv.Key] = kv
+		v.seqs[kv.Key] = seq
+	}
+	return nil
+}
+
+// addTable layers tbl on top of the view.
+func (v *view) addTable(tbl *sstable.SSTable) error {
+	kvs, err := tbl.Entries()
+	if err != nil {
+		return err
+	}
+	return v.add(kvs, tbl.RangeDels, tbl.Meta.MaxSeq)
+}
+
+// sorted returns the merged records in key order.
+func (v *view) sorted() []memtable.KV {
+	kvs := make([]memtable.KV, 0, len(v.merged))
+	for _, kv := range v.merged {
+		kvs = append(kvs, kv)
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// writeTable writes the next numbered table file.
+func (t *LSMTree) writeTable(kvs []memtable.KV, rangeDels []memtable.RangeTombstone, opts sstable.Options) (*sstable.SSTable, error) {
+	tbl, err := t.writeTableFile(t.tablePath(t.nextID), kvs, rangeDels, opts)
+	if err != nil {
+		return nil, err
+	}
+	t.nextID++
+	return tbl, nil
+}
+
+// writeTableFile writes a table file at path with the tree's table options.
+func (t *LSMTree) writeTableFile(path string, kvs []memtable.KV, rangeDels []memtable.RangeTombstone, opts sstable.Options) (*sstable.SSTable, error) {
+	opts.PrefixExtractor = t.prefix
+	opts.Filter = t.policy
+	w, err := sstable.NewWriter(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	wroteBlobs := false
+	for _, kv := range kvs {
+		kv, wrote, err := t.separate(kv)
+		if err == nil {
+			err = w.AddEntry(kv)
+		}
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+		wroteBlobs = wroteBlobs || wrote
+	}
+	for _, rt := range rangeDels {
+		w.AddRangeTombstone(rt)
+	}
+	if wroteBlobs {
+		if err := t.syncBlobs(); err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+	return w.Finish()
+}
+
+// dropCoveredTables removes tables whose whole key range was deleted by a
+// newer range tombstone, without reading them through a compaction.
+func (t *LSMTree) dropCoveredTables() error {
+	var dropped []*sstable.SSTable
+	for _, tbl := range t.Tables {
+		covered, err := t.tableCovered(tbl)
+		if err != nil {
+			return err
+		}
+		if covered {
+			dropped = append(dropped, tbl)
+		}
+	}
+	return t.dropTables(dropped)
+}
+
+// tableCovered reports whether a range tombstone newer than tbl, held by
+// the memtable or another table, spans every key and tombstone in tbl.
+func (t *LSMTree) tableCovered(tbl *sstable.SSTable) (bool, error) {
+	var newer []memtable.RangeTombstone
+	for _, rt := range t.Mem.RangeTombstones() {
+		if rt.Seq > tbl.Meta.MaxSeq {
+			newer = append(newer, rt)
+		}
+	}
+	for _, other := range t.Tables {
+		for _, rt := range other.RangeDels {
+			if rt.Seq > tbl.Meta.MaxSeq {
+				newer = append(newer, rt)
+			}
+		}
+	}
+	if len(newer) == 0 {
+		return false, nil
+	}
+
+	min, max, points := tbl.Meta.SmallestKey, tbl.Meta.LargestKey, tbl.Meta.Entries > 0
+	ok := points
+	// Own tombstones must be covered too, or dropping the table would
+	// resurrect the older keys they hide.
+	var end string
+	for _, rt := range tbl.RangeDels {
+		if !ok || rt.Start < min {
+			min = rt.Start
+		}
+		if rt.End > end {
+			end = rt.End
+		}
+		ok = true
+	}
+	if !ok {
+		return false, nil
+	}
+	for _, rt := range newer {
+		if rt.Start <= min && (!points || rt.Covers(max)) && end <= rt.End {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,118 @@
+package lsmtree
+
+import (
+	"errors"
+	"sort"
+
+	"lsm/memtable"
+	"lsm/sstable"
+)
+
+// ErrSnapshotReleased is returned when reading from a released snapshot.
+var ErrSnapshotReleased = errors.New("lsmtree: snapshot released")
+
+// Snapshot is a consistent read-only view of the tree as it was when the
+// snapshot was taken. It holds references to the tables it reads, so
+// their files outlive any compaction until the snapshot is released.
+// Reads run without the tree's lock. A Snapshot must be released, and is
+// not safe for use after Release.
+type Snapshot struct {
+	t         *LSMTree
+	mem       []memtable.KV // memtable contents, sorted by key
+	rangeDels []memtable.RangeTombstone
+	tables    []*sstable.SSTable // oldest first
+	seq       uint64
+	released  bool
+}
+
+// NewSnapshot returns a snapshot of the tree's current contents.
+func (t *LSMTree) NewSnapshot() *Snapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.newSnapshot()
+}
+
+func (t *LSMTree) newSnapshot() *Snapshot {
+	mem := t.Mem.Entries()
+	for i := range mem {
+		// The memtable appends to its operand slices in place
+		mem[i].Operands = append([]string(nil), mem[i].Operands...)
+	}
+	s := &Snapshot{
+		t:         t,
+		mem:       mem,
+		rangeDels: append([]memtable.RangeTombstone(nil), t.Mem.RangeTombstones()...),
+		tables:    append([]*sstable.SSTable(nil), t.Tables...),
+		seq:       *t.seq,
+	}
+	t.ref(s.tables)
+	return s
+}
+
+// Get returns the value of key in the snapshot.
+func (s *Snapshot) Get(key string) (string, bool, error) {
+	if s.released {
+		return "", false, ErrSnapshotReleased
+	}
+
+	var pending []string
+	i := sort.Search(len(s.mem), func(i int) bool { return s.mem[i].Key >= key })
+	if i < len(s.mem) && s.mem[i].Key == key {
+		kv := s.mem[i]
+		if kv.Kind == memtable.KindValue {
+			return s.mergeValue(kv, nil)
+		}
+		pending = kv.Operands
+	}
+	covered := coveringSeq(0, s.rangeDels, key)
+
+	var tables []*sstable.SSTable
+	for _, tbl := range s.tables {
+		if tbl.Overlaps(key, key) {
+			tables = append(tables, tbl)
+		}
+	}
+	var counts readCounts
+	kv, found, pending, err := searchTables(tables, key, pending, covered, &counts)
+	if err == nil && found {
+		kv, err = s.t.fetchBlob(kv)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if found {
+		return s.mergeValue(kv, pending)
+	}
+	if pending != nil {
+		return s.mergeValue(memtable.KV{Key: key, Kind: memtable.KindMerge}, pending)
+	}
+	return "", false, nil
+}
+
+// mergeValue applies pending operands to kv with the tree's merge operator.
+func (s *Snapshot) mergeValue(kv memtable.KV, pending []string) (string, bool, error) {
+	kv.Operands = append(append([]string(nil), kv.Operands...), pending...)
+	return s.t.mergeValue(kv, nil)
+}
+
+// NewIterator returns an iterator over keys in [start, end) as of the
+// snapshot. An empty end means no upper bound.
+func (s *Snapshot) NewIterator(start, end string) (*Iterator, error) {
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	return s.t.buildIterator(s.tables, s.mem, s.rangeDels, s.seq, start, end, nil)
+}
+
+// Release drops the snapshot's table references, deleting files that were
+// compacted away while it was held. Releasing twice is a no-op.
+func (s *Snapshot) Release() {
+	if s.released {
+		return
+	}
+	s.released = true
+	s.t.mu.Lock()
+	defer s.t.mu.Unlock()
+	s.t.unref(s.tables)
+	s.tables, s.mem, s.rangeDels = nil, nil, nil
+}
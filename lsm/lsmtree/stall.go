@@ -0,0 +1,187 @@
+package lsmtree
+
+import (
+	"time"
+
+	"lsm/compaction"
+	"lsm/ratelimit"
+)
+
+// WriteStallOptions sets when writes are slowed down or stopped so that
+// compaction can keep up with them. Zero limits are disabled.
+type WriteStallOptions struct {
+	// Writes are delayed to DelayedWriteRate once level 0 holds this many
+	// tables, and stop until compaction has reduced it at L0StopTables.
+	// Neither applies to FIFO or time-window strategies, which keep all
+	// their tables on level 0 and are never merged into one table.
+	L0SlowdownTables int
+	L0StopTables     int
+
+	// The same for the bytes in tables the strategy wants to compact.
+	SoftPendingCompactionBytes int64
+	HardPendingCompactionBytes int64
+
+	// DelayedWriteRate is the write rate in bytes per second allowed while
+	// slowed down (default 1MB/s).
+	DelayedWriteRate int64
+}
+
+// SetWriteStall enables write stalls. Pass nil to disable them.
+func (t *LSMTree) SetWriteStall(opts *WriteStallOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stall = opts
+	t.delay = nil
+	if opts != nil {
+		rate := opts.DelayedWriteRate
+		if rate <= 0 {
+			rate = 1 << 20
+		}
+		t.delay = ratelimit.New(rate, 1)
+	}
+}
+
+// SetRateLimiter paces the table writes of compactions with l. Compactions
+// write without holding the tree lock, so reads and writes go on while the
+// limiter holds them back. Flushes are not paced: they run under the lock
+// and must finish before the memtable takes new writes. One limiter can be
+// shared by several trees. Pass nil to remove it.
+func (t *LSMTree) SetRateLimiter(l *ratelimit.Limiter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.waitForCompaction()
+	t.limiter = l
+}
+
+// throttle applies write stalls to a write of n bytes before it takes the
+// lock: past a hard limit it compacts until the tree is back under it, past
+// a soft limit it waits for the delayed write rate.
+func (t *LSMTree) throttle(n int) error {
+	t.mu.Lock()
+	if t.stall == nil {
+		t.mu.Unlock()
+		return nil
+	}
+
+	if t.stopped() {
+		ev := t.stallEvent(true)
+		start := time.Now()
+		err := t.backgroundError("compaction", t.catchUp())
+		ev.Duration = time.Since(start)
+		if t.stats != nil {
+			t.stats.StallStops++
+			t.stats.StallStopTime += ev.Duration
+		}
+		if t.listener != nil {
+			t.listener.OnWriteStall(ev)
+		}
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+	}
+	if !t.slowedDown() {
+		t.mu.Unlock()
+		return nil
+	}
+	ev := t.stallEvent(false)
+	delay := t.delay
+	t.mu.Unlock()
+
+	// Sleep without the lock so reads and compaction can go on
+	start := time.Now()
+	delay.Wait(n)
+	ev.Duration = time.Since(start)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats != nil {
+		t.stats.StallSlowdowns++
+		t.stats.StallSlowdownTime += ev.Duration
+	}
+	if t.listener != nil {
+		t.listener.OnWriteStall(ev)
+	}
+	return nil
+}
+
+// stallEvent describes the state that stalled a write.
+func (t *LSMTree) stallEvent(stopped bool) WriteStallEvent {
+	l0, pending := t.stallState()
+	return WriteStallEvent{Stopped: stopped, L0Tables: l0, PendingBytes: pending}
+}
+
+// stopped reports whether a hard stall limit is reached.
+func (t *LSMTree) stopped() bool {
+	l0, pending := t.stallState()
+	if t.keepsTables() {
+		l0 = 0
+	}
+	return (t.stall.L0StopTables > 0 && l0 >= t.stall.L0StopTables) ||
+		(t.stall.HardPendingCompactionBytes > 0 && pending >= t.stall.HardPendingCompactionBytes)
+}
+
+// slowedDown reports whether a soft stall limit is reached.
+func (t *LSMTree) slowedDown() bool {
+	l0, pending := t.stallState()
+	if t.keepsTables() {
+		l0 = 0
+	}
+	return (t.stall.L0SlowdownTables > 0 && l0 >= t.stall.L0SlowdownTables) ||
+		(t.stall.SoftPendingCompactionBytes > 0 && pending >= t.stall.SoftPendingCompactionBytes)
+}
+
+// stallState returns the number of level 0 tables and the bytes the
+// strategy would compact next.
+func (t *LSMTree) stallState() (l0 int, pending int64) {
+	for _, tbl := range t.Tables {
+		if tbl.Meta.Level == 0 {
+			l0++
+		}
+	}
+	if t.strategy != nil && (*t.strategy).ShouldCompact(t.Tables) {
+		for _, tbl := range (*t.strategy).SelectTables(t.Tables) {
+			pending += tbl.Size
+		}
+	}
+	return l0, pending
+}
+
+// catchUp compacts until no hard stall limit is reached. Strategy
+// compactions are tried first; if they stop making progress, or there is no
+// strategy, everything is compacted into one table, unless the strategy
+// keeps its tables apart, in which case the write goes ahead.
+func (t *LSMTree) catchUp() error {
+	for t.stopped() {
+		before := len(t.Tables)
+		if t.strategy != nil && (*t.strategy).ShouldCompact(t.Tables) {
+			if err := t.compactWithStrategy(); err != nil {
+				return err
+			}
+		}
+		if len(t.Tables) < before {
+			continue
+		}
+		if t.keepsTables() {
+			return nil
+		}
+		return t.compact()
+	}
+	return nil
+}
+
+// keepsTables reports whether the strategy relies on tables never being
+// merged wholesale: FIFO drops whole tables by age, and time-window
+// compaction keeps each window in tables of its own. Level 0 limits do not
+// apply to such strategies, since all their tables stay on level 0.
+func (t *LSMTree) keepsTables() bool {
+	if t.strategy == nil {
+		return false
+	}
+	switch (*t.strategy).(type) {
+	case compaction.Dropper, *compaction.TimeBasedStrategy:
+		return true
+	}
+	return false
+}
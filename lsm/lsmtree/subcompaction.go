@@ -0,0 +1,206 @@
+package lsmtree
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	"lsm/memtable"
+	"lsm/sstable"
+)
+
+// SetSubcompactions splits every compaction into up to n disjoint key
+// ranges that are merged in parallel, each into its own table. The outputs
+// replace the inputs in one manifest update. The default, 1, merges on a
+// single goroutine into a single table. With n > 1 the compaction filter
+// and merge operator are called concurrently and must be safe for that.
+func (t *LSMTree) SetSubcompactions(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if n < 1 {
+		n = 1
+	}
+	t.subcompactions = n
+}
+
+// compactTables merges tables, ordered oldest to newest, into new tables at
+// level and returns them. With subcompactions the outputs hold disjoint key
+// ranges; ranges left without data produce no table. The caller holds the
+// lock, which is released while the tables are merged and written, so the
+// rate limiter pacing the writes does not hold up reads and writes.
+func (t *LSMTree) compactTables(tables []*sstable.SSTable, level int, bottommost bool) ([]*sstable.SSTable, error) {
+	minSeq, maxSeq := seqRange(tables)
+	opts := sstable.Options{Level: level, MinSeq: minSeq, MaxSeq: maxSeq, RateLimiter: t.limiter}
+	// Table numbers are handed out up front, as flushes take others while
+	// the lock is released
+	n := max(t.subcompactions, 1)
+	first := t.nextID
+	t.nextID += n
+
+	t.mu.Unlock()
+	outputs, ranges, err := t.mergeInto(tables, first, n, level, bottommost, opts)
+	t.mu.Lock()
+	if err != nil {
+		return nil, err
+	}
+	if n > 1 && t.stats != nil {
+		t.stats.Subcompactions += uint64(ranges)
+	}
+	return outputs, nil
+}
+
+// mergeInto merges tables into up to n tables numbered from first on,
+// without the lock, and returns them with the number of key ranges merged.
+func (t *LSMTree) mergeInto(tables []*sstable.SSTable, first, n, level int, bottommost bool, opts sstable.Options) ([]*sstable.SSTable, int, error) {
+	if n == 1 {
+		kvs, rangeDels, err := t.mergeTables(tables, level, bottommost)
+		if err != nil {
+			return nil, 0, err
+		}
+		tbl, err := t.writeTableFile(t.tablePath(first), kvs, rangeDels, opts)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []*sstable.SSTable{tbl}, 1, nil
+	}
+
+	inputs := make([][]memtable.KV, len(tables))
+	err := parallel(len(tables), func(i int) (err error) {
+		inputs[i], err = tables[i].Entries()
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	bounds := splitPoints(inputs, n)
+
+	outputs := make([]*sstable.SSTable, len(bounds)+1)
+	err = parallel(len(outputs), func(i int) error {
+		var lo, hi string
+		if i > 0 {
+			lo = bounds[i-1]
+		}
+		if i < len(bounds) {
+			hi = bounds[i]
+		}
+		kvs, rangeDels, err := t.mergeRange(tables, inputs, lo, hi, level, bottommost)
+		if err != nil || len(kvs) == 0 && len(rangeDels) == 0 {
+			return err
+		}
+		path := t.tablePath(first + i)
+		outputs[i], err = t.writeTableFile(path, kvs, rangeDels, opts)
+		return err
+	})
+
+	var written []*sstable.SSTable
+	for _, tbl := range outputs {
+		if tbl != nil {
+			written = append(written, tbl)
+		}
+	}
+	if err != nil {
+		for _, tbl := range written {
+			os.Remove(tbl.Path)
+		}
+		return nil, 0, err
+	}
+	return written, len(outputs), nil
+}
+
+// mergeRange is mergeTables restricted to the keys in [lo, hi), reading
+// the tables' entries from inputs. An empty hi means no upper bound.
+func (t *LSMTree) mergeRange(tables []*sstable.SSTable, inputs [][]memtable.KV, lo, hi string, level int, bottommost bool) ([]memtable.KV, []memtable.RangeTombstone, error) {
+	v := newView(t, nil)
+	for i, tbl := range tables {
+		kvs := inputs[i]
+		start := sort.Search(len(kvs), func(j int) bool { return kvs[j].Key >= lo })
+		end := len(kvs)
+		if hi != "" {
+			end = sort.Search(len(kvs), func(j int) bool { return kvs[j].Key >= hi })
+		}
+		if err := v.add(kvs[start:end], clipRangeDels(tbl.RangeDels, lo, hi), tbl.Meta.MaxSeq); err != nil {
+			return nil, nil, err
+		}
+	}
+	kvs, err := t.resolveAll(v.sorted(), bottommost)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rangeDels []memtable.RangeTombstone
+	if !bottommost {
+		rangeDels = v.rangeDels
+	}
+	return t.applyFilter(kvs, level, bottommost), rangeDels, nil
+}
+
+// clipRangeDels returns the parts of rangeDels inside [lo, hi), so that
+// each subcompaction output only carries tombstones for its own keys.
+func clipRangeDels(rangeDels []memtable.RangeTombstone, lo, hi string) []memtable.RangeTombstone {
+	var clipped []memtable.RangeTombstone
+	for _, rt := range rangeDels {
+		if rt.Start < lo {
+			rt.Start = lo
+		}
+		if hi != "" && rt.End > hi {
+			rt.End = hi
+		}
+		if rt.Start < rt.End {
+			clipped = append(clipped, rt)
+		}
+	}
+	return clipped
+}
+
+// splitPoints picks up to n-1 keys dividing the inputs into n ranges. The
+// candidates are the first keys of the input tables, so ranges follow
+// table boundaries and large inputs are spread over several ranges.
+func splitPoints(inputs [][]memtable.KV, n int) []string {
+	var keys []string
+	for _, kvs := range inputs {
+		if len(kvs) > 0 {
+			keys = append(keys, kvs[0].Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	// Splitting at the smallest first key would only cut off an empty range
+	min := keys[0]
+	for len(keys) > 0 && keys[0] == min {
+		keys = keys[1:]
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	var bounds []string
+	for i := 1; i < n; i++ {
+		k := keys[(i-1)*len(keys)/(n-1)]
+		if len(bounds) > 0 && k <= bounds[len(bounds)-1] {
+			continue
+		}
+		bounds = append(bounds, k)
+	}
+	return bounds
+}
+
+// parallel runs fn(0) to fn(n-1) concurrently and returns the first error.
+func parallel(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
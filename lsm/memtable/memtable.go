@@ -1,11 +1,40 @@
 package memtable
 
-import "sort"
+import (
+	"sort"
+	"time"
+)
+
+// Kind distinguishes stored values from pending merge operands.
+type Kind uint8
+
+const (
+	KindValue  Kind = iota // a full value, optionally followed by Operands
+	KindMerge              // only merge operands; the base value is in older data
+	KindDelete             // a tombstone hiding older values of the key
+	KindBlob               // a value stored in a blob file; Value holds its reference
+)
+
+// RangeTombstone deletes every key in [Start, End) written before it.
+type RangeTombstone struct {
+	Start, End string
+	Seq        uint64 // sequence number of the DeleteRange
+	Timestamp  int64  // write time in Unix nanoseconds
+}
+
+// Covers reports whether key falls inside the tombstone's range.
+func (r RangeTombstone) Covers(key string) bool {
+	return key >= r.Start && key < r.End
+}
 
 // Memtable holds key-value pairs in memory until flush threshold.
 type Memtable struct {
 	Data           map[string]string
 	FlushThreshold int
+
+	merges    map[string][]string // merge operands applied after Data[key], oldest first
+	times     map[string]int64    // write time of each key in Unix nanoseconds
+	rangeDels []RangeTombstone    // range deletions, oldest first
 }
 
 // New creates a new Memtable with given flush threshold.
@@ -13,38 +42,137 @@ func New(threshold int) *Memtable {
 	return &Memtable{
 		Data:           make(map[string]string),
 		FlushThreshold: threshold,
+		merges:         make(map[string][]string),
+		times:          make(map[string]int64),
 	}
 }
 
-// Put inserts or updates a key-value pair.
+// Put inserts or updates a key-value pair, stamping it with the current time.
+// Any merge operands pending for the key are superseded.
 func (m *Memtable) Put(key, value string) {
+	m.PutAt(key, value, time.Now().UnixNano())
+}
+
+// PutAt is Put with an explicit write time in Unix nanoseconds.
+func (m *Memtable) PutAt(key, value string, ts int64) {
 	m.Data[key] = value
+	delete(m.merges, key)
+	m.times[key] = ts
+}
+
+// Merge records a merge operand for key to be combined with its current value.
+func (m *Memtable) Merge(key, operand string) {
+	m.MergeAt(key, operand, time.Now().UnixNano())
+}
+
+// MergeAt is Merge with an explicit write time in Unix nanoseconds.
+func (m *Memtable) MergeAt(key, operand string, ts int64) {
+	m.merges[key] = append(m.merges[key], operand)
+	m.times[key] = ts
+}
+
+// DeleteRange records a range tombstone. Keys in the range already held by
+// the memtable are dropped, so every key left in the memtable is newer than
+// its tombstones, which only hide data in older tables.
+func (m *Memtable) DeleteRange(rt RangeTombstone) {
+	for k := range m.Data {
+		if rt.Covers(k) {
+			delete(m.Data, k)
+			delete(m.times, k)
+		}
+	}
+	for k := range m.merges {
+		if rt.Covers(k) {
+			delete(m.merges, k)
+			delete(m.times, k)
+		}
+	}
+	m.rangeDels = append(m.rangeDels, rt)
 }
 
-// Get retrieves a value and boolean indicating presence.
+// RangeTombstones returns the range deletions held, oldest first.
+func (m *Memtable) RangeTombstones() []RangeTombstone {
+	return m.rangeDels
+}
+
+// Get retrieves a value and boolean indicating presence. Keys with pending
+// merge operands are not reported; use Lookup to see them.
 func (m *Memtable) Get(key string) (string, bool) {
+	if _, ok := m.merges[key]; ok {
+		return "", false
+	}
 	v, ok := m.Data[key]
 	return v, ok
 }
 
+// Lookup returns the full record for key, including pending merge operands.
+func (m *Memtable) Lookup(key string) (KV, bool) {
+	v, hasValue := m.Data[key]
+	ops, hasOps := m.merges[key]
+	switch {
+	case hasValue:
+		return KV{Key: key, Value: v, Operands: ops, Timestamp: m.times[key]}, true
+	case hasOps:
+		return KV{Key: key, Kind: KindMerge, Operands: ops, Timestamp: m.times[key]}, true
+	}
+	return KV{}, false
+}
+
+// Len returns the number of distinct keys and range tombstones held.
+func (m *Memtable) Len() int {
+	n := len(m.Data) + len(m.rangeDels)
+	for k := range m.merges {
+		if _, ok := m.Data[k]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
 // IsFull checks if memtable reached flush threshold.
 func (m *Memtable) IsFull() bool {
-	return len(m.Data) >= m.FlushThreshold
+	return m.Len() >= m.FlushThreshold
 }
 
-// Flush returns sorted contents and resets the memtable.
-func (m *Memtable) Flush() []KV {
-	kvs := make([]KV, 0, len(m.Data))
+// Entries returns the sorted contents without resetting the memtable.
+func (m *Memtable) Entries() []KV {
+	kvs := make([]KV, 0, m.Len())
+	now := time.Now().UnixNano()
+	stamp := func(k string) int64 {
+		if ts, ok := m.times[k]; ok {
+			return ts
+		}
+		return now // written directly into Data
+	}
 	for k, v := range m.Data {
-		kvs = append(kvs, KV{Key: k, Value: v})
+		kvs = append(kvs, KV{Key: k, Value: v, Operands: m.merges[k], Timestamp: stamp(k)})
+	}
+	for k, ops := range m.merges {
+		if _, ok := m.Data[k]; !ok {
+			kvs = append(kvs, KV{Key: k, Kind: KindMerge, Operands: ops, Timestamp: stamp(k)})
+		}
 	}
 	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// Flush returns sorted contents and resets the memtable, range tombstones
+// included; read them with RangeTombstones first.
+func (m *Memtable) Flush() []KV {
+	kvs := m.Entries()
 	m.Data = make(map[string]string)
+	m.merges = make(map[string][]string)
+	m.times = make(map[string]int64)
+	m.rangeDels = nil
 	return kvs
 }
 
 // KV is a key-value pair.
 type KV struct {
-	Key   string
-	Value string
+	Key       string
+	Value     string
+	Timestamp int64 // write time in Unix nanoseconds
+
+	Kind     Kind
+	Operands []string // merge operands, oldest first
 }
@@ -0,0 +1,135 @@
+// Package merge provides ready-made merge operators for lsmtree.LSMTree.Merge.
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Counter treats values as decimal int64 counters and operands as deltas.
+type Counter struct{}
+
+func (Counter) Name() string {
+	return "Counter"
+}
+
+func (Counter) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("counter %q: bad value %q: %w", key, existing, err)
+		}
+		sum = n
+	}
+	for _, op := range operands {
+		n, err := strconv.ParseInt(op, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("counter %q: bad delta %q: %w", key, op, err)
+		}
+		sum += n
+	}
+	return strconv.FormatInt(sum, 10), nil
+}
+
+func (c Counter) PartialMerge(key, older, newer string) (string, bool) {
+	v, err := c.FullMerge(key, older, true, []string{newer})
+	return v, err == nil
+}
+
+// Append builds append-only lists by joining operands onto the value.
+type Append struct {
+	Separator string
+}
+
+func (a Append) Name() string {
+	return "Append"
+}
+
+func (a Append) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	result := existing
+	for i, op := range operands {
+		if exists || i > 0 {
+			result += a.Separator
+		}
+		result += op
+	}
+	return result, nil
+}
+
+func (a Append) PartialMerge(key, older, newer string) (string, bool) {
+	return older + a.Separator + newer, true
+}
+
+// JSONPatch applies operands as JSON merge patches (RFC 7396) to JSON object values.
+type JSONPatch struct{}
+
+func (JSONPatch) Name() string {
+	return "JSONPatch"
+}
+
+func (JSONPatch) FullMerge(key, existing string, exists bool, operands []string) (string, error) {
+	var doc interface{}
+	if exists {
+		if err := json.Unmarshal([]byte(existing), &doc); err != nil {
+			return "", fmt.Errorf("json patch %q: bad value: %w", key, err)
+		}
+	}
+	for _, op := range operands {
+		var patch interface{}
+		if err := json.Unmarshal([]byte(op), &patch); err != nil {
+			return "", fmt.Errorf("json patch %q: bad patch: %w", key, err)
+		}
+		doc = applyPatch(doc, patch)
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// PartialMerge combines two patches into one when they touch disjoint
+// top-level fields, where applying their union is exactly equivalent to
+// applying them in order. Other cases are left to FullMerge.
+func (JSONPatch) PartialMerge(key, older, newer string) (string, bool) {
+	var a, b map[string]json.RawMessage
+	if json.Unmarshal([]byte(older), &a) != nil || json.Unmarshal([]byte(newer), &b) != nil {
+		return "", false
+	}
+	if a == nil || b == nil {
+		return "", false
+	}
+	for k, v := range b {
+		if _, ok := a[k]; ok {
+			return "", false
+		}
+		a[k] = v
+	}
+	out, err := json.Marshal(a)
+	if err != nil {
+		return "", false
+	}
+	return string(out), true
+}
+
+// applyPatch implements the RFC 7396 MergePatch algorithm.
+func applyPatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = applyPatch(t[k], v)
+		}
+	}
+	return t
+}
@@ -0,0 +1,101 @@
+// Package ratelimit provides a token-bucket limiter for background I/O such
+// as table writes, so flushes and compactions do not starve foreground reads
+// and writes of disk bandwidth.
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket holding up to burst bytes and refilled at a
+// fixed rate. It is safe for concurrent use.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64 // negative while callers wait for bytes already granted
+	last   time.Time
+
+	// Clock, replaceable in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New creates a limiter allowing bytesPerSecond on average and bursts of up
+// to burst bytes. A burst below 1 is set to one second's worth.
+func New(bytesPerSecond, burst int64) *Limiter {
+	if burst < 1 {
+		burst = bytesPerSecond
+	}
+	l := &Limiter{
+		rate:  float64(bytesPerSecond),
+		burst: float64(burst),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.tokens = l.burst
+	l.last = l.now()
+	return l
+}
+
+// Wait blocks until n bytes may be written. Requests larger than the burst
+// are granted on credit and the caller waits for the bucket to recover.
+func (l *Limiter) Wait(n int) {
+	if d := l.reserve(n); d > 0 {
+		l.sleep(d)
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait for
+// them to be paid for.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0 // unlimited
+	}
+
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// SetRate changes the refill rate. Zero or less disables limiting.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bytesPerSecond)
+}
+
+// Rate returns the refill rate in bytes per second.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// Writer returns a writer that waits on l before each write to w.
+func (l *Limiter) Writer(w io.Writer) io.Writer {
+	return &limitedWriter{w: w, l: l}
+}
+
+type limitedWriter struct {
+	w io.Writer
+	l *Limiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	lw.l.Wait(len(p))
+	return lw.w.Write(p)
+}
@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the limiter sleeps.
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func newFake(bytesPerSecond, burst int64) (*Limiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := New(bytesPerSecond, burst)
+	l.now, l.sleep = clock.now, clock.sleep
+	l.last = clock.t
+	return l, clock
+}
+
+func TestLimiter(t *testing.T) {
+	l, clock := newFake(1000, 500)
+
+	// The initial burst is free
+	l.Wait(500)
+	if clock.slept != 0 {
+		t.Fatalf("Expected the burst without waiting, slept %v", clock.slept)
+	}
+	// Then writes proceed at the rate: 2000 bytes take 2 seconds
+	for i := 0; i < 20; i++ {
+		l.Wait(100)
+	}
+	if clock.slept != 2*time.Second {
+		t.Fatalf("Expected 2s of waiting, slept %v", clock.slept)
+	}
+
+	// Idle time refills the bucket, but only up to the burst
+	clock.t = clock.t.Add(time.Hour)
+	clock.slept = 0
+	l.Wait(1500)
+	if clock.slept != time.Second {
+		t.Fatalf("Expected 1s of waiting after a full bucket, slept %v", clock.slept)
+	}
+
+	// No limit
+	l.SetRate(0)
+	clock.slept = 0
+	l.Wait(1 << 30)
+	if clock.slept != 0 {
+		t.Fatalf("Expected no waiting without a rate, slept %v", clock.slept)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	l, clock := newFake(1000, 1000)
+	var buf bytes.Buffer
+	w := l.Writer(&buf)
+	for i := 0; i < 3; i++ {
+		if _, err := w.Write(make([]byte, 1000)); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if buf.Len() != 3000 {
+		t.Fatalf("Expected 3000 bytes written, got %d", buf.Len())
+	}
+	if clock.slept != 2*time.Second {
+		t.Fatalf("Expected 2s of waiting, slept %v", clock.slept)
+	}
+}
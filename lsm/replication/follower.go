@@ -0,0 +1,437 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"lsm/lsmtree"
+)
+
+// stateFamily is the follower's column family holding its position.
+const stateFamily = "replication"
+
+const appliedKey = "applied"
+
+// ErrNoData is returned by reads while a follower has no usable data, for
+// example after installing a checkpoint failed.
+var ErrNoData = errors.New("replication: follower has no data")
+
+// FollowerOptions configures a Follower.
+type FollowerOptions struct {
+	FlushThreshold int                   // memtable entries before a flush (default 1000)
+	MergeOperator  lsmtree.MergeOperator // registered on every column family, to apply replicated merges
+	RetryInterval  time.Duration         // wait before reconnecting to the primary (default 100ms)
+}
+
+// Status describes the replication state of a follower.
+type Status struct {
+	Applied     uint64 // primary sequence number of the last write applied
+	PrimarySeq  uint64 // latest primary sequence number known
+	Lag         uint64 // writes on the primary not applied yet
+	Connected   bool
+	Checkpoints int   // checkpoints installed since the follower started
+	Err         error // why the last connection ended
+}
+
+// Follower keeps a read-only copy of a primary's tree in a directory.
+type Follower struct {
+	dir, addr string
+	opts      FollowerOptions
+
+	mu       sync.RWMutex // held exclusively to replace the tree
+	tree     *lsmtree.LSMTree
+	state    *lsmtree.LSMTree            // the state family
+	families map[string]*lsmtree.LSMTree // used by the replication loop only
+
+	statusMu sync.Mutex
+	status   Status
+	changed  chan struct{} // closed when Applied advances
+	conn     net.Conn
+	closed   bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Follow opens the follower in dir, which holds the data of an earlier run
+// if any, and keeps it up to date with the primary at addr.
+func Follow(dir, addr string, opts FollowerOptions) (*Follower, error) {
+	if opts.FlushThreshold <= 0 {
+		opts.FlushThreshold = 1000
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = 100 * time.Millisecond
+	}
+	f := &Follower{
+		dir:     dir,
+		addr:    addr,
+		opts:    opts,
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	// A checkpoint left by a crash while receiving it is incomplete
+	os.RemoveAll(f.checkpointDir())
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.run()
+	return f, nil
+}
+
+func (f *Follower) checkpointDir() string {
+	return f.dir + ".checkpoint"
+}
+
+// open opens the tree in the follower's directory and loads its position.
+// The caller holds f.mu exclusively, or is Follow.
+func (f *Follower) open() error {
+	tree, err := lsmtree.New(f.dir, f.opts.FlushThreshold)
+	if err != nil {
+		return err
+	}
+	state, err := tree.ColumnFamily(stateFamily, lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		tree.Close()
+		return err
+	}
+	var applied uint64
+	if v, ok, err := state.Get(appliedKey); err != nil {
+		tree.Close()
+		return err
+	} else if ok {
+		if applied, err = strconv.ParseUint(v, 10, 64); err != nil {
+			tree.Close()
+			return fmt.Errorf("replication: bad position %q: %w", v, err)
+		}
+	}
+
+	f.tree, f.state = tree, state
+	f.families = make(map[string]*lsmtree.LSMTree)
+	for _, name := range tree.ColumnFamilies() {
+		if _, err := f.family(name); err != nil {
+			tree.Close()
+			f.tree = nil
+			return err
+		}
+	}
+	f.statusMu.Lock()
+	f.status.Applied = applied
+	f.statusMu.Unlock()
+	return nil
+}
+
+// family returns the column family name, creating it on first use.
+func (f *Follower) family(name string) (*lsmtree.LSMTree, error) {
+	if family := f.families[name]; family != nil {
+		return family, nil
+	}
+	family, err := f.tree.ColumnFamily(name, lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if f.opts.MergeOperator != nil {
+		family.SetMergeOperator(f.opts.MergeOperator)
+	}
+	f.families[name] = family
+	return family, nil
+}
+
+// run follows the primary, reconnecting whenever the connection ends.
+func (f *Follower) run() {
+	defer close(f.done)
+	for {
+		err := f.follow()
+		f.statusMu.Lock()
+		f.status.Connected, f.status.Err, f.conn = false, err, nil
+		closed := f.closed
+		f.statusMu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(f.opts.RetryInterval):
+		}
+	}
+}
+
+// follow applies the messages of one connection to the primary.
+func (f *Follower) follow() error {
+	if f.tree == nil {
+		// Installing a checkpoint failed; start over from what is on disk
+		f.mu.Lock()
+		err := f.open()
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	nc, err := net.DialTimeout("tcp", f.addr, time.Second)
+	if err != nil {
+		return err
+	}
+	f.statusMu.Lock()
+	if f.closed {
+		f.statusMu.Unlock()
+		nc.Close()
+		return nil
+	}
+	f.conn = nc
+	applied := f.status.Applied
+	f.statusMu.Unlock()
+	c := newConn(nc)
+	defer c.Close()
+
+	if err := c.send(message{Type: msgHello, Seq: applied}); err != nil {
+		return err
+	}
+	f.statusMu.Lock()
+	f.status.Connected = true
+	f.statusMu.Unlock()
+
+	var pending []lsmtree.Change // changes of a write not received completely
+	for {
+		m, err := c.receive()
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case msgHeartbeat:
+			f.statusMu.Lock()
+			f.status.PrimarySeq = max(f.status.PrimarySeq, m.Seq)
+			f.statusMu.Unlock()
+		case msgChange:
+			if m.Change == nil {
+				return errors.New("replication: change message without a change")
+			}
+			pending = append(pending, *m.Change)
+			if !m.Change.Last {
+				continue
+			}
+			if err := f.apply(pending); err != nil {
+				return err
+			}
+			pending = nil
+			if err := c.send(message{Type: msgAck, Seq: m.Change.Seq}); err != nil {
+				return err
+			}
+		case msgCheckpoint:
+			pending = nil
+			dir := f.checkpointDir()
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		case msgFile:
+			if err := f.receiveFile(m.Name, m.Data); err != nil {
+				return err
+			}
+		case msgCheckpointEnd:
+			if err := f.install(m.Seq); err != nil {
+				return err
+			}
+			if err := c.send(message{Type: msgAck, Seq: m.Seq}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// apply writes the changes of one primary write, together with the new
+// position, in one batch.
+func (f *Follower) apply(changes []lsmtree.Change) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var batch lsmtree.WriteBatch
+	for _, c := range changes {
+		if c.Family == stateFamily {
+			continue // the state of the primary's own primary
+		}
+		family, err := f.family(c.Family)
+		if err != nil {
+			return err
+		}
+		switch c.Op {
+		case lsmtree.ChangePut:
+			batch.Put(family, c.Key, c.Value)
+		case lsmtree.ChangeMerge:
+			batch.Merge(family, c.Key, c.Value)
+		case lsmtree.ChangeDeleteRange:
+			batch.DeleteRange(family, c.Key, c.Value)
+		default:
+			return fmt.Errorf("replication: unknown change %q", c.Op)
+		}
+	}
+	seq := changes[len(changes)-1].Seq
+	batch.Put(f.state, appliedKey, strconv.FormatUint(seq, 10))
+	if err := f.tree.Write(&batch); err != nil {
+		return err
+	}
+	f.advance(seq)
+	return nil
+}
+
+// receiveFile appends a chunk to a file of the checkpoint being received.
+func (f *Follower) receiveFile(name string, data []byte) error {
+	if name == "" || filepath.Base(name) != name || name == "." || name == ".." {
+		return fmt.Errorf("replication: bad checkpoint file name %q", name)
+	}
+	file, err := os.OpenFile(filepath.Join(f.checkpointDir(), name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// install replaces the follower's data with the received checkpoint. A
+// crash midway leaves no position, so the next run asks for a new one.
+func (f *Follower) install(seq uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tree.Close()
+	f.tree = nil
+	if err := os.RemoveAll(f.dir); err != nil {
+		return err
+	}
+	if err := os.Rename(f.checkpointDir(), f.dir); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		f.tree = nil
+		return err
+	}
+	if err := f.state.Put(appliedKey, strconv.FormatUint(seq, 10)); err != nil {
+		return err
+	}
+
+	f.statusMu.Lock()
+	f.status.Checkpoints++
+	f.statusMu.Unlock()
+	f.advance(seq)
+	return nil
+}
+
+// advance records seq as applied and wakes WaitFor callers.
+func (f *Follower) advance(seq uint64) {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	f.status.Applied = seq
+	f.status.PrimarySeq = max(f.status.PrimarySeq, seq)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// Status returns the follower's replication state.
+func (f *Follower) Status() Status {
+	f.statusMu.Lock()
+	defer f.statusMu.Unlock()
+	s := f.status
+	if s.PrimarySeq > s.Applied {
+		s.Lag = s.PrimarySeq - s.Applied
+	}
+	return s
+}
+
+// WaitFor waits until the follower applied every write up to primary
+// sequence number seq, or ctx is done.
+func (f *Follower) WaitFor(ctx context.Context, seq uint64) error {
+	for {
+		f.statusMu.Lock()
+		applied, changed := f.status.Applied, f.changed
+		f.statusMu.Unlock()
+		if applied >= seq {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Get returns the value of key in the column family named family.
+func (f *Follower) Get(family, key string) (string, bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	t, err := f.lookup(family)
+	if err != nil {
+		return "", false, err
+	}
+	return t.Get(key)
+}
+
+// Scan calls fn for every key in [start, end) of the column family named
+// family, in order, until fn returns false. An empty end means no upper
+// bound.
+func (f *Follower) Scan(family, start, end string, fn func(key, value string) bool) error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	t, err := f.lookup(family)
+	if err != nil {
+		return err
+	}
+	it, err := t.NewIterator(start, end)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for it.Next() && fn(it.Key(), it.Value()) {
+	}
+	return nil
+}
+
+// lookup returns an existing column family without creating it. The
+// caller holds f.mu.
+func (f *Follower) lookup(name string) (*lsmtree.LSMTree, error) {
+	if f.tree == nil {
+		return nil, ErrNoData
+	}
+	for _, family := range f.tree.ColumnFamilies() {
+		if family == name {
+			return f.tree.ColumnFamily(name, lsmtree.ColumnFamilyOptions{})
+		}
+	}
+	return nil, lsmtree.ErrNoColumnFamily
+}
+
+// Close disconnects from the primary and closes the follower's tree.
+func (f *Follower) Close() error {
+	f.statusMu.Lock()
+	if f.closed {
+		f.statusMu.Unlock()
+		return nil
+	}
+	f.closed = true
+	if f.conn != nil {
+		f.conn.Close()
+	}
+	f.statusMu.Unlock()
+	close(f.stop)
+	<-f.done
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.tree == nil {
+		return nil
+	}
+	return f.tree.Close()
+}
@@ -0,0 +1,297 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"lsm/lsmtree"
+)
+
+// PrimaryOptions configures a Primary.
+type PrimaryOptions struct {
+	HeartbeatInterval time.Duration // between heartbeats to each follower (default 100ms)
+}
+
+const defaultHeartbeatInterval = 100 * time.Millisecond
+
+// FollowerStatus describes a follower connected to a primary.
+type FollowerStatus struct {
+	Addr        string
+	Acked       uint64 // position the follower reported applied
+	Lag         uint64 // writes on the primary the follower has not acknowledged
+	Checkpoints int    // checkpoints sent to the follower
+}
+
+// Primary serves the changes of a tree to followers.
+type Primary struct {
+	tree *lsmtree.LSMTree
+	ln   net.Listener
+	opts PrimaryOptions
+
+	mu        sync.Mutex
+	followers map[*conn]*FollowerStatus
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// Listen serves the changes of tree to followers connecting to addr, such
+// as "127.0.0.1:0" for a free port on localhost.
+func Listen(tree *lsmtree.LSMTree, addr string, opts PrimaryOptions) (*Primary, error) {
+	if opts.HeartbeatInterval <= 0 {
+		opts.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &Primary{tree: tree, ln: ln, opts: opts, followers: make(map[*conn]*FollowerStatus)}
+	p.wg.Add(1)
+	go p.accept()
+	return p, nil
+}
+
+// Addr returns the address the primary listens on.
+func (p *Primary) Addr() string {
+	return p.ln.Addr().String()
+}
+
+// Followers returns the connected followers, by address.
+func (p *Primary) Followers() []FollowerStatus {
+	last := p.tree.LastSequence()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var statuses []FollowerStatus
+	for _, f := range p.followers {
+		s := *f
+		if last > s.Acked {
+			s.Lag = last - s.Acked
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Addr < statuses[j].Addr })
+	return statuses
+}
+
+// Close stops listening and disconnects every follower.
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	err := p.ln.Close()
+	for c := range p.followers {
+		c.Close()
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+	return err
+}
+
+func (p *Primary) accept() {
+	defer p.wg.Done()
+	for {
+		nc, err := p.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		c := newConn(nc)
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			nc.Close()
+			return
+		}
+		p.followers[c] = &FollowerStatus{Addr: nc.RemoteAddr().String()}
+		p.wg.Add(1)
+		p.mu.Unlock()
+		go p.serve(c)
+	}
+}
+
+// serve streams changes to a follower until the connection fails.
+func (p *Primary) serve(c *conn) {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		delete(p.followers, c)
+		p.mu.Unlock()
+		c.Close()
+	}()
+
+	hello, err := c.receive()
+	if err != nil || hello.Type != msgHello {
+		return
+	}
+	p.setAcked(c, hello.Seq)
+
+	// Acknowledgements arrive while changes are sent; the connection is
+	// done once it cannot be read from
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			m, err := c.receive()
+			if err != nil {
+				return
+			}
+			if m.Type == msgAck {
+				p.setAcked(c, m.Seq)
+			}
+		}
+	}()
+
+	pos := hello.Seq
+	resync := false
+	for {
+		var sub *lsmtree.Subscription
+		var err error
+		if !resync {
+			sub, err = p.tree.Subscribe(pos)
+			if err == nil && pos > p.tree.LastSequence() {
+				// The follower is ahead, e.g. of a primary restored from a
+				// backup: its data cannot be trusted
+				sub.Close()
+				err = lsmtree.ErrChangesTruncated
+			}
+		}
+		if resync || errors.Is(err, lsmtree.ErrChangesTruncated) {
+			if pos, err = p.sendCheckpoint(c); err != nil {
+				return
+			}
+			resync = false
+			continue
+		}
+		if err != nil {
+			return
+		}
+		pos, err = p.stream(ctx, c, sub)
+		sub.Close()
+		switch {
+		case errors.Is(err, errIngested):
+			resync = true
+		case !errors.Is(err, lsmtree.ErrChangesTruncated):
+			return
+		}
+	}
+}
+
+// errIngested ends a stream at an ingest, which the follower can only
+// receive as part of a checkpoint.
+var errIngested = errors.New("replication: tables ingested")
+
+// stream sends the changes of sub and heartbeats until either fails or an
+// ingest is reached, and returns the position of the last change sent.
+func (p *Primary) stream(ctx context.Context, c *conn, sub *lsmtree.Subscription) (uint64, error) {
+	pos := sub.Seq()
+	var beat time.Time
+	for {
+		if time.Since(beat) >= p.opts.HeartbeatInterval {
+			if err := c.send(message{Type: msgHeartbeat, Seq: p.tree.LastSequence()}); err != nil {
+				return pos, err
+			}
+			beat = time.Now()
+		}
+
+		next, cancel := context.WithTimeout(ctx, p.opts.HeartbeatInterval)
+		change, err := sub.Next(next)
+		cancel()
+		switch {
+		case err == nil && change.Op == lsmtree.ChangeIngest:
+			return pos, errIngested
+		case err == nil:
+			if err := c.send(message{Type: msgChange, Change: &change}); err != nil {
+				return pos, err
+			}
+			pos = change.Seq
+		case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+			// Idle: time for a heartbeat
+		default:
+			return pos, err
+		}
+	}
+}
+
+// sendCheckpoint sends a checkpoint of the tree and returns its position.
+func (p *Primary) sendCheckpoint(c *conn) (uint64, error) {
+	tmp, err := os.MkdirTemp("", "lsm-replication-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tmp)
+	dir := filepath.Join(tmp, "checkpoint")
+	if err := p.tree.Checkpoint(dir); err != nil {
+		return 0, err
+	}
+
+	// The checkpoint's position is the last write the tree it holds
+	// recovers
+	ckpt, err := lsmtree.New(dir, 1<<30)
+	if err != nil {
+		return 0, err
+	}
+	seq := ckpt.LastSequence()
+	if err := ckpt.Close(); err != nil {
+		return 0, err
+	}
+
+	p.mu.Lock()
+	p.followers[c].Checkpoints++
+	p.mu.Unlock()
+	if err := c.send(message{Type: msgCheckpoint, Seq: seq}); err != nil {
+		return 0, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			return 0, fmt.Errorf("replication: unexpected checkpoint entry %s", entry.Name())
+		}
+		if err := sendFile(c, filepath.Join(dir, entry.Name())); err != nil {
+			return 0, err
+		}
+	}
+	return seq, c.send(message{Type: msgCheckpointEnd, Seq: seq})
+}
+
+// sendFile sends the file at path in chunks; an empty file as one empty
+// chunk.
+func sendFile(c *conn, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, fileChunkSize)
+	for first := true; ; first = false {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF && !first {
+			return nil
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if serr := c.send(message{Type: msgFile, Name: filepath.Base(path), Data: buf[:n]}); serr != nil {
+			return serr
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+func (p *Primary) setAcked(c *conn, seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f := p.followers[c]; f != nil {
+		f.Acked = seq
+	}
+}
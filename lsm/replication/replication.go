@@ -0,0 +1,75 @@
+// Package replication ships the writes of a primary LSM tree to followers
+// over TCP.
+//
+// A follower connects and sends the primary sequence number it applied
+// last. The primary subscribes to its changes from there and streams them,
+// one JSON message per line, with periodic heartbeats carrying its latest
+// sequence number. The follower applies each write, or each WriteBatch,
+// together with its new position in one atomic batch, so a restarted
+// follower resumes exactly where it stopped. A follower whose position the
+// primary no longer retains (see lsmtree.SetWALRetention) is sent a
+// checkpoint instead, which replaces its data.
+//
+// Ingested tables are not logged entry by entry, so the primary sends a
+// checkpoint in place of an ingest. Dropped column families are not
+// replicated.
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+
+	"lsm/lsmtree"
+)
+
+// Message types of the protocol.
+const (
+	msgHello         = "hello"          // follower: position applied last (Seq)
+	msgAck           = "ack"            // follower: position applied last (Seq)
+	msgChange        = "change"         // primary: a change
+	msgHeartbeat     = "heartbeat"      // primary: its latest sequence number (Seq)
+	msgCheckpoint    = "checkpoint"     // primary: a checkpoint at Seq follows
+	msgFile          = "file"           // primary: the next chunk of checkpoint file Name
+	msgCheckpointEnd = "checkpoint_end" // primary: the checkpoint is complete
+)
+
+// fileChunkSize bounds the data of a single file message.
+const fileChunkSize = 1 << 20
+
+// message is one line of the protocol.
+type message struct {
+	Type   string          `json:"type"`
+	Seq    uint64          `json:"seq,omitempty"`
+	Change *lsmtree.Change `json:"change,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	Data   []byte          `json:"data,omitempty"`
+}
+
+// conn exchanges messages over a network connection.
+type conn struct {
+	net.Conn
+	dec *json.Decoder
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newConn(c net.Conn) *conn {
+	w := bufio.NewWriter(c)
+	return &conn{Conn: c, dec: json.NewDecoder(bufio.NewReader(c)), w: w, enc: json.NewEncoder(w)}
+}
+
+// send writes m and flushes it to the network.
+func (c *conn) send(m message) error {
+	if err := c.enc.Encode(m); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// receive reads the next message.
+func (c *conn) receive() (message, error) {
+	var m message
+	err := c.dec.Decode(&m)
+	return m, err
+}
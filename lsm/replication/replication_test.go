@@ -0,0 +1,173 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lsm/lsmtree"
+	"lsm/sstable"
+)
+
+func TestReplication(t *testing.T) {
+	primaryDir, firstDir, secondDir := "test_replication_primary", "test_replication_first", "test_replication_second"
+	externalDir := "test_replication_external"
+	for _, dir := range []string{primaryDir, firstDir, secondDir, externalDir} {
+		os.RemoveAll(dir)
+		defer os.RemoveAll(dir)
+	}
+
+	tree, err := lsmtree.New(primaryDir, 4)
+	if err != nil {
+		t.Fatalf("new tree: %v", err)
+	}
+	defer tree.Close()
+	tree.SetWALRetention(1 << 20)
+	users, err := tree.ColumnFamily("users", lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatalf("column family: %v", err)
+	}
+	primary, err := Listen(tree, "127.0.0.1:0", PrimaryOptions{HeartbeatInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer primary.Close()
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := tree.Put(fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i)); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+		}
+	}
+	wait := func(f *Follower) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := f.WaitFor(ctx, tree.LastSequence()); err != nil {
+			t.Fatalf("wait for follower: %v (status %+v)", err, f.Status())
+		}
+	}
+	check := func(f *Follower, family, key, want string) {
+		t.Helper()
+		v, ok, err := f.Get(family, key)
+		if err != nil || (ok != (want != "")) || v != want {
+			t.Fatalf("follower %s/%s = %q, %v, %v; want %q", family, key, v, ok, err, want)
+		}
+	}
+
+	// Writes from before the follower joined are sent from the archived log
+	put(0, 10)
+	follow := func(dir string) *Follower {
+		f, err := Follow(dir, primary.Addr(), FollowerOptions{FlushThreshold: 4, RetryInterval: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatalf("follow: %v", err)
+		}
+		return f
+	}
+	first := follow(firstDir)
+	wait(first)
+	check(first, lsmtree.DefaultColumnFamily, "k03", "v3")
+
+	var batch lsmtree.WriteBatch
+	batch.Put(users, "u1", "ada")
+	batch.DeleteRange(nil, "k00", "k05")
+	if err := tree.Write(&batch); err != nil {
+		t.Fatalf("write batch: %v", err)
+	}
+	wait(first)
+	check(first, "users", "u1", "ada")
+	check(first, lsmtree.DefaultColumnFamily, "k03", "")
+	var keys []string
+	first.Scan(lsmtree.DefaultColumnFamily, "", "", func(key, value string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 5 || keys[0] != "k05" {
+		t.Fatalf("follower scan = %v", keys)
+	}
+	if s := first.Status(); !s.Connected || s.Lag != 0 || s.Checkpoints != 0 {
+		t.Fatalf("unexpected follower status %+v", s)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		statuses := primary.Followers()
+		if len(statuses) == 1 && statuses[0].Acked == tree.LastSequence() && statuses[0].Lag == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("primary does not see the follower caught up: %+v", statuses)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// A restarted follower resumes from its position
+	if err := first.Close(); err != nil {
+		t.Fatalf("close follower: %v", err)
+	}
+	put(10, 20)
+	first = follow(firstDir)
+	defer first.Close()
+	wait(first)
+	check(first, lsmtree.DefaultColumnFamily, "k15", "v15")
+	if s := first.Status(); s.Checkpoints != 0 {
+		t.Fatalf("expected the restarted follower to resume, got %+v", s)
+	}
+
+	// A follower the log no longer covers starts from a checkpoint
+	tree.SetWALRetention(0)
+	put(20, 30)
+	second := follow(secondDir)
+	defer second.Close()
+	wait(second)
+	if s := second.Status(); s.Checkpoints != 1 {
+		t.Fatalf("expected one checkpoint, got %+v", s)
+	}
+	check(second, "users", "u1", "ada")
+	check(second, lsmtree.DefaultColumnFamily, "k25", "v25")
+	check(second, lsmtree.DefaultColumnFamily, "k03", "")
+
+	// Both keep following new writes
+	users.Put("u2", "grace")
+	wait(first)
+	wait(second)
+	check(first, "users", "u2", "grace")
+	check(second, "users", "u2", "grace")
+	if _, _, err := second.Get("missing", "k"); err != lsmtree.ErrNoColumnFamily {
+		t.Fatalf("expected ErrNoColumnFamily, got %v", err)
+	}
+
+	// Ingested tables reach the followers in a checkpoint, even while the
+	// log still covers their positions
+	tree.SetWALRetention(1 << 20)
+	checkpoints := []int{first.Status().Checkpoints, second.Status().Checkpoints}
+	if err := os.MkdirAll(externalDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	path := filepath.Join(externalDir, "bulk.sst")
+	w, err := sstable.NewWriter(path, sstable.Options{})
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	if err := w.Add("bulk", "loaded"); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if _, err := w.Finish(); err != nil {
+		t.Fatalf("finish: %v", err)
+	}
+	if err := tree.IngestExternalFiles([]string{path}); err != nil {
+		t.Fatalf("ingest: %v", err)
+	}
+	put(30, 31)
+	for i, f := range []*Follower{first, second} {
+		wait(f)
+		check(f, lsmtree.DefaultColumnFamily, "bulk", "loaded")
+		check(f, lsmtree.DefaultColumnFamily, "k30", "v30")
+		if s := f.Status(); s.Checkpoints != checkpoints[i]+1 || s.Lag != 0 {
+			t.Fatalf("expected a checkpoint for the ingest, got %+v", s)
+		}
+	}
+}
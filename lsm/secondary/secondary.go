@@ -0,0 +1,262 @@
+// Package secondary maintains secondary indexes over an LSM tree.
+//
+// Each index lives in its own column family of the tree. An entry maps an
+// index value to a primary key and is stored under the key
+//
+//	index value \x00 primary key
+//
+// with an empty value, so the entries for one index value, or a range of
+// them, are a contiguous key range. Writes made through a DB update the
+// primary data and every index in one atomic WriteBatch, so the indexes
+// cannot drift from the data even across crashes.
+package secondary
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"lsm/lsmtree"
+)
+
+// sep separates the index value from the primary key in an entry key.
+const sep = "\x00"
+
+// builtKey marks an index whose backfill completed. It holds no sep, so it
+// is never an entry key and scans skip it.
+const builtKey = "built"
+
+// ErrInvalidIndexValue is returned when an extractor produces an index
+// value containing a NUL byte, which entry keys use as separator.
+var ErrInvalidIndexValue = errors.New("secondary: index value contains NUL")
+
+// Extractor maps a primary key and value to the index values it should be
+// found under. It must be deterministic: the same input always yields the
+// same index values.
+type Extractor func(key, value string) []string
+
+// DB writes to a primary column family and keeps its indexes up to date.
+// Writes to the primary family that bypass the DB are not indexed.
+type DB struct {
+	primary *lsmtree.LSMTree
+
+	mu      sync.Mutex // orders read-modify-write cycles of writes
+	indexes map[string]*Index
+}
+
+// Index is a secondary index of a DB.
+type Index struct {
+	Name    string
+	family  *lsmtree.LSMTree
+	extract Extractor
+}
+
+// New returns a DB over primary, which may be any column family of a tree.
+// Indexes must be added with AddIndex each time the tree is opened.
+func New(primary *lsmtree.LSMTree) *DB {
+	return &DB{primary: primary, indexes: make(map[string]*Index)}
+}
+
+// familyName returns the column family holding the index name.
+func (db *DB) familyName(name string) string {
+	return fmt.Sprintf("%s.index.%s", db.primary.Name(), name)
+}
+
+// AddIndex registers an index maintained with extract. An index that was
+// not built in the tree yet is built from the current primary data in one
+// atomic batch, together with a marker recording that it is complete; a
+// built one was kept up to date by earlier writes and is used as is, so
+// extract must not change between runs.
+func (db *DB) AddIndex(name string, extract Extractor) (*Index, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.indexes[name]; ok {
+		return nil, fmt.Errorf("secondary: index %q already added", name)
+	}
+	familyName := db.familyName(name)
+	family, err := db.primary.ColumnFamily(familyName, lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{Name: name, family: family, extract: extract}
+	// A family without the marker was created by a run that stopped
+	// before its backfill was written
+	_, built, err := family.Get(builtKey)
+	if err != nil {
+		return nil, err
+	}
+	if !built {
+		if err := db.backfill(idx); err != nil {
+			db.primary.DropColumnFamily(familyName)
+			return nil, err
+		}
+	}
+	db.indexes[name] = idx
+	return idx, nil
+}
+
+// backfill indexes every key already in the primary family and marks the
+// index as built.
+func (db *DB) backfill(idx *Index) error {
+	it, err := db.primary.NewIterator("", "")
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	var batch lsmtree.WriteBatch
+	for it.Next() {
+		values, err := idx.values(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+		for _, v := range values {
+			batch.Put(idx.family, entryKey(v, it.Key()), "")
+		}
+	}
+	batch.Put(idx.family, builtKey, "")
+	return db.primary.Write(&batch)
+}
+
+// DropIndex removes an index and its entries.
+func (db *DB) DropIndex(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.indexes[name]; !ok {
+		return fmt.Errorf("secondary: no index %q", name)
+	}
+	delete(db.indexes, name)
+	return db.primary.DropColumnFamily(db.familyName(name))
+}
+
+// Index returns the index name, or nil if it was not added.
+func (db *DB) Index(name string) *Index {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.indexes[name]
+}
+
+// Get returns the primary value of key.
+func (db *DB) Get(key string) (string, bool, error) {
+	return db.primary.Get(key)
+}
+
+// Put writes key and updates every index in the same atomic batch.
+func (db *DB) Put(key, value string) error {
+	return db.write(key, &value)
+}
+
+// Delete deletes key and its index entries in the same atomic batch.
+func (db *DB) Delete(key string) error {
+	return db.write(key, nil)
+}
+
+// write replaces the value of key, deleting it if value is nil, and moves
+// its index entries from the old value's index values to the new one's.
+func (db *DB) write(key string, value *string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	old, found, err := db.primary.Get(key)
+	if err != nil {
+		return err
+	}
+	var batch lsmtree.WriteBatch
+	if value != nil {
+		batch.Put(db.primary, key, *value)
+	} else {
+		batch.DeleteRange(db.primary, key, key+sep)
+	}
+	for _, idx := range db.indexes {
+		var before, after []string
+		if found {
+			if before, err = idx.values(key, old); err != nil {
+				return err
+			}
+		}
+		if value != nil {
+			if after, err = idx.values(key, *value); err != nil {
+				return err
+			}
+		}
+		keep := make(map[string]bool, len(after))
+		for _, v := range after {
+			keep[v] = true
+		}
+		for _, v := range before {
+			if !keep[v] {
+				entry := entryKey(v, key)
+				batch.DeleteRange(idx.family, entry, entry+sep)
+			}
+		}
+		for _, v := range after {
+			batch.Put(idx.family, entryKey(v, key), "")
+		}
+	}
+	return db.primary.Write(&batch)
+}
+
+// values returns the distinct index values of key and value.
+func (idx *Index) values(key, value string) ([]string, error) {
+	var values []string
+	seen := make(map[string]bool)
+	for _, v := range idx.extract(key, value) {
+		if strings.Contains(v, sep) {
+			return nil, ErrInvalidIndexValue
+		}
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// entryKey returns the key of the index entry of value for primary key.
+func entryKey(value, key string) string {
+	return value + sep + key
+}
+
+// Lookup returns the primary keys indexed under value, sorted.
+func (idx *Index) Lookup(value string) ([]string, error) {
+	if strings.Contains(value, sep) {
+		return nil, ErrInvalidIndexValue
+	}
+	// Every entry of value sorts between value\x00 and value\x01
+	return idx.scan(value+sep, value+"\x01")
+}
+
+// Range returns the primary keys whose index values lie in [start, end),
+// sorted by index value and then primary key. An empty end means no upper
+// bound. A key found under several values in the range is returned once.
+func (idx *Index) Range(start, end string) ([]string, error) {
+	if strings.Contains(start, sep) || strings.Contains(end, sep) {
+		return nil, ErrInvalidIndexValue
+	}
+	// value\x00key lies in [start, end) exactly when value does, as no
+	// index value holds a NUL
+	return idx.scan(start, end)
+}
+
+// scan returns the primary keys of the entries in [start, end).
+func (idx *Index) scan(start, end string) ([]string, error) {
+	it, err := idx.family.NewIterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys []string
+	seen := make(map[string]bool)
+	for it.Next() {
+		_, key, ok := strings.Cut(it.Key(), sep)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,173 @@
+package secondary
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"lsm/lsmtree"
+)
+
+// byCity indexes "name,city" values by city.
+func byCity(key, value string) []string {
+	_, city, _ := strings.Cut(value, ",")
+	return []string{city}
+}
+
+// byTag indexes "a|b|c" values by each tag.
+func byTag(key, value string) []string {
+	return strings.Split(value, "|")
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+	dir := "test_secondary_db"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	tree, err := lsmtree.New(dir, 4)
+	if err != nil {
+		t.Fatalf("new tree: %v", err)
+	}
+	users, err := tree.ColumnFamily("users", lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatalf("column family: %v", err)
+	}
+	// Written before the index exists, so AddIndex must backfill them
+	for i, city := range []string{"oslo", "rome", "oslo", "lima", "rome", "bern"} {
+		if err := users.Put(fmt.Sprintf("u%d", i), fmt.Sprintf("user%d,%s", i, city)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+
+	db := New(users)
+	cities, err := db.AddIndex("city", byCity)
+	if err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+	lookup := func(idx *Index, value string, want ...string) {
+		t.Helper()
+		got, err := idx.Lookup(value)
+		if err != nil {
+			t.Fatalf("lookup %q: %v", value, err)
+		}
+		if len(got) != len(want) || (len(want) > 0 && !reflect.DeepEqual(got, want)) {
+			t.Fatalf("lookup %q = %v, want %v", value, got, want)
+		}
+	}
+	lookup(cities, "oslo", "u0", "u2")
+	lookup(cities, "rome", "u1", "u4")
+	lookup(cities, "paris")
+
+	// Range covers [lima, rome) by index value
+	got, err := cities.Range("lima", "rome")
+	if err != nil || !reflect.DeepEqual(got, []string{"u3", "u0", "u2"}) {
+		t.Fatalf("range = %v, %v", got, err)
+	}
+
+	// Updates move the entry; deletes remove it
+	if err := db.Put("u0", "user0,rome"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := db.Delete("u4"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := db.Put("u9", "user9,bern"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	lookup(cities, "oslo", "u2")
+	lookup(cities, "rome", "u0", "u1")
+	lookup(cities, "bern", "u5", "u9")
+	if _, ok, _ := db.Get("u4"); ok {
+		t.Fatalf("u4 still present after delete")
+	}
+
+	// A multi-valued index returns a key once per range
+	tags, err := db.AddIndex("tags", byTag)
+	if err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+	if err := db.Put("u7", "a|b|b"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	lookup(tags, "b", "u7")
+	if got, _ := tags.Range("a", "c"); !reflect.DeepEqual(got, []string{"u7"}) {
+		t.Fatalf("tag range = %v", got)
+	}
+	if err := db.Put("u8", "x\x00y"); err != ErrInvalidIndexValue {
+		t.Fatalf("expected ErrInvalidIndexValue, got %v", err)
+	}
+	if _, ok, _ := db.Get("u8"); ok {
+		t.Fatalf("rejected write was applied")
+	}
+
+	// Indexes survive reopening without being rebuilt
+	if err := tree.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	tree, err = lsmtree.New(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tree.Close()
+	users, err = tree.ColumnFamily("users", lsmtree.ColumnFamilyOptions{})
+	if err != nil {
+		t.Fatalf("column family: %v", err)
+	}
+	db = New(users)
+	if cities, err = db.AddIndex("city", byCity); err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+	lookup(cities, "rome", "u0", "u1")
+	lookup(cities, "bern", "u5", "u9")
+
+	if err := db.DropIndex("city"); err != nil {
+		t.Fatalf("drop index: %v", err)
+	}
+	if db.Index("city") != nil {
+		t.Fatalf("dropped index still registered")
+	}
+}
+
+func TestAddIndexAfterInterruptedBackfill(t *testing.T) {
+	dir := "test_secondary_backfill_db"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	tree, err := lsmtree.New(dir, 4)
+	if err != nil {
+		t.Fatalf("new tree: %v", err)
+	}
+	for i, city := range []string{"oslo", "rome", "oslo"} {
+		if err := tree.Put(fmt.Sprintf("u%d", i), fmt.Sprintf("user%d,%s", i, city)); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	// A crash after AddIndex created the index family but before the
+	// backfill was written leaves the family empty
+	db := New(tree)
+	if _, err := tree.ColumnFamily(db.familyName("city"), lsmtree.ColumnFamilyOptions{}); err != nil {
+		t.Fatalf("column family: %v", err)
+	}
+	if err := tree.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	tree, err = lsmtree.New(dir, 4)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer tree.Close()
+	db = New(tree)
+	cities, err := db.AddIndex("city", byCity)
+	if err != nil {
+		t.Fatalf("add index: %v", err)
+	}
+	if got, err := cities.Lookup("oslo"); err != nil || !reflect.DeepEqual(got, []string{"u0", "u2"}) {
+		t.Fatalf("lookup = %v, %v", got, err)
+	}
+	if got, err := cities.Range("", ""); err != nil || len(got) != 3 {
+		t.Fatalf("range = %v, %v", got, err)
+	}
+}
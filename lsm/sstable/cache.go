@@ -0,0 +1,147 @@
+package sstable
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+)
+
+// TableCache keeps up to a fixed number of table files open so reads do
+// not reopen them. Least recently used files are closed first; a file in
+// use by a read is only closed once the read releases it, so the cache may
+// briefly hold more files than its capacity. It is safe for concurrent use
+// and can be shared by several tables and trees.
+type TableCache struct {
+	mu       sync.Mutex
+	capacity int
+	files    map[string]*cachedFile
+	lru      *list.List // of *cachedFile, most recently used first
+	hits     uint64
+	misses   uint64
+}
+
+// cachedFile is an open table file with the number of reads using it.
+type cachedFile struct {
+	path    string
+	f       *os.File
+	refs    int
+	elem    *list.Element // nil once evicted
+	evicted bool
+}
+
+// NewTableCache creates a cache of up to capacity open files.
+func NewTableCache(capacity int) *TableCache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &TableCache{
+		capacity: capacity,
+		files:    make(map[string]*cachedFile),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns the open file for path, opening it on a miss. The caller
+// must release it.
+func (c *TableCache) acquire(path string) (*cachedFile, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cf, ok := c.files[path]; ok {
+		c.hits++
+		cf.refs++
+		c.lru.MoveToFront(cf.elem)
+		return cf, nil
+	}
+	c.misses++
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	cf := &cachedFile{path: path, f: f, refs: 1}
+	cf.elem = c.lru.PushFront(cf)
+	c.files[path] = cf
+
+	// Close unused files beyond capacity, oldest first
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		prev := e.Prev()
+		if old := e.Value.(*cachedFile); old.refs == 0 {
+			c.remove(old)
+		}
+		e = prev
+	}
+	return cf, nil
+}
+
+// release returns a file obtained from acquire.
+func (c *TableCache) release(cf *cachedFile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cf.refs--
+	if cf.refs == 0 && (cf.evicted || c.lru.Len() > c.capacity) {
+		c.remove(cf)
+	}
+}
+
+// remove drops cf from the cache, closing it unless a read still uses it.
+func (c *TableCache) remove(cf *cachedFile) {
+	if cf.elem != nil {
+		c.lru.Remove(cf.elem)
+		cf.elem = nil
+		delete(c.files, cf.path)
+	}
+	cf.evicted = true
+	if cf.refs == 0 {
+		cf.f.Close()
+	}
+}
+
+// Evict closes the cached file for path, if any, once no read uses it.
+// Call it before deleting or replacing the file.
+func (c *TableCache) Evict(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cf, ok := c.files[path]; ok {
+		c.remove(cf)
+	}
+}
+
+// Len returns the number of open files.
+func (c *TableCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Stats returns the number of reads that found their file open and the
+// number that had to open it.
+func (c *TableCache) Stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// SetCache makes the table read its file through c. Pass nil to open the
+// file for every read.
+func (s *SSTable) SetCache(c *TableCache) {
+	s.cache.Store(c)
+}
+
+// open returns a reader over the table file and a function to call when
+// done with it.
+func (s *SSTable) open() (io.Reader, func(), error) {
+	if c := s.cache.Load(); c != nil {
+		cf, err := c.acquire(s.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		// ReadAt through a section reader is safe for concurrent reads
+		return io.NewSectionReader(cf.f, 0, 1<<62), func() { c.release(cf) }, nil
+	}
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
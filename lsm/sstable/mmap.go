@@ -0,0 +1,154 @@
+package sstable
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"lsm/memtable"
+)
+
+// mapping is a read-only memory mapping of a table file with the offsets of
+// its entry lines. It is reference counted: the table holds one reference
+// until Close, and every read holds one while it runs, so a table deleted
+// during a read stays mapped until the read is done.
+type mapping struct {
+	data    []byte
+	entries []int // start offset of each entry line
+	sorted  bool  // entries are in strictly increasing key order
+	refs    atomic.Int32
+}
+
+// Mmap maps the table file into memory. Lookups then binary search the
+// mapped entries in place instead of opening and scanning the file, and
+// Entries reads them without system calls. Platforms without mmap read the
+// file into memory instead. Call Close to release the mapping.
+func (s *SSTable) Mmap() error {
+	if s.mapped.Load() != nil {
+		return nil
+	}
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := mmapFile(f, int(info.Size()))
+	if err != nil {
+		return err
+	}
+
+	m := &mapping{data: data, sorted: true}
+	for off := 0; off < len(data); {
+		end := bytes.IndexByte(data[off:], '\n')
+		if end < 0 {
+			end = len(data) - off
+		}
+		if line := data[off : off+end]; !bytes.HasPrefix(line, []byte(metaPrefix)) && !bytes.HasPrefix(line, []byte(rangeDelPrefix)) {
+			if n := len(m.entries); n > 0 && bytes.Compare(lineKey(m.line(n-1)), lineKey(line)) >= 0 {
+				m.sorted = false // only files written outside a Writer
+			}
+			m.entries = append(m.entries, off)
+		}
+		off += end + 1
+	}
+	m.refs.Store(1)
+	if !s.mapped.CompareAndSwap(nil, m) {
+		munmapFile(data) // mapped concurrently
+	}
+	return nil
+}
+
+// Mapped reports whether reads are served from a memory mapping.
+func (s *SSTable) Mapped() bool {
+	return s.mapped.Load() != nil
+}
+
+// Close releases the table's memory mapping, if any, once no read uses it.
+// The table reads its file again afterwards.
+func (s *SSTable) Close() error {
+	if m := s.mapped.Swap(nil); m != nil {
+		m.release()
+	}
+	return nil
+}
+
+// acquire returns the table's mapping with a reference held for the
+// caller, or nil if the table is not mapped.
+func (s *SSTable) acquire() *mapping {
+	for {
+		m := s.mapped.Load()
+		if m == nil {
+			return nil
+		}
+		n := m.refs.Load()
+		if n == 0 {
+			return nil // released by Close
+		}
+		if m.refs.CompareAndSwap(n, n+1) {
+			return m
+		}
+	}
+}
+
+// release drops a reference, unmapping the file with the last one.
+func (m *mapping) release() {
+	if m.refs.Add(-1) == 0 {
+		munmapFile(m.data)
+		m.data, m.entries = nil, nil
+	}
+}
+
+// line returns entry line i, without its newline. It points into the
+// mapping and must be copied before the reference is released.
+func (m *mapping) line(i int) []byte {
+	start := m.entries[i]
+	end := bytes.IndexByte(m.data[start:], '\n')
+	if end < 0 {
+		return m.data[start:]
+	}
+	return m.data[start : start+end]
+}
+
+// lookup binary searches the entries for key, comparing keys in place.
+func (m *mapping) lookup(s *SSTable, key string) (memtable.KV, bool) {
+	k := []byte(key)
+	if !m.sorted {
+		for i := range m.entries {
+			if bytes.Equal(lineKey(m.line(i)), k) {
+				return s.parse(string(m.line(i)))
+			}
+		}
+		return memtable.KV{}, false
+	}
+	i := sort.Search(len(m.entries), func(i int) bool {
+		return bytes.Compare(lineKey(m.line(i)), k) >= 0
+	})
+	if i == len(m.entries) || !bytes.Equal(lineKey(m.line(i)), k) {
+		return memtable.KV{}, false
+	}
+	return s.parse(string(m.line(i)))
+}
+
+// all parses every entry.
+func (m *mapping) all(s *SSTable) []memtable.KV {
+	kvs := make([]memtable.KV, 0, len(m.entries))
+	for i := range m.entries {
+		if kv, ok := s.parse(string(m.line(i))); ok {
+			kvs = append(kvs, kv)
+		}
+	}
+	return kvs
+}
+
+// lineKey returns the key of an entry line: everything before the first tab.
+func lineKey(line []byte) []byte {
+	if i := bytes.IndexByte(line, '\t'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
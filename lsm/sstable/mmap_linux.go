@@ -0,0 +1,21 @@
+package sstable
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of f read-only.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// munmapFile unmaps data returned by mmapFile.
+func munmapFile(data []byte) {
+	if len(data) > 0 {
+		syscall.Munmap(data)
+	}
+}
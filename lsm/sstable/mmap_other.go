@@ -0,0 +1,18 @@
+//go:build !linux
+
+package sstable
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads f into memory where mmap is not supported.
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(f, data)
+	return data, err
+}
+
+// munmapFile releases data returned by mmapFile.
+func munmapFile(data []byte) {}
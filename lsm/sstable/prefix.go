@@ -0,0 +1,111 @@
+package sstable
+
+import (
+	"strings"
+
+	"lsm/bloom"
+)
+
+// PrefixExtractor maps keys to the prefix indexed by a table's prefix
+// filter, such as the "user:42:" part of "user:42:orders:7". A key that
+// starts with another key's prefix must have the same prefix.
+type PrefixExtractor interface {
+	// Name identifies the extractor.
+	Name() string
+	// Prefix returns the prefix of key, or false if key has none and is
+	// left out of the prefix filter.
+	Prefix(key string) (string, bool)
+}
+
+// FixedPrefix extracts the first N bytes of keys at least N bytes long.
+type FixedPrefix struct {
+	N int
+}
+
+// Name implements PrefixExtractor.
+func (p FixedPrefix) Name() string { return "fixed" }
+
+// Prefix implements PrefixExtractor.
+func (p FixedPrefix) Prefix(key string) (string, bool) {
+	if len(key) < p.N {
+		return "", false
+	}
+	return key[:p.N], true
+}
+
+// DelimitedPrefix extracts the first Fields fields of a key split by Sep,
+// including the trailing separator: with Sep ":" and Fields 2 the prefix of
+// "user:42:orders" is "user:42:". Keys with fewer fields have no prefix.
+type DelimitedPrefix struct {
+	Sep    string
+	Fields int
+}
+
+// Name implements PrefixExtractor.
+func (p DelimitedPrefix) Name() string { return "delimited" }
+
+// Prefix implements PrefixExtractor.
+func (p DelimitedPrefix) Prefix(key string) (string, bool) {
+	if p.Sep == "" || p.Fields < 1 {
+		return "", false
+	}
+	end := 0
+	for i := 0; i < p.Fields; i++ {
+		n := strings.Index(key[end:], p.Sep)
+		if n < 0 {
+			return "", false
+		}
+		end += n + len(p.Sep)
+	}
+	return key[:end], true
+}
+
+// buildPrefixFilter returns a filter over the prefixes of keys built with
+// policy, or nil without an extractor.
+func buildPrefixFilter(policy bloom.Policy, pe PrefixExtractor, keys []string) bloom.Filter {
+	if pe == nil {
+		return nil
+	}
+	var prefixes []string
+	for _, k := range keys {
+		if p, ok := pe.Prefix(k); ok && (len(prefixes) == 0 || prefixes[len(prefixes)-1] != p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	return buildFilter(policy, prefixes)
+}
+
+// SetPrefixExtractor rebuilds the table's prefix filter with pe. Prefix
+// filters are not stored in the file, so tables loaded from disk have none
+// until this is called. Pass nil to remove the filter.
+func (s *SSTable) SetPrefixExtractor(pe PrefixExtractor) error {
+	if pe == nil {
+		s.PrefixFilter, s.prefix = nil, nil
+		return nil
+	}
+	kvs, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(kvs))
+	for i, kv := range kvs {
+		keys[i] = kv.Key
+	}
+	s.PrefixFilter, s.prefix = buildPrefixFilter(s.policy, pe, keys), pe
+	return nil
+}
+
+// MayContainPrefix reports whether the table can hold keys starting with
+// prefix. Without a prefix filter, or for a prefix shorter than the ones
+// the extractor produces, it conservatively reports true.
+func (s *SSTable) MayContainPrefix(prefix string) bool {
+	if s.PrefixFilter == nil {
+		return true
+	}
+	// Every key starting with prefix shares its extracted prefix
+	p, ok := s.prefix.Prefix(prefix)
+	if !ok {
+		return true
+	}
+	return s.PrefixFilter.Contains(p)
+}
@@ -2,47 +2,125 @@ package sstable
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"lsm/bloom"
 	"lsm/memtable"
+	"lsm/ratelimit"
 )
 
+// metaPrefix marks the metadata footer line written after the entries.
+// Files without a footer use the original "key\tvalue" line format.
+const metaPrefix = "\x00meta\t"
+
+// rangeDelPrefix marks the lines of the range-del block, written between
+// the entries and the footer: start \t end \t seq \t timestamp.
+const rangeDelPrefix = "\x00rdel\t"
+
+// formatVersion is the entry line format written by New.
+//
+//	0: key \t timestamp \t value
+//	1: key \t timestamp \t kind \t value (merge records hold a JSON operand list,
+//	   tombstones an empty value, blob records a blob.Ref)
+const formatVersion = 1
+
+// Entry kinds as written in the kind column.
+const (
+	kindValue  = "v"
+	kindMerge  = "m"
+	kindDelete = "d"
+	kindBlob   = "b"
+)
+
+// Metadata describes a table and is stored in the file footer.
+type Metadata struct {
+	Version      int       // entry line format
+	Level        int       // LSM level the table belongs to; flushes land on level 0
+	CreatedAt    time.Time // when the table file was written
+	MinTimestamp time.Time // oldest entry write time
+	MaxTimestamp time.Time // newest entry write time
+	Entries      int       // number of entries in the table
+	MinSeq       uint64    // oldest sequence number of the writes in the table
+	MaxSeq       uint64    // newest sequence number of the writes in the table
+	RangeDels    int       // number of range tombstones in the range-del block
+	Filter       string    // name of the filter policy; empty for the default Bloom filter
+	SmallestKey  string    // first key in the table; empty if it has no entries
+	LargestKey   string    // last key in the table
+
+	// BlobFiles holds the bytes of values the table references in each
+	// blob file, by file number.
+	BlobFiles map[uint64]int64 `json:",omitempty"`
+}
+
 // SSTable represents an immutable sorted table on disk.
 type SSTable struct {
-	Path  string
-	Bloom *bloom.Bloom
+	Path   string
+	Size   int64        // file size in bytes
+	Filter bloom.Filter // whole-key filter built by the table's filter policy
+	Meta   Metadata
+
+	// RangeDels holds the table's range tombstones. They hide keys in older
+	// tables only; entries in the same table are always newer.
+	RangeDels []memtable.RangeTombstone
+
+	// PrefixFilter holds the key prefixes produced by the table's prefix
+	// extractor; nil without one.
+	PrefixFilter bloom.Filter
+
+	legacy bool                       // file has no footer and no per-entry timestamps
+	policy bloom.Policy               // built Filter and PrefixFilter
+	prefix PrefixExtractor            // built PrefixFilter
+	mapped atomic.Pointer[mapping]    // set by Mmap
+	cache  atomic.Pointer[TableCache] // set by SetCache
+}
+
+// Options controls how a table is written.
+type Options struct {
+	Level  int    // level recorded in the table metadata
+	MinSeq uint64 // sequence range of the writes in the table
+	MaxSeq uint64
+
+	// PrefixExtractor, if set, builds a prefix filter alongside the
+	// whole-key one.
+	PrefixExtractor PrefixExtractor
+
+	// Filter chooses the filter implementation. It is recorded in the
+	// metadata so Load rebuilds the same kind; nil uses a Bloom filter with
+	// 8 bits per key and 3 hash functions.
+	Filter bloom.Policy
+
+	// RateLimiter, if set, paces the file writes.
+	RateLimiter *ratelimit.Limiter
 }
 
-// New writes kvs to path and builds a Bloom filter.
+// New writes kvs to path as a level 0 table and builds its filter.
 func New(path string, kvs []memtable.KV) (*SSTable, error) {
-	f, err := os.Create(path)
+	return NewWithOptions(path, kvs, Options{})
+}
+
+// NewWithOptions writes kvs to path using opts and builds its filter.
+// kvs must be sorted by key.
+func NewWithOptions(path string, kvs []memtable.KV, opts Options) (*SSTable, error) {
+	w, err := NewWriter(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
-	bw := bufio.NewWriter(f)
 	for _, kv := range kvs {
-		line := fmt.Sprintf("%s\t%s\n", kv.Key, kv.Value)
-		if _, err := bw.WriteString(line); err != nil {
+		if err := w.AddEntry(kv); err != nil {
+			w.Abort()
 			return nil, err
 		}
 	}
-	if err := bw.Flush(); err != nil {
-		return nil, err
-	}
-
-	bl := bloom.New(uint(len(kvs)*8+1), 3)
-	for _, kv := range kvs {
-		bl.Add(kv.Key)
-	}
-	return &SSTable{Path: path, Bloom: bl}, nil
+	return w.Finish()
 }
 
-// Load opens an existing table and rebuilds its Bloom filter.
+// Load opens an existing table, reads its metadata and rebuilds its filter.
 func Load(path string) (*SSTable, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -50,51 +128,262 @@ func Load(path string) (*SSTable, error) {
 	}
 	defer f.Close()
 
+	s := &SSTable{Path: path}
+	var keys []string
+	var footer string
 	scanner := bufio.NewScanner(f)
-	var count int
 	for scanner.Scan() {
-		count++
+		line := scanner.Text()
+		if strings.HasPrefix(line, metaPrefix) {
+			footer = strings.TrimPrefix(line, metaPrefix)
+			continue
+		}
+		if strings.HasPrefix(line, rangeDelPrefix) {
+			rt, err := parseRangeDel(line)
+			if err != nil {
+				return nil, fmt.Errorf("sstable %s: %w", path, err)
+			}
+			s.RangeDels = append(s.RangeDels, rt)
+			continue
+		}
+		keys = append(keys, strings.SplitN(line, "\t", 2)[0])
 	}
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
-	bl := bloom.New(uint(count*8+1), 3)
-	// second pass to add keys
-	if _, err := f.Seek(0, 0); err != nil {
+	info, err := f.Stat()
+	if err != nil {
 		return nil, err
 	}
-	scanner = bufio.NewScanner(f)
-	for scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), "\t", 2)
-		if len(parts) >= 1 {
-			bl.Add(parts[0])
+	s.Size = info.Size()
+
+	if footer != "" {
+		if err := json.Unmarshal([]byte(footer), &s.Meta); err != nil {
+			return nil, fmt.Errorf("sstable %s: bad footer: %w", path, err)
+		}
+	} else {
+		// Tables written before metadata existed only have the file's
+		// modification time to go on.
+		s.legacy = true
+		s.Meta = Metadata{
+			CreatedAt:    info.ModTime(),
+			MinTimestamp: info.ModTime(),
+			MaxTimestamp: info.ModTime(),
+			Entries:      len(keys),
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+
+	if len(keys) > 0 && s.Meta.SmallestKey == "" && s.Meta.LargestKey == "" {
+		// Footers written before key ranges were recorded
+		s.Meta.SmallestKey, s.Meta.LargestKey = keys[0], keys[len(keys)-1]
+	}
+
+	policy, err := bloom.ParsePolicy(s.Meta.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("sstable %s: %w", path, err)
 	}
+	s.policy = policy
+	s.Filter = buildFilter(policy, keys)
+	return s, nil
+}
 
-	return &SSTable{Path: path, Bloom: bl}, nil
+// buildFilter builds a filter over keys with policy, or the default Bloom
+// filter if policy is nil.
+func buildFilter(policy bloom.Policy, keys []string) bloom.Filter {
+	if policy != nil {
+		return policy.Build(keys)
+	}
+	b := bloom.New(uint(len(keys)*8+1), 3)
+	for _, k := range keys {
+		b.Add(k)
+	}
+	return b
 }
 
-// Get searches for key in the SSTable.
+// Get searches for the value stored for key in the SSTable. Merge records
+// and tombstones are not values and are only reported by Lookup.
 func (s *SSTable) Get(key string) (string, bool, error) {
-	if !s.Bloom.Contains(key) {
-		return "", false, nil
+	kv, ok, err := s.Lookup(key)
+	if err != nil || !ok || kv.Kind != memtable.KindValue {
+		return "", false, err
+	}
+	return kv.Value, true, nil
+}
+
+// Lookup returns the record stored for key, which may be a merge record or
+// a tombstone.
+func (s *SSTable) Lookup(key string) (memtable.KV, bool, error) {
+	if !s.Filter.Contains(key) {
+		return memtable.KV{}, false, nil
+	}
+	if m := s.acquire(); m != nil {
+		defer m.release()
+		kv, ok := m.lookup(s, key)
+		return kv, ok, nil
 	}
-	f, err := os.Open(s.Path)
+	r, done, err := s.open()
 	if err != nil {
-		return "", false, err
+		return memtable.KV{}, false, err
 	}
-	defer f.Close()
+	defer done()
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		parts := strings.SplitN(scanner.Text(), "\t", 2)
-		if len(parts) == 2 && parts[0] == key {
-			return parts[1], true, nil
+		kv, ok := s.parse(scanner.Text())
+		if ok && kv.Key == key {
+			return kv, true, nil
 		}
 	}
-	return "", false, scanner.Err()
+	return memtable.KV{}, false, scanner.Err()
+}
+
+// Entries reads every key-value pair stored in the table in key order.
+func (s *SSTable) Entries() ([]memtable.KV, error) {
+	if m := s.acquire(); m != nil {
+		defer m.release()
+		return m.all(s), nil
+	}
+	r, done, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	var kvs []memtable.KV
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if kv, ok := s.parse(scanner.Text()); ok {
+			kvs = append(kvs, kv)
+		}
+	}
+	return kvs, scanner.Err()
+}
+
+// encode formats kv as an entry line in the current format.
+func encode(kv memtable.KV) (string, error) {
+	switch kv.Kind {
+	case memtable.KindValue:
+		if len(kv.Operands) > 0 {
+			return "", fmt.Errorf("sstable: key %q has unresolved merge operands", kv.Key)
+		}
+		return fmt.Sprintf("%s\t%d\t%s\t%s\n", kv.Key, kv.Timestamp, kindValue, kv.Value), nil
+	case memtable.KindMerge:
+		ops, err := json.Marshal(kv.Operands)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s\t%d\t%s\t%s\n", kv.Key, kv.Timestamp, kindMerge, ops), nil
+	case memtable.KindDelete:
+		return fmt.Sprintf("%s\t%d\t%s\t\n", kv.Key, kv.Timestamp, kindDelete), nil
+	case memtable.KindBlob:
+		return fmt.Sprintf("%s\t%d\t%s\t%s\n", kv.Key, kv.Timestamp, kindBlob, kv.Value), nil
+	}
+	return "", fmt.Errorf("sstable: unknown entry kind %d", kv.Kind)
+}
+
+// encodeRangeDel formats a line of the range-del block.
+func encodeRangeDel(rt memtable.RangeTombstone) string {
+	return fmt.Sprintf("%s%s\t%s\t%d\t%d\n", rangeDelPrefix, rt.Start, rt.End, rt.Seq, rt.Timestamp)
+}
+
+// parseRangeDel decodes a line of the range-del block.
+func parseRangeDel(line string) (memtable.RangeTombstone, error) {
+	parts := strings.Split(strings.TrimPrefix(line, rangeDelPrefix), "\t")
+	if len(parts) != 4 {
+		return memtable.RangeTombstone{}, fmt.Errorf("bad range tombstone %q", line)
+	}
+	seq, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return memtable.RangeTombstone{}, fmt.Errorf("bad range tombstone %q: %w", line, err)
+	}
+	ts, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return memtable.RangeTombstone{}, fmt.Errorf("bad range tombstone %q: %w", line, err)
+	}
+	return memtable.RangeTombstone{Start: parts[0], End: parts[1], Seq: seq, Timestamp: ts}, nil
+}
+
+// parse decodes one entry line, reporting false for the footer, the
+// range-del block and malformed lines.
+func (s *SSTable) parse(line string) (memtable.KV, bool) {
+	if strings.HasPrefix(line, metaPrefix) || strings.HasPrefix(line, rangeDelPrefix) {
+		return memtable.KV{}, false
+	}
+	if s.legacy {
+		parts := strings.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			return memtable.KV{}, false
+		}
+		return memtable.KV{Key: parts[0], Value: parts[1], Timestamp: s.Meta.MaxTimestamp.UnixNano()}, true
+	}
+	if s.Meta.Version == 0 {
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			return memtable.KV{}, false
+		}
+		ts, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return memtable.KV{}, false
+		}
+		return memtable.KV{Key: parts[0], Value: parts[2], Timestamp: ts}, true
+	}
+	parts := strings.SplitN(line, "\t", 4)
+	if len(parts) != 4 {
+		return memtable.KV{}, false
+	}
+	ts, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return memtable.KV{}, false
+	}
+	kv := memtable.KV{Key: parts[0], Timestamp: ts}
+	switch parts[2] {
+	case kindValue:
+		kv.Value = parts[3]
+	case kindMerge:
+		kv.Kind = memtable.KindMerge
+		if err := json.Unmarshal([]byte(parts[3]), &kv.Operands); err != nil {
+			return memtable.KV{}, false
+		}
+	case kindDelete:
+		kv.Kind = memtable.KindDelete
+	case kindBlob:
+		kv.Kind = memtable.KindBlob
+		kv.Value = parts[3]
+	default:
+		return memtable.KV{}, false
+	}
+	return kv, true
+}
+
+// MayContainKey reports whether key lies within the table's smallest and
+// largest key. Range tombstones are not considered.
+func (s *SSTable) MayContainKey(key string) bool {
+	return s.Meta.Entries > 0 && key >= s.Meta.SmallestKey && key <= s.Meta.LargestKey
+}
+
+// KeyRange returns the smallest and largest key the table has data for,
+// including the extent of its range tombstones, whose exclusive ends are
+// treated as inclusive. ok is false for a table without data.
+func (s *SSTable) KeyRange() (smallest, largest string, ok bool) {
+	if s.Meta.Entries > 0 {
+		smallest, largest, ok = s.Meta.SmallestKey, s.Meta.LargestKey, true
+	}
+	for _, rt := range s.RangeDels {
+		if !ok || rt.Start < smallest {
+			smallest = rt.Start
+		}
+		if !ok || rt.End > largest {
+			largest = rt.End
+		}
+		ok = true
+	}
+	return smallest, largest, ok
+}
+
+// Overlaps reports whether the table has data within [smallest, largest].
+// An empty largest means no upper bound.
+func (s *SSTable) Overlaps(smallest, largest string) bool {
+	min, max, ok := s.KeyRange()
+	return ok && max >= smallest && (largest == "" || min <= largest)
 }
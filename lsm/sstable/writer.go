@@ -0,0 +1,174 @@
+package sstable
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"lsm/blob"
+	"lsm/bloom"
+	"lsm/memtable"
+)
+
+// Writer builds a table file one entry at a time, outside of any tree. Keys
+// must be added in strictly increasing order. The finished file can be
+// loaded with Load or ingested into a tree with IngestExternalFiles.
+type Writer struct {
+	path string
+	f    *os.File
+	bw   *bufio.Writer
+	meta Metadata
+	keys []string
+
+	policy    bloom.Policy
+	prefix    PrefixExtractor
+	rangeDels []memtable.RangeTombstone
+}
+
+// NewWriter creates the table file at path.
+func NewWriter(path string, opts Options) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var filter string
+	if opts.Filter != nil {
+		filter = opts.Filter.Name()
+	}
+	var out io.Writer = f
+	if opts.RateLimiter != nil {
+		out = opts.RateLimiter.Writer(f)
+	}
+	return &Writer{
+		path:   path,
+		f:      f,
+		bw:     bufio.NewWriter(out),
+		policy: opts.Filter,
+		prefix: opts.PrefixExtractor,
+		meta: Metadata{
+			Version: formatVersion,
+			Level:   opts.Level,
+			MinSeq:  opts.MinSeq,
+			MaxSeq:  opts.MaxSeq,
+			Filter:  filter,
+		},
+	}, nil
+}
+
+// Add appends a value for key, stamped with the current time.
+func (w *Writer) Add(key, value string) error {
+	return w.AddEntry(memtable.KV{Key: key, Value: value, Timestamp: time.Now().UnixNano()})
+}
+
+// AddEntry appends kv, which may also be a merge record, a tombstone or a
+// blob reference.
+func (w *Writer) AddEntry(kv memtable.KV) error {
+	if n := len(w.keys); n > 0 && kv.Key <= w.keys[n-1] {
+		return fmt.Errorf("sstable: key %q added after %q; keys must be strictly increasing", kv.Key, w.keys[n-1])
+	}
+	line, err := encode(kv)
+	if err != nil {
+		return err
+	}
+	if kv.Kind == memtable.KindBlob {
+		ref, err := blob.ParseRef(kv.Value)
+		if err != nil {
+			return err
+		}
+		if w.meta.BlobFiles == nil {
+			w.meta.BlobFiles = make(map[uint64]int64)
+		}
+		w.meta.BlobFiles[ref.File] += int64(ref.Size)
+	}
+	if _, err := w.bw.WriteString(line); err != nil {
+		return err
+	}
+
+	w.stamp(kv.Timestamp)
+	w.keys = append(w.keys, kv.Key)
+	return nil
+}
+
+// stamp widens the table's time range to include ts.
+func (w *Writer) stamp(ts int64) {
+	t := time.Unix(0, ts)
+	first := len(w.keys) == 0 && len(w.rangeDels) == 0
+	if first || t.Before(w.meta.MinTimestamp) {
+		w.meta.MinTimestamp = t
+	}
+	if first || t.After(w.meta.MaxTimestamp) {
+		w.meta.MaxTimestamp = t
+	}
+}
+
+// AddRangeTombstone adds rt to the table's range-del block. It hides keys
+// in older tables, never entries of this table.
+func (w *Writer) AddRangeTombstone(rt memtable.RangeTombstone) {
+	w.stamp(rt.Timestamp)
+	w.rangeDels = append(w.rangeDels, rt)
+}
+
+// Finish writes the range-del block and metadata footer, closes the file
+// and returns the table.
+func (w *Writer) Finish() (*SSTable, error) {
+	w.meta.CreatedAt = time.Now()
+	w.meta.Entries = len(w.keys)
+	w.meta.RangeDels = len(w.rangeDels)
+	if n := len(w.keys); n > 0 {
+		w.meta.SmallestKey, w.meta.LargestKey = w.keys[0], w.keys[n-1]
+	}
+	if len(w.keys) == 0 && len(w.rangeDels) == 0 {
+		w.meta.MinTimestamp = w.meta.CreatedAt
+		w.meta.MaxTimestamp = w.meta.CreatedAt
+	}
+
+	for _, rt := range w.rangeDels {
+		if _, err := w.bw.WriteString(encodeRangeDel(rt)); err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+
+	footer, err := json.Marshal(w.meta)
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if _, err := w.bw.WriteString(metaPrefix + string(footer) + "\n"); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := w.bw.Flush(); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	info, err := w.f.Stat()
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.path)
+		return nil, err
+	}
+
+	return &SSTable{
+		Path:         w.path,
+		Size:         info.Size(),
+		Filter:       buildFilter(w.policy, w.keys),
+		Meta:         w.meta,
+		RangeDels:    w.rangeDels,
+		PrefixFilter: buildPrefixFilter(w.policy, w.prefix, w.keys),
+		policy:       w.policy,
+		prefix:       w.prefix,
+	}, nil
+}
+
+// Abort closes and removes the partially written file.
+func (w *Writer) Abort() {
+	w.f.Close()
+	os.Remove(w.path)
+}
@@ -0,0 +1,308 @@
+// Package wal implements the write-ahead log that makes memtable contents
+// durable until they are flushed to an SSTable.
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Op identifies the kind of mutation in a record.
+type Op string
+
+const (
+	OpPut         Op = "p"
+	OpMerge       Op = "m"
+	OpDeleteRange Op = "r"
+
+	// OpIngest records tables added to the tree directly. It changes no
+	// memtable; Key and Value are the smallest and largest key ingested.
+	OpIngest Op = "i"
+
+	// opBatch heads a group of records that Replay delivers all or none
+	// of. Its Value is the number of records in the group.
+	opBatch Op = "b"
+)
+
+// Record is a single logged mutation.
+type Record struct {
+	Seq       uint64 // sequence number assigned by the tree
+	Op        Op
+	Key       string
+	Value     string // value for OpPut, operand for OpMerge, range end for OpDeleteRange, largest key for OpIngest
+	Timestamp int64  // write time in Unix nanoseconds
+	Family    string // column family; empty for the default one
+}
+
+// Log appends records to a file, one line per record:
+//
+//	seq \t op[:family] \t timestamp \t key \t value
+type Log struct {
+	Path string
+	f    *os.File
+	w    *bufio.Writer
+}
+
+// Open opens the log at path for appending, creating it if needed. A torn
+// tail left by a crash is cut off first, so new records do not run into it.
+func Open(path string) (*Log, error) {
+	valid, err := scan(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err != nil || stat.Size() > valid {
+		if err == nil {
+			err = f.Truncate(valid)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return &Log{Path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+// Append writes r and hands it to the operating system. Use Sync to force
+// it to stable storage.
+func (l *Log) Append(r Record) error {
+	if _, err := l.w.WriteString(format(r)); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+// AppendBatch writes rs as one group: after a crash Replay returns either
+// every record of the group or none of them.
+func (l *Log) AppendBatch(rs []Record) error {
+	if len(rs) == 0 {
+		return nil
+	}
+	if _, err := l.w.WriteString(formatBatch(rs)); err != nil {
+		return err
+	}
+	return l.w.Flush()
+}
+
+// formatBatch formats rs as a group, or as a plain record if it is alone.
+func formatBatch(rs []Record) string {
+	if len(rs) == 1 {
+		return format(rs[0])
+	}
+	var b strings.Builder
+	b.WriteString(format(Record{Seq: rs[0].Seq, Op: opBatch, Timestamp: rs[0].Timestamp, Value: strconv.Itoa(len(rs))}))
+	for _, r := range rs {
+		b.WriteString(format(r))
+	}
+	return b.String()
+}
+
+func format(r Record) string {
+	op := string(r.Op)
+	if r.Family != "" {
+		op += ":" + r.Family
+	}
+	return fmt.Sprintf("%d\t%s\t%d\t%s\t%s\n", r.Seq, op, r.Timestamp, r.Key, r.Value)
+}
+
+// Sync flushes the log to stable storage.
+func (l *Log) Sync() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+// Reset discards all records, typically after the memtable was flushed.
+func (l *Log) Reset() error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	return l.f.Truncate(0)
+}
+
+// Rewrite replaces the log with the records for which keep reports true,
+// typically to drop records already flushed while others are not. Kept
+// records of a batch stay grouped.
+func (l *Log) Rewrite(keep func(Record) bool) error {
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	var kept [][]Record
+	err := ReplayBatches(l.Path, func(batch []Record) error {
+		var group []Record
+		for _, r := range batch {
+			if keep(r) {
+				group = append(group, r)
+			}
+		}
+		if len(group) > 0 {
+			kept = append(kept, group)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := l.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, group := range kept {
+		if _, err := w.WriteString(formatBatch(group)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.Path); err != nil {
+		return err
+	}
+
+	f, err = os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.f.Close()
+	l.f, l.w = f, bufio.NewWriter(f)
+	return nil
+}
+
+// Archive keeps the log's current records in a new file at dst, then
+// rewrites the log like Rewrite. The archive is a hard link to the old log
+// file, which Rewrite replaces rather than modifies, so nothing is copied.
+func (l *Log) Archive(dst string, keep func(Record) bool) error {
+	if err := l.Sync(); err != nil {
+		return err
+	}
+	if err := os.Link(l.Path, dst); err != nil {
+		return err
+	}
+	return l.Rewrite(keep)
+}
+
+// Close flushes and closes the log file.
+func (l *Log) Close() error {
+	if err := l.w.Flush(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+// Replay calls fn for every record in the log at path, oldest first. A
+// missing log has no records. A torn final line left by a crash is ignored,
+// as is a batch that was not completely written.
+func Replay(path string, fn func(Record) error) error {
+	_, err := scan(path, func(batch []Record) error {
+		for _, r := range batch {
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// ReplayBatches is Replay calling fn once for all records of a batch, and
+// once for each record written alone. fn must not keep the slice.
+func ReplayBatches(path string, fn func([]Record) error) error {
+	_, err := scan(path, fn)
+	return err
+}
+
+// scan calls fn, if not nil, for every complete record or batch in the log
+// at path and returns the length of the log up to the last one.
+func scan(path string, fn func([]Record) error) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	var offset, valid int64
+	var batch []Record
+	pending := 0 // records of the current batch still to read
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return valid, nil // a torn final line has no newline
+		}
+		if err != nil {
+			return valid, err
+		}
+		offset += int64(len(line))
+
+		r, ok := parse(strings.TrimSuffix(line, "\n"))
+		switch {
+		case !ok:
+			continue
+		case r.Op == opBatch:
+			n, err := strconv.Atoi(r.Value)
+			if err != nil || n < 1 {
+				continue
+			}
+			batch, pending = batch[:0], n
+			continue
+		case pending > 0:
+			batch = append(batch, r)
+			if pending--; pending > 0 {
+				continue
+			}
+		default:
+			batch = append(batch[:0], r)
+		}
+		valid = offset
+		if fn == nil {
+			continue
+		}
+		if err := fn(batch); err != nil {
+			return valid, err
+		}
+	}
+}
+
+func parse(line string) (Record, bool) {
+	parts := strings.SplitN(line, "\t", 5)
+	if len(parts) != 5 {
+		return Record{}, false
+	}
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Record{}, false
+	}
+	ts, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return Record{}, false
+	}
+	op, family, _ := strings.Cut(parts[1], ":")
+	r := Record{Seq: seq, Op: Op(op), Timestamp: ts, Key: parts[3], Value: parts[4], Family: family}
+	if r.Op != OpPut && r.Op != OpMerge && r.Op != OpDeleteRange && r.Op != OpIngest && r.Op != opBatch {
+		return Record{}, false
+	}
+	return r, true
+}
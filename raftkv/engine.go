@@ -0,0 +1,127 @@
+package raftkv
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"btree"
+	"lsm/lsmtree"
+)
+
+// Engine is the state machine a node applies committed commands to. The
+// repository's storage engines are adapted to it by OpenLSM and OpenBTree.
+type Engine interface {
+	Get(key string) (string, bool, error)
+	Put(key, value string) error
+	Delete(key string) error
+
+	// Checkpoint writes a consistent copy of the data to dir, which must
+	// not exist and can be opened by the engine's Opener.
+	Checkpoint(dir string) error
+	Close() error
+}
+
+// Opener opens the engine whose files are in dir, creating it if needed.
+type Opener func(dir string) (Engine, error)
+
+// OpenLSM opens an LSM tree with the given memtable flush threshold.
+func OpenLSM(threshold int) Opener {
+	return func(dir string) (Engine, error) {
+		t, err := lsmtree.New(dir, threshold)
+		if err != nil {
+			return nil, err
+		}
+		return lsmEngine{t}, nil
+	}
+}
+
+type lsmEngine struct {
+	*lsmtree.LSMTree
+}
+
+// Delete deletes key as the range holding only key.
+func (e lsmEngine) Delete(key string) error {
+	return e.DeleteRange(key, key+"\x00")
+}
+
+// btreeFile is the B-tree's file inside the engine directory.
+const btreeFile = "btree.gob"
+
+// OpenBTree opens a B-tree of the given order.
+func OpenBTree(order int) Opener {
+	return func(dir string) (Engine, error) {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dir, btreeFile)
+		e, err := btree.Open(path, order)
+		if err != nil {
+			return nil, err
+		}
+		return &btreeEngine{Engine: e, path: path}, nil
+	}
+}
+
+type btreeEngine struct {
+	*btree.Engine
+	path string
+}
+
+// Checkpoint copies the tree's file, which every write saves in full.
+func (e *btreeEngine) Checkpoint(dir string) error {
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(e.path); os.IsNotExist(err) {
+		return nil // nothing written yet
+	}
+	return copyFile(e.path, filepath.Join(dir, btreeFile))
+}
+
+func (e *btreeEngine) Close() error {
+	return nil
+}
+
+// copyFile copies src to dst and syncs it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyDir copies the files of src into dst, which is created.
+func copyDir(src, dst string) error {
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+module raftkv
+
+go 1.23.8
+
+require (
+    lsm v0.0.0
+    btree v0.0.0
+)
+
+replace lsm => ../lsm
+replace btree => ../btree
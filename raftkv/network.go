@@ -0,0 +1,130 @@
+package raftkv
+
+import (
+	"math/rand"
+	"slices"
+)
+
+// Network connects nodes in memory and delivers their messages one tick
+// later. It simulates partitions and message loss from a seeded source of
+// randomness, so a run with the same seed and calls is reproducible.
+type Network struct {
+	nodes    map[uint64]*Node
+	group    map[uint64]int // partition of each node; nodes not listed are in group 0
+	dropRate float64
+	rand     *rand.Rand
+	queue    []Message // sent during the last tick
+}
+
+// NewNetwork returns an empty network.
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		nodes: make(map[uint64]*Node),
+		group: make(map[uint64]int),
+		rand:  rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Add connects n to the network.
+func (net *Network) Add(n *Node) {
+	net.nodes[n.id] = n
+}
+
+// Remove disconnects node id, as if it crashed, and returns it. Messages
+// to it are dropped until it is added again.
+func (net *Network) Remove(id uint64) *Node {
+	n := net.nodes[id]
+	delete(net.nodes, id)
+	return n
+}
+
+// Node returns node id, or nil if it is not connected.
+func (net *Network) Node(id uint64) *Node {
+	return net.nodes[id]
+}
+
+// ids returns the IDs of the connected nodes in order.
+func (net *Network) ids() []uint64 {
+	ids := make([]uint64, 0, len(net.nodes))
+	for id := range net.nodes {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Partition splits the network so that only nodes of the same group can
+// talk. Nodes in no group form a group of their own.
+func (net *Network) Partition(groups ...[]uint64) {
+	clear(net.group)
+	for i, group := range groups {
+		for _, id := range group {
+			net.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes any partition.
+func (net *Network) Heal() {
+	clear(net.group)
+}
+
+// SetDropRate makes the network lose each message with probability p.
+func (net *Network) SetDropRate(p float64) {
+	net.dropRate = p
+}
+
+// Tick delivers the messages sent during the previous tick, then ticks
+// every node, in order of ID.
+func (net *Network) Tick() error {
+	queue := net.queue
+	net.queue = nil
+	for _, m := range queue {
+		n := net.nodes[m.To]
+		if n == nil || net.group[m.From] != net.group[m.To] {
+			continue
+		}
+		if net.dropRate > 0 && net.rand.Float64() < net.dropRate {
+			continue
+		}
+		if err := n.Step(m); err != nil {
+			return err
+		}
+	}
+	for _, id := range net.ids() {
+		if err := net.nodes[id].Tick(); err != nil {
+			return err
+		}
+	}
+	for _, id := range net.ids() {
+		net.queue = append(net.queue, net.nodes[id].Messages()...)
+	}
+	return nil
+}
+
+// RunUntil ticks until cond returns true, and reports whether it did
+// within maxTicks.
+func (net *Network) RunUntil(maxTicks int, cond func() bool) (bool, error) {
+	for range maxTicks {
+		if cond() {
+			return true, nil
+		}
+		if err := net.Tick(); err != nil {
+			return false, err
+		}
+	}
+	return cond(), nil
+}
+
+// Leader returns the connected leader of the highest term, or nil.
+func (net *Network) Leader() *Node {
+	var leader *Node
+	var term uint64
+	for _, id := range net.ids() {
+		n := net.nodes[id]
+		if s := n.Status(); s.State == StateLeader && s.Term >= term {
+			leader, term = n, s.Term
+		}
+	}
+	return leader
+}
@@ -0,0 +1,797 @@
+// Package raftkv is a key-value store replicated with the Raft consensus
+// algorithm, on top of any Engine: an LSM tree or a B-tree.
+//
+// A Node is a deterministic state machine driven from outside: Tick
+// advances its logical clock, Step hands it a message and Messages returns
+// the messages it wants sent. Nodes never talk to a network themselves, so
+// the in-memory Network can run a whole cluster reproducibly, with
+// partitions and message loss.
+//
+// Nodes implement leader election, log replication, snapshots taken as
+// engine checkpoints and sent to followers that fall behind the log, and
+// membership changes of one server at a time. A node ignores vote requests
+// within an election timeout of hearing from its leader, and a leader steps
+// down when it has not heard from a quorum for that long, so members
+// removed without learning of it cannot disrupt the cluster.
+package raftkv
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+var (
+	// ErrNotLeader is returned for proposals to a node that is not the
+	// leader. Status reports the leader the node knows of, if any.
+	ErrNotLeader = errors.New("raftkv: not the leader")
+
+	// ErrConfigChangePending is returned for a membership change while an
+	// earlier one is not committed yet.
+	ErrConfigChangePending = errors.New("raftkv: membership change in progress")
+)
+
+// maxAppendEntries bounds the entries sent in one append message.
+const maxAppendEntries = 64
+
+// Config configures a Node.
+type Config struct {
+	ID    uint64   // non-zero and unique in the cluster
+	Peers []uint64 // initial members, including ID, when Dir holds no state; empty for a node added later
+	Dir   string   // the node's files
+	Open  Opener   // opens the engine holding the replicated data
+
+	ElectionTicks   int   // ticks without hearing from a leader before campaigning (default 10)
+	HeartbeatTicks  int   // ticks between leader heartbeats (default 1)
+	SnapshotEntries int   // applied entries between snapshots (default 1000)
+	Seed            int64 // randomizes election timeouts reproducibly
+}
+
+// StateType is the role of a node.
+type StateType string
+
+const (
+	StateFollower  StateType = "follower"
+	StateCandidate StateType = "candidate"
+	StateLeader    StateType = "leader"
+)
+
+// Command is a write to the engine.
+type Command struct {
+	Op    string `json:"op"` // "put" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// MessageType is the kind of a Message.
+type MessageType string
+
+const (
+	MsgVote     MessageType = "vote"      // candidate asks for a vote
+	MsgVoteResp MessageType = "vote_resp" // vote granted unless Reject
+	MsgApp      MessageType = "append"    // leader sends entries, or a heartbeat without any
+	MsgAppResp  MessageType = "append_resp"
+	MsgSnap     MessageType = "snapshot" // leader sends its snapshot
+)
+
+// Message is exchanged between nodes.
+type Message struct {
+	Type MessageType
+	From uint64
+	To   uint64
+	Term uint64
+
+	// Vote: the candidate's last entry. Append: the entry preceding
+	// Entries.
+	LogIndex uint64
+	LogTerm  uint64
+	Entries  []Entry
+	Commit   uint64
+
+	Reject bool
+	Hint   uint64 // append response: last index matching the leader, or to retry from on Reject
+
+	Snapshot *Snapshot
+}
+
+// Snapshot is the state of the engine up to Index, with its files.
+type Snapshot struct {
+	Index   uint64
+	Term    uint64
+	Members []uint64
+	Files   map[string][]byte
+}
+
+// Status describes a node.
+type Status struct {
+	ID            uint64
+	State         StateType
+	Term          uint64
+	Leader        uint64 // 0 if unknown
+	Commit        uint64
+	Applied       uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	Members       []uint64
+}
+
+// Node is a member of a Raft cluster. Its methods are safe for concurrent
+// use.
+type Node struct {
+	mu     sync.Mutex
+	id     uint64
+	cfg    Config
+	store  *storage
+	engine Engine
+	rand   *rand.Rand
+
+	state   StateType
+	leader  uint64
+	members []uint64 // in effect: those of the last configuration entry in the log
+	commit  uint64
+	applied uint64
+
+	electionElapsed  int
+	heartbeatElapsed int
+	timeout          int // randomized election timeout
+
+	votes  map[uint64]bool   // candidate: responses by member
+	next   map[uint64]uint64 // leader: next entry to send, by member
+	match  map[uint64]uint64 // leader: last entry known replicated, by member
+	active map[uint64]bool   // leader: members heard from this election timeout
+
+	msgs []Message // outgoing, until Messages
+}
+
+// NewNode starts a node from the state in cfg.Dir. Its engine is rebuilt
+// from the latest snapshot; later entries are applied again once the node
+// learns they are committed.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == 0 {
+		return nil, errors.New("raftkv: node ID must not be 0")
+	}
+	if cfg.ElectionTicks <= 0 {
+		cfg.ElectionTicks = 10
+	}
+	if cfg.HeartbeatTicks <= 0 {
+		cfg.HeartbeatTicks = 1
+	}
+	if cfg.SnapshotEntries <= 0 {
+		cfg.SnapshotEntries = 1000
+	}
+	store, err := openStorage(cfg.Dir, cfg.Peers)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		id:    cfg.ID,
+		cfg:   cfg,
+		store: store,
+		rand:  rand.New(rand.NewSource(cfg.Seed + int64(cfg.ID))),
+	}
+	if err := n.restore(); err != nil {
+		store.close()
+		return nil, err
+	}
+	n.commit, n.applied = store.snap.Index, store.snap.Index
+	n.members = store.membersAt(store.lastIndex())
+	if err := n.becomeFollower(store.hard.Term, 0); err != nil {
+		n.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// restore replaces the engine's data with the snapshot's.
+func (n *Node) restore() error {
+	if n.engine != nil {
+		if err := n.engine.Close(); err != nil {
+			return err
+		}
+		n.engine = nil
+	}
+	data := filepath.Join(n.cfg.Dir, dataName)
+	if err := os.RemoveAll(data); err != nil {
+		return err
+	}
+	if dir := n.store.snap.Dir; dir != "" {
+		if err := copyDir(filepath.Join(n.cfg.Dir, dir), data); err != nil {
+			return err
+		}
+	}
+	engine, err := n.cfg.Open(data)
+	if err != nil {
+		return err
+	}
+	n.engine = engine
+	return nil
+}
+
+// Tick advances the node's clock by one tick.
+func (n *Node) Tick() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state == StateLeader {
+		if n.electionElapsed++; n.electionElapsed >= n.cfg.ElectionTicks {
+			n.electionElapsed = 0
+			if !n.quorumActive() {
+				return n.becomeFollower(n.store.hard.Term, 0)
+			}
+		}
+		if n.heartbeatElapsed++; n.heartbeatElapsed >= n.cfg.HeartbeatTicks {
+			n.heartbeatElapsed = 0
+			return n.broadcast()
+		}
+		return nil
+	}
+	if n.electionElapsed++; n.electionElapsed >= n.timeout {
+		return n.campaign()
+	}
+	return nil
+}
+
+// Messages returns the messages the node sent since the last call.
+func (n *Node) Messages() []Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	msgs := n.msgs
+	n.msgs = nil
+	return msgs
+}
+
+func (n *Node) send(m Message) {
+	m.From, m.Term = n.id, n.store.hard.Term
+	n.msgs = append(n.msgs, m)
+}
+
+func (n *Node) isMember(id uint64) bool {
+	return slices.Contains(n.members, id)
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+// quorumActive reports whether the leader heard from a quorum of members
+// since the last call.
+func (n *Node) quorumActive() bool {
+	count := 0
+	for _, id := range n.members {
+		if id == n.id || n.active[id] {
+			count++
+		}
+	}
+	clear(n.active)
+	return count >= n.quorum()
+}
+
+func (n *Node) resetElection() {
+	n.electionElapsed = 0
+	n.timeout = n.cfg.ElectionTicks + n.rand.Intn(n.cfg.ElectionTicks)
+}
+
+func (n *Node) becomeFollower(term, leader uint64) error {
+	if term != n.store.hard.Term {
+		if err := n.store.setHardState(term, 0); err != nil {
+			return err
+		}
+	}
+	n.state, n.leader = StateFollower, leader
+	n.votes, n.next, n.match, n.active = nil, nil, nil, nil
+	n.resetElection()
+	return nil
+}
+
+// campaign starts an election, unless the node is not a member.
+func (n *Node) campaign() error {
+	n.resetElection()
+	if !n.isMember(n.id) {
+		return nil
+	}
+	if err := n.store.setHardState(n.store.hard.Term+1, n.id); err != nil {
+		return err
+	}
+	n.state, n.leader = StateCandidate, 0
+	n.votes = map[uint64]bool{n.id: true}
+	if n.quorum() == 1 {
+		return n.becomeLeader()
+	}
+	for _, id := range n.members {
+		if id != n.id {
+			n.send(Message{Type: MsgVote, To: id, LogIndex: n.store.lastIndex(), LogTerm: n.store.lastTerm()})
+		}
+	}
+	return nil
+}
+
+func (n *Node) becomeLeader() error {
+	n.state, n.leader = StateLeader, n.id
+	n.votes = nil
+	n.heartbeatElapsed, n.electionElapsed = 0, 0
+	n.next, n.match = make(map[uint64]uint64), make(map[uint64]uint64)
+	n.active = make(map[uint64]bool)
+	n.updateProgress()
+	// Entries of earlier terms are only committed along with one of this
+	// term
+	return n.appendEntries(Entry{Type: EntryNoop})
+}
+
+// updateProgress tracks replication to the current members.
+func (n *Node) updateProgress() {
+	for _, id := range n.members {
+		if _, ok := n.next[id]; !ok {
+			n.next[id], n.match[id] = n.store.lastIndex()+1, 0
+		}
+	}
+	for id := range n.next {
+		if !n.isMember(id) {
+			delete(n.next, id)
+			delete(n.match, id)
+		}
+	}
+}
+
+// appendEntries appends entries to the leader's log and sends them.
+func (n *Node) appendEntries(entries ...Entry) error {
+	last := n.store.lastIndex()
+	for i := range entries {
+		entries[i].Index, entries[i].Term = last+uint64(i)+1, n.store.hard.Term
+	}
+	if err := n.store.append(entries); err != nil {
+		return err
+	}
+	n.members = n.store.membersAt(n.store.lastIndex())
+	n.updateProgress()
+	n.match[n.id] = n.store.lastIndex()
+	if err := n.maybeCommit(); err != nil || n.state != StateLeader {
+		return err
+	}
+	return n.broadcast()
+}
+
+// broadcast sends every other member the entries it is missing, or a
+// heartbeat.
+func (n *Node) broadcast() error {
+	for _, id := range n.members {
+		if id == n.id {
+			continue
+		}
+		if err := n.sendAppend(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendAppend sends to the entries from next[to] on, or the snapshot if
+// they were compacted.
+func (n *Node) sendAppend(to uint64) error {
+	next := n.next[to]
+	prevTerm, ok := n.store.term(next - 1)
+	if !ok {
+		return n.sendSnapshot(to)
+	}
+	last := min(n.store.lastIndex(), next+maxAppendEntries-1)
+	n.send(Message{Type: MsgApp, To: to, LogIndex: next - 1, LogTerm: prevTerm, Entries: n.store.slice(next, last), Commit: n.commit})
+	return nil
+}
+
+func (n *Node) sendSnapshot(to uint64) error {
+	files, err := n.store.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	snap := n.store.snap
+	n.send(Message{Type: MsgSnap, To: to, Snapshot: &Snapshot{Index: snap.Index, Term: snap.Term, Members: snap.Members, Files: files}})
+	// Continue after the snapshot; a lost snapshot is sent again once the
+	// follower rejects the entries that follow it
+	n.next[to] = snap.Index + 1
+	return nil
+}
+
+// maybeCommit commits the newest entry of the current term that a quorum
+// of members stores.
+func (n *Node) maybeCommit() error {
+	for i := n.store.lastIndex(); i > n.commit; i-- {
+		if t, _ := n.store.term(i); t != n.store.hard.Term {
+			break
+		}
+		count := 0
+		for _, id := range n.members {
+			if n.match[id] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commit = i
+			return n.apply()
+		}
+	}
+	return nil
+}
+
+// apply applies committed entries to the engine.
+func (n *Node) apply() error {
+	for n.applied < n.commit {
+		e := n.store.entry(n.applied + 1)
+		if e.Type == EntryCommand {
+			var cmd Command
+			if err := json.Unmarshal(e.Data, &cmd); err != nil {
+				return err
+			}
+			var err error
+			switch cmd.Op {
+			case "put":
+				err = n.engine.Put(cmd.Key, cmd.Value)
+			case "delete":
+				err = n.engine.Delete(cmd.Key)
+			default:
+				err = fmt.Errorf("raftkv: unknown command %q", cmd.Op)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		n.applied++
+	}
+	if n.state == StateLeader && !n.isMember(n.id) && n.commit >= n.lastConfigIndex() {
+		// The leader's removal is committed: leave the rest to the others
+		if err := n.becomeFollower(n.store.hard.Term, 0); err != nil {
+			return err
+		}
+	}
+	return n.maybeSnapshot()
+}
+
+// lastConfigIndex returns the index of the last configuration entry in the
+// log, or 0.
+func (n *Node) lastConfigIndex() uint64 {
+	for i := n.store.lastIndex(); i >= n.store.firstIndex(); i-- {
+		if n.store.entry(i).Type == EntryConfig {
+			return i
+		}
+	}
+	return 0
+}
+
+// maybeSnapshot checkpoints the engine once enough entries were applied
+// since the last snapshot, and drops them from the log.
+func (n *Node) maybeSnapshot() error {
+	if n.applied-n.store.snap.Index < uint64(n.cfg.SnapshotEntries) {
+		return nil
+	}
+	name := fmt.Sprintf("snapshot-%d", n.applied)
+	tmp := filepath.Join(n.cfg.Dir, name+".tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := n.engine.Checkpoint(tmp); err != nil {
+		return err
+	}
+	if err := syncDir(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(n.cfg.Dir, name)); err != nil {
+		return err
+	}
+	term, _ := n.store.term(n.applied)
+	return n.store.saveSnapshot(snapshotMeta{Index: n.applied, Term: term, Members: n.store.membersAt(n.applied), Dir: name})
+}
+
+// Step processes a message from another node.
+func (n *Node) Step(m Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch term := n.store.hard.Term; {
+	case m.Term > term:
+		if m.Type == MsgVote && n.leader != 0 && n.electionElapsed < n.cfg.ElectionTicks {
+			return nil // in contact with a leader: the candidate may be a removed member
+		}
+		leader := uint64(0)
+		if m.Type == MsgApp || m.Type == MsgSnap {
+			leader = m.From
+		}
+		if err := n.becomeFollower(m.Term, leader); err != nil {
+			return err
+		}
+	case m.Term < term:
+		// Tell a stale leader or candidate about the newer term
+		switch m.Type {
+		case MsgApp, MsgSnap:
+			n.send(Message{Type: MsgAppResp, To: m.From, Reject: true})
+		case MsgVote:
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+		return nil
+	}
+
+	switch m.Type {
+	case MsgVote:
+		return n.handleVote(m)
+	case MsgVoteResp:
+		if n.state == StateCandidate {
+			return n.handleVoteResp(m)
+		}
+	case MsgApp, MsgSnap:
+		if n.state == StateLeader {
+			return nil // another leader of the same term cannot exist
+		}
+		n.state, n.leader = StateFollower, m.From
+		n.electionElapsed = 0
+		if m.Type == MsgSnap {
+			return n.handleSnapshot(m)
+		}
+		return n.handleAppend(m)
+	case MsgAppResp:
+		if n.state == StateLeader {
+			return n.handleAppendResp(m)
+		}
+	}
+	return nil
+}
+
+func (n *Node) handleVote(m Message) error {
+	lastIndex, lastTerm := n.store.lastIndex(), n.store.lastTerm()
+	upToDate := m.LogTerm > lastTerm || (m.LogTerm == lastTerm && m.LogIndex >= lastIndex)
+	vote := n.store.hard.Vote
+	grant := (vote == 0 || vote == m.From) && upToDate && n.state == StateFollower
+	if grant && vote == 0 {
+		if err := n.store.setHardState(n.store.hard.Term, m.From); err != nil {
+			return err
+		}
+		n.resetElection()
+	}
+	n.send(Message{Type: MsgVoteResp, To: m.From, Reject: !grant})
+	return nil
+}
+
+func (n *Node) handleVoteResp(m Message) error {
+	if !n.isMember(m.From) {
+		return nil
+	}
+	n.votes[m.From] = !m.Reject
+	granted, rejected := 0, 0
+	for _, ok := range n.votes {
+		if ok {
+			granted++
+		} else {
+			rejected++
+		}
+	}
+	switch {
+	case granted >= n.quorum():
+		return n.becomeLeader()
+	case rejected >= n.quorum():
+		return n.becomeFollower(n.store.hard.Term, 0)
+	}
+	return nil
+}
+
+func (n *Node) handleAppend(m Message) error {
+	prev, prevTerm, entries := m.LogIndex, m.LogTerm, m.Entries
+	if snap := n.store.snap; prev < snap.Index {
+		// Entries up to the snapshot are committed, so they match
+		for len(entries) > 0 && entries[0].Index <= snap.Index {
+			entries = entries[1:]
+		}
+		prev, prevTerm = snap.Index, snap.Term
+		if len(entries) == 0 && m.LogIndex+uint64(len(m.Entries)) < snap.Index {
+			n.send(Message{Type: MsgAppResp, To: m.From, Hint: snap.Index})
+			return nil
+		}
+	}
+	if t, ok := n.store.term(prev); !ok || t != prevTerm {
+		n.send(Message{Type: MsgAppResp, To: m.From, Reject: true, Hint: min(n.store.lastIndex(), prev-1)})
+		return nil
+	}
+
+	for i, e := range entries {
+		if t, ok := n.store.term(e.Index); !ok || t != e.Term {
+			if e.Index <= n.commit {
+				return fmt.Errorf("raftkv: leader %d conflicts with committed entry %d", m.From, e.Index)
+			}
+			if err := n.store.append(entries[i:]); err != nil {
+				return err
+			}
+			n.members = n.store.membersAt(n.store.lastIndex())
+			break
+		}
+	}
+	last := prev + uint64(len(entries))
+	if commit := min(m.Commit, last); commit > n.commit {
+		n.commit = commit
+		if err := n.apply(); err != nil {
+			return err
+		}
+	}
+	n.send(Message{Type: MsgAppResp, To: m.From, Hint: last})
+	return nil
+}
+
+func (n *Node) handleAppendResp(m Message) error {
+	if _, ok := n.next[m.From]; !ok {
+		return nil // no longer a member
+	}
+	n.active[m.From] = true
+	if m.Reject {
+		next := max(min(n.next[m.From]-1, m.Hint+1), n.match[m.From]+1, 1)
+		n.next[m.From] = next
+		return n.sendAppend(m.From)
+	}
+	if m.Hint > n.match[m.From] {
+		n.match[m.From] = m.Hint
+	}
+	if n.next[m.From] <= m.Hint {
+		n.next[m.From] = m.Hint + 1
+	}
+	if err := n.maybeCommit(); err != nil {
+		return err
+	}
+	if n.state == StateLeader && n.next[m.From] <= n.store.lastIndex() {
+		return n.sendAppend(m.From)
+	}
+	return nil
+}
+
+func (n *Node) handleSnapshot(m Message) error {
+	s := m.Snapshot
+	if s == nil {
+		return errors.New("raftkv: snapshot message without a snapshot")
+	}
+	if s.Index <= n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Hint: n.commit})
+		return nil
+	}
+	if t, ok := n.store.term(s.Index); ok && t == s.Term {
+		// The log already holds the snapshot's entries
+		n.commit = s.Index
+		if err := n.apply(); err != nil {
+			return err
+		}
+		n.send(Message{Type: MsgAppResp, To: m.From, Hint: s.Index})
+		return nil
+	}
+
+	name := fmt.Sprintf("snapshot-%d", s.Index)
+	if err := n.store.writeSnapshotFiles(name, s.Files); err != nil {
+		return err
+	}
+	meta := snapshotMeta{Index: s.Index, Term: s.Term, Members: s.Members, Dir: name}
+	if err := n.store.saveSnapshot(meta); err != nil {
+		return err
+	}
+	if err := n.restore(); err != nil {
+		return err
+	}
+	n.commit, n.applied = s.Index, s.Index
+	n.members = n.store.membersAt(n.store.lastIndex())
+	n.send(Message{Type: MsgAppResp, To: m.From, Hint: s.Index})
+	return nil
+}
+
+// propose appends an entry if the node is the leader and returns its
+// index.
+func (n *Node) propose(e Entry) (uint64, error) {
+	if n.state != StateLeader {
+		return 0, ErrNotLeader
+	}
+	if err := n.appendEntries(e); err != nil {
+		return 0, err
+	}
+	return n.store.lastIndex(), nil
+}
+
+// Put proposes writing key and returns the index of its log entry. The
+// write is applied once Status reports the index as applied.
+func (n *Node) Put(key, value string) (uint64, error) {
+	return n.proposeCommand(Command{Op: "put", Key: key, Value: value})
+}
+
+// Delete proposes deleting key and returns the index of its log entry.
+func (n *Node) Delete(key string) (uint64, error) {
+	return n.proposeCommand(Command{Op: "delete", Key: key})
+}
+
+func (n *Node) proposeCommand(cmd Command) (uint64, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return 0, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.propose(Entry{Type: EntryCommand, Data: data})
+}
+
+// Get reads key from the node's engine. It sees the writes the node has
+// applied, which may lag behind the leader.
+func (n *Node) Get(key string) (string, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.engine.Get(key)
+}
+
+// AddMember proposes adding node id to the cluster. The new node starts
+// with no peers and catches up from the leader.
+func (n *Node) AddMember(id uint64) (uint64, error) {
+	return n.changeMembers(id, true)
+}
+
+// RemoveMember proposes removing node id from the cluster. A leader that
+// removes itself steps down once the change is committed.
+func (n *Node) RemoveMember(id uint64) (uint64, error) {
+	return n.changeMembers(id, false)
+}
+
+func (n *Node) changeMembers(id uint64, add bool) (uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.state != StateLeader {
+		return 0, ErrNotLeader
+	}
+	// One change at a time, and not before the leader committed an entry
+	// of its term
+	if t, _ := n.store.term(n.commit); n.lastConfigIndex() > n.commit || t != n.store.hard.Term {
+		return 0, ErrConfigChangePending
+	}
+
+	members := slices.Clone(n.members)
+	switch i := slices.Index(members, id); {
+	case id == 0:
+		return 0, errors.New("raftkv: node ID must not be 0")
+	case add && i >= 0:
+		return 0, fmt.Errorf("raftkv: node %d is already a member", id)
+	case !add && i < 0:
+		return 0, fmt.Errorf("raftkv: node %d is not a member", id)
+	case add:
+		members = append(members, id)
+		slices.Sort(members)
+	default:
+		members = slices.Delete(members, i, i+1)
+		if len(members) == 0 {
+			return 0, errors.New("raftkv: cannot remove the last member")
+		}
+	}
+	data, err := json.Marshal(members)
+	if err != nil {
+		return 0, err
+	}
+	return n.propose(Entry{Type: EntryConfig, Data: data})
+}
+
+// Status returns the node's current state.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		State:         n.state,
+		Term:          n.store.hard.Term,
+		Leader:        n.leader,
+		Commit:        n.commit,
+		Applied:       n.applied,
+		LastIndex:     n.store.lastIndex(),
+		SnapshotIndex: n.store.snap.Index,
+		Members:       slices.Clone(n.members),
+	}
+}
+
+// Close releases the node's files. The node can be started again from its
+// directory with NewNode.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var err error
+	if n.engine != nil {
+		err = n.engine.Close()
+	}
+	if serr := n.store.close(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+package raftkv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// cluster runs nodes in subdirectories of dir on an in-memory network.
+type cluster struct {
+	t    *testing.T
+	dir  string
+	open Opener
+	net  *Network
+}
+
+func newCluster(t *testing.T, dir string, open Opener, seed int64, ids ...uint64) *cluster {
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	c := &cluster{t: t, dir: dir, open: open, net: NewNetwork(seed)}
+	t.Cleanup(func() {
+		for _, id := range c.net.ids() {
+			c.net.Node(id).Close()
+		}
+	})
+	for _, id := range ids {
+		c.start(id, ids)
+	}
+	return c
+}
+
+// start starts node id from its directory and connects it.
+func (c *cluster) start(id uint64, peers []uint64) *Node {
+	n, err := NewNode(Config{
+		ID:              id,
+		Peers:           peers,
+		Dir:             filepath.Join(c.dir, fmt.Sprintf("node%d", id)),
+		Open:            c.open,
+		SnapshotEntries: 20,
+	})
+	if err != nil {
+		c.t.Fatalf("new node %d: %v", id, err)
+	}
+	c.net.Add(n)
+	return n
+}
+
+// stop disconnects and closes node id.
+func (c *cluster) stop(id uint64) {
+	if err := c.net.Remove(id).Close(); err != nil {
+		c.t.Fatalf("close node %d: %v", id, err)
+	}
+}
+
+func (c *cluster) run(what string, cond func() bool) {
+	c.t.Helper()
+	ok, err := c.net.RunUntil(2000, cond)
+	if err != nil {
+		c.t.Fatalf("run: %v", err)
+	}
+	if !ok {
+		c.t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func (c *cluster) leader() *Node {
+	c.t.Helper()
+	c.run("a leader", func() bool { return c.net.Leader() != nil })
+	return c.net.Leader()
+}
+
+// put writes on the leader, retrying when leadership changes or the entry
+// is lost, until every connected node in ids applied it.
+func (c *cluster) put(key, value string, ids ...uint64) {
+	c.t.Helper()
+	for attempt := 0; attempt < 10; attempt++ {
+		leader := c.leader()
+		index, err := leader.Put(key, value)
+		if err != nil {
+			c.t.Fatalf("put %s: %v", key, err)
+		}
+		term := leader.Status().Term
+		applied := func() bool {
+			for _, id := range ids {
+				if c.net.Node(id).Status().Applied < index {
+					return false
+				}
+			}
+			return true
+		}
+		c.net.RunUntil(500, func() bool { return applied() || leader.Status().Term != term })
+		if applied() {
+			if v, _, _ := c.net.Node(ids[0]).Get(key); v == value {
+				return
+			}
+		}
+	}
+	c.t.Fatalf("put %s was not applied", key)
+}
+
+func (c *cluster) check(id uint64, key, want string) {
+	c.t.Helper()
+	v, ok, err := c.net.Node(id).Get(key)
+	if err != nil || ok != (want != "") || v != want {
+		c.t.Fatalf("node %d: %s = %q, %v, %v; want %q", id, key, v, ok, err, want)
+	}
+}
+
+func TestElectionAndReplication(t *testing.T) {
+	c := newCluster(t, "test_raftkv_replication", OpenLSM(8), 1, 1, 2, 3)
+	leader := c.leader()
+	for _, id := range []uint64{1, 2, 3} {
+		if n := c.net.Node(id); n != leader && n.Status().State != StateFollower {
+			t.Fatalf("node %d is %s, want follower", id, n.Status().State)
+		}
+	}
+	for _, id := range []uint64{1, 2, 3} {
+		if n := c.net.Node(id); n != leader {
+			if _, err := n.Put("k", "v"); err != ErrNotLeader {
+				t.Fatalf("expected ErrNotLeader from a follower, got %v", err)
+			}
+			break
+		}
+	}
+
+	for i := range 10 {
+		c.put(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i), 1, 2, 3)
+	}
+	index, err := c.leader().Delete("k3")
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	c.run("the delete", func() bool {
+		for _, id := range []uint64{1, 2, 3} {
+			if c.net.Node(id).Status().Applied < index {
+				return false
+			}
+		}
+		return true
+	})
+	for _, id := range []uint64{1, 2, 3} {
+		c.check(id, "k5", "v5")
+		c.check(id, "k3", "")
+	}
+}
+
+func TestPartitionAndLoss(t *testing.T) {
+	c := newCluster(t, "test_raftkv_partition", OpenLSM(8), 2, 1, 2, 3, 4, 5)
+	old := c.leader()
+	c.put("a", "1", 1, 2, 3, 4, 5)
+
+	// The majority elects a new leader and keeps accepting writes; the
+	// old leader steps down
+	var minority, majority []uint64
+	for _, id := range []uint64{1, 2, 3, 4, 5} {
+		if id == old.id || (len(minority) == 1 && len(majority) == 3) {
+			minority = append(minority, id)
+		} else {
+			majority = append(majority, id)
+		}
+	}
+	c.net.Partition(minority, majority)
+	c.run("a majority leader", func() bool {
+		l := c.net.Leader()
+		return l != nil && slices.Contains(majority, l.id) && old.Status().State != StateLeader
+	})
+	if _, err := old.Put("lost", "x"); err != ErrNotLeader {
+		t.Fatalf("expected ErrNotLeader from the old leader, got %v", err)
+	}
+	c.put("b", "2", majority...)
+
+	// After healing, the minority catches up, even with messages lost
+	c.net.Heal()
+	c.net.SetDropRate(0.2)
+	for i := range 5 {
+		c.put(fmt.Sprintf("c%d", i), "3", 1, 2, 3, 4, 5)
+	}
+	c.net.SetDropRate(0)
+	c.run("all nodes to catch up", func() bool {
+		commit := c.leader().Status().Commit
+		for _, id := range []uint64{1, 2, 3, 4, 5} {
+			if c.net.Node(id).Status().Applied < commit {
+				return false
+			}
+		}
+		return true
+	})
+	for _, id := range []uint64{1, 2, 3, 4, 5} {
+		c.check(id, "b", "2")
+		c.check(id, "c4", "3")
+		c.check(id, "lost", "")
+	}
+}
+
+func TestSnapshotsAndMembership(t *testing.T) {
+	c := newCluster(t, "test_raftkv_membership", OpenBTree(4), 3, 1, 2, 3)
+	leader := c.leader()
+
+	// A node that misses enough entries is sent a snapshot
+	var lagging uint64
+	for _, id := range []uint64{1, 2, 3} {
+		if id != leader.id {
+			lagging = id
+			break
+		}
+	}
+	var others []uint64
+	for _, id := range []uint64{1, 2, 3} {
+		if id != lagging {
+			others = append(others, id)
+		}
+	}
+	c.net.Partition([]uint64{lagging}, others)
+	for i := range 50 {
+		c.put(fmt.Sprintf("k%02d", i), fmt.Sprint(i), others...)
+	}
+	if s := c.leader().Status(); s.SnapshotIndex == 0 {
+		t.Fatalf("expected a snapshot, got %+v", s)
+	}
+	c.net.Heal()
+	c.put("after", "heal", 1, 2, 3)
+	c.check(lagging, "k10", "10")
+	if s := c.net.Node(lagging).Status(); s.SnapshotIndex == 0 {
+		t.Fatalf("expected the lagging node to install a snapshot, got %+v", s)
+	}
+
+	// An added node catches up from the leader
+	if _, err := c.leader().RemoveMember(9); err == nil {
+		t.Fatalf("expected an error removing a non-member")
+	}
+	c.start(4, nil)
+	index, err := c.leader().AddMember(4)
+	if err != nil {
+		t.Fatalf("add member: %v", err)
+	}
+	if _, err := c.leader().AddMember(5); err != ErrConfigChangePending {
+		t.Fatalf("expected ErrConfigChangePending, got %v", err)
+	}
+	c.run("node 4 to join", func() bool { return c.net.Node(4).Status().Applied >= index })
+	c.check(4, "k42", "42")
+	if s := c.net.Node(4).Status(); !slices.Equal(s.Members, []uint64{1, 2, 3, 4}) {
+		t.Fatalf("unexpected members %v", s.Members)
+	}
+
+	// A removed leader steps down and the rest elect a new one
+	old := c.leader()
+	if _, err := old.RemoveMember(old.id); err != nil {
+		t.Fatalf("remove member: %v", err)
+	}
+	c.run("a new leader", func() bool {
+		l := c.net.Leader()
+		return l != nil && l != old
+	})
+	var rest []uint64
+	for _, id := range []uint64{1, 2, 3, 4} {
+		if id != old.id {
+			rest = append(rest, id)
+		}
+	}
+	c.put("without", "old", rest...)
+	if s := c.leader().Status(); len(s.Members) != 3 || slices.Contains(s.Members, old.id) {
+		t.Fatalf("unexpected members %v", s.Members)
+	}
+	if s := old.Status(); s.State == StateLeader {
+		t.Fatalf("removed node is still the leader: %+v", s)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	c := newCluster(t, "test_raftkv_restart", OpenLSM(4), 4, 1, 2, 3)
+	for i := range 30 {
+		c.put(fmt.Sprintf("k%02d", i), fmt.Sprint(i), 1, 2, 3)
+	}
+
+	// Every node restarts from its snapshot and log
+	for _, id := range []uint64{1, 2, 3} {
+		c.stop(id)
+	}
+	for _, id := range []uint64{1, 2, 3} {
+		c.start(id, []uint64{1, 2, 3})
+	}
+	c.put("new", "write", 1, 2, 3)
+	for _, id := range []uint64{1, 2, 3} {
+		c.check(id, "k05", "5")
+		c.check(id, "k29", "29")
+		if s := c.net.Node(id).Status(); s.Term < 2 || s.SnapshotIndex == 0 {
+			t.Fatalf("node %d did not keep its state: %+v", id, s)
+		}
+	}
+}
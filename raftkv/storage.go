@@ -0,0 +1,382 @@
+package raftkv
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A node directory is laid out as:
+//
+//	state.json     current term and vote
+//	log.jsonl      log entries after the snapshot, one JSON entry per line
+//	snapshot.json  index, term and members of the snapshot
+//	snapshot-<n>/  engine checkpoint of the snapshot at index n
+//	data/          the engine's working files, rebuilt from the snapshot on start
+const (
+	stateName    = "state.json"
+	logName      = "log.jsonl"
+	snapshotName = "snapshot.json"
+	dataName     = "data"
+)
+
+// EntryType is the kind of a log entry.
+type EntryType string
+
+const (
+	EntryNoop    EntryType = "noop"    // appended by a new leader to commit earlier entries
+	EntryCommand EntryType = "command" // a Command for the engine
+	EntryConfig  EntryType = "config"  // the new member list, JSON encoded
+)
+
+// Entry is a log entry.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// hardState is the state a node must not forget across restarts.
+type hardState struct {
+	Term uint64 `json:"term"`
+	Vote uint64 `json:"vote"` // candidate voted for in Term; 0 for none
+}
+
+// snapshotMeta describes the latest snapshot. Before the first snapshot
+// Index is 0 and Members holds the initial members.
+type snapshotMeta struct {
+	Index   uint64   `json:"index"`
+	Term    uint64   `json:"term"`
+	Members []uint64 `json:"members"`
+	Dir     string   `json:"dir"` // checkpoint directory; empty before the first snapshot
+}
+
+// storage persists a node's hard state, log and snapshot.
+type storage struct {
+	dir     string
+	hard    hardState
+	snap    snapshotMeta
+	entries []Entry // entries after snap.Index, by index
+	log     *os.File
+}
+
+// openStorage loads the state in dir. A new directory starts with peers as
+// its members.
+func openStorage(dir string, peers []uint64) (*storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &storage{dir: dir}
+	// A new node has not voted yet
+	if err := readJSON(filepath.Join(dir, stateName), &s.hard); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	err := readJSON(filepath.Join(dir, snapshotName), &s.snap)
+	if os.IsNotExist(err) {
+		s.snap.Members = append([]uint64(nil), peers...)
+		err = writeJSON(filepath.Join(dir, snapshotName), s.snap)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Checkpoints of snapshots replaced before a crash
+	paths, err := filepath.Glob(filepath.Join(dir, "snapshot-*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		if filepath.Base(path) != s.snap.Dir {
+			os.RemoveAll(path)
+		}
+	}
+
+	if err := s.loadLog(); err != nil {
+		return nil, err
+	}
+	return s, s.rewriteLog()
+}
+
+// loadLog reads the entries following the snapshot. A torn final line left
+// by a crash ends the log.
+func (s *storage) loadLog() error {
+	f, err := os.Open(filepath.Join(s.dir, logName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		if e.Index <= s.snap.Index {
+			continue
+		}
+		if e.Index != s.lastIndex()+1 {
+			return fmt.Errorf("raftkv: log entry %d follows %d", e.Index, s.lastIndex())
+		}
+		s.entries = append(s.entries, e)
+	}
+	return scanner.Err()
+}
+
+// rewriteLog replaces the log file with the current entries.
+func (s *storage) rewriteLog() error {
+	path := filepath.Join(s.dir, logName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range s.entries {
+		if err := writeEntry(w, e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	return err
+}
+
+func writeEntry(w *bufio.Writer, e Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	return w.WriteByte('\n')
+}
+
+// setHardState records the current term and vote.
+func (s *storage) setHardState(term, vote uint64) error {
+	s.hard = hardState{Term: term, Vote: vote}
+	return writeJSON(filepath.Join(s.dir, stateName), s.hard)
+}
+
+// firstIndex returns the index of the first entry after the snapshot.
+func (s *storage) firstIndex() uint64 {
+	return s.snap.Index + 1
+}
+
+// lastIndex returns the index of the last entry, or of the snapshot.
+func (s *storage) lastIndex() uint64 {
+	return s.snap.Index + uint64(len(s.entries))
+}
+
+// term returns the term of entry i, reporting false if it is compacted
+// into the snapshot or beyond the log.
+func (s *storage) term(i uint64) (uint64, bool) {
+	switch {
+	case i == s.snap.Index:
+		return s.snap.Term, true
+	case i < s.snap.Index || i > s.lastIndex():
+		return 0, false
+	}
+	return s.entries[i-s.firstIndex()].Term, true
+}
+
+// lastTerm returns the term of the last entry.
+func (s *storage) lastTerm() uint64 {
+	t, _ := s.term(s.lastIndex())
+	return t
+}
+
+// entry returns entry i, which must be in the log.
+func (s *storage) entry(i uint64) Entry {
+	return s.entries[i-s.firstIndex()]
+}
+
+// slice returns the entries lo through hi, which must be in the log.
+func (s *storage) slice(lo, hi uint64) []Entry {
+	if lo > hi {
+		return nil
+	}
+	return append([]Entry(nil), s.entries[lo-s.firstIndex():hi-s.firstIndex()+1]...)
+}
+
+// append adds entries to the log, first dropping any entries from the
+// index of the first one on. They are on disk when it returns, since the
+// node acknowledges them to the leader.
+func (s *storage) append(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	first := entries[0].Index
+	if first <= s.lastIndex() {
+		s.entries = append(s.entries[:first-s.firstIndex()], entries...)
+		return s.rewriteLog()
+	}
+	s.entries = append(s.entries, entries...)
+	w := bufio.NewWriter(s.log)
+	for _, e := range entries {
+		if err := writeEntry(w, e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// membersAt returns the members in effect at index i: those of the last
+// configuration entry up to i, or else those of the snapshot.
+func (s *storage) membersAt(i uint64) []uint64 {
+	for j := min(i, s.lastIndex()); j >= s.firstIndex(); j-- {
+		if e := s.entry(j); e.Type == EntryConfig {
+			var members []uint64
+			json.Unmarshal(e.Data, &members)
+			return members
+		}
+	}
+	return append([]uint64(nil), s.snap.Members...)
+}
+
+// saveSnapshot makes the checkpoint in directory name of the snapshot
+// meta and drops the log entries it covers, keeping the entries after it
+// only if the log agrees with it at its index.
+func (s *storage) saveSnapshot(meta snapshotMeta) error {
+	var entries []Entry
+	if t, ok := s.term(meta.Index); ok && t == meta.Term {
+		entries = s.slice(meta.Index+1, s.lastIndex())
+	}
+	old := s.snap.Dir
+	if err := writeJSON(filepath.Join(s.dir, snapshotName), meta); err != nil {
+		return err
+	}
+	s.snap, s.entries = meta, entries
+	if old != "" && old != meta.Dir {
+		os.RemoveAll(filepath.Join(s.dir, old))
+	}
+	return s.rewriteLog()
+}
+
+// snapshotFiles reads the files of the snapshot's checkpoint.
+func (s *storage) snapshotFiles() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	if s.snap.Dir == "" {
+		return files, nil
+	}
+	dir := filepath.Join(s.dir, s.snap.Dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		files[entry.Name()] = data
+	}
+	return files, nil
+}
+
+// writeSnapshotFiles writes received checkpoint files into directory name.
+func (s *storage) writeSnapshotFiles(name string, files map[string][]byte) error {
+	dir := filepath.Join(s.dir, name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	for file, data := range files {
+		if file == "" || filepath.Base(file) != file || strings.HasPrefix(file, ".") {
+			return fmt.Errorf("raftkv: bad snapshot file name %q", file)
+		}
+		if err := writeFile(filepath.Join(dir, file), data); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+func (s *storage) close() error {
+	return s.log.Close()
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file at path with v atomically and durably: the
+// node grants votes and acknowledges entries based on what it wrote.
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := writeFile(tmp, data); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// writeFile writes data to path and syncs it.
+func writeFile(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir makes the creation, renaming and removal of files in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}